@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -12,6 +14,7 @@ import (
 	"github.com/tinsane/storages/storage"
 	"github.com/tinsane/tracelog"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/pkg/errors"
 )
@@ -22,11 +25,17 @@ const (
 	BufferSizeSetting = "AZURE_BUFFER_SIZE"
 	MaxBuffersSetting = "AZURE_MAX_BUFFERS"
 	TryTimeoutSetting = "AZURE_TRY_TIMEOUT"
-	minBufferSize     = 1024
-	defaultBufferSize = 64 * 1024 * 1024
-	minBuffers        = 1
-	defaultBuffers    = 3
-	defaultTryTimeout = 5
+	// Large blobs are downloaded by concurrent range requests if concurrency is greater than 1
+	DownloadConcurrencySetting = "AZURE_DOWNLOAD_CONCURRENCY"
+	DownloadChunkSizeSetting   = "AZURE_DOWNLOAD_CHUNK_SIZE"
+	DownloadMemoryLimitSetting = "AZURE_DOWNLOAD_MEMORY_LIMIT"
+	minBufferSize              = 1024
+	defaultBufferSize          = 64 * 1024 * 1024
+	minBuffers                 = 1
+	defaultBuffers             = 3
+	defaultTryTimeout          = 5
+	// Access tier of uploaded blobs: Hot, Cool or Archive, the default tier of the account is used if not set
+	AccessTierSetting = "AZURE_ACCESS_TIER"
 )
 
 var SettingList = []string{
@@ -34,6 +43,10 @@ var SettingList = []string{
 	AccessKeySetting,
 	BufferSizeSetting,
 	MaxBuffersSetting,
+	DownloadConcurrencySetting,
+	DownloadChunkSizeSetting,
+	DownloadMemoryLimitSetting,
+	AccessTierSetting,
 }
 
 func NewFolderError(err error, format string, args ...interface{}) storage.Error {
@@ -45,11 +58,31 @@ func NewCredentialError(settingName string) storage.Error {
 		"%s setting is not set", settingName)
 }
 
+// FolderOptions are optional settings of the folder, zero value uses defaults
+type FolderOptions struct {
+	// URLs can be signed only with the shared key credential
+	Credential   *azblob.SharedKeyCredential
+	ParallelRead storage.ParallelReadOptions
+	// Empty access tier means the default tier of the account
+	AccessTier azblob.AccessTierType
+	// Pipeline of the container URL is used to count bytes of sent blocks,
+	// progress counts bytes read from content if it is not set
+	Pipeline pipeline.Pipeline
+}
+
 func NewFolder(
 	uploadStreamToBlockBlobOptions azblob.UploadStreamToBlockBlobOptions,
 	containerURL azblob.ContainerURL,
 	path string) *Folder {
-	return &Folder{uploadStreamToBlockBlobOptions, containerURL, path}
+	return NewFolderWithOptions(uploadStreamToBlockBlobOptions, containerURL, path, FolderOptions{})
+}
+
+func NewFolderWithOptions(
+	uploadStreamToBlockBlobOptions azblob.UploadStreamToBlockBlobOptions,
+	containerURL azblob.ContainerURL,
+	path string,
+	options FolderOptions) *Folder {
+	return &Folder{uploadStreamToBlockBlobOptions, containerURL, path, options}
 }
 
 func ConfigureFolder(prefix string, settings map[string]string) (storage.Folder, error) {
@@ -87,13 +120,25 @@ func ConfigureFolder(prefix string, settings map[string]string) (storage.Folder,
 	}
 	containerURL := azblob.NewContainerURL(*serviceURL, pipeLine)
 	path = storage.AddDelimiterToPath(path)
-	return NewFolder(getUploadStreamToBlockBlobOptions(settings), containerURL, path), nil
+	parallelReadOptions, err := storage.ConfigureParallelReadOptions(settings,
+		DownloadConcurrencySetting, DownloadChunkSizeSetting, DownloadMemoryLimitSetting)
+	if err != nil {
+		return nil, NewFolderError(err, "Invalid download settings")
+	}
+	options := FolderOptions{
+		Credential:   credential,
+		ParallelRead: parallelReadOptions,
+		AccessTier:   azblob.AccessTierType(settings[AccessTierSetting]),
+		Pipeline:     pipeLine,
+	}
+	return NewFolderWithOptions(getUploadStreamToBlockBlobOptions(settings), containerURL, path, options), nil
 }
 
 type Folder struct {
 	uploadStreamToBlockBlobOptions azblob.UploadStreamToBlockBlobOptions
 	containerURL                   azblob.ContainerURL
 	path                           string
+	options                        FolderOptions
 }
 
 func (folder *Folder) GetPath() string {
@@ -137,7 +182,7 @@ func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []stora
 		for _, blobPrefix := range blobPrefixes {
 			subFolderPath := blobPrefix.Name
 
-			subFolders = append(subFolders, NewFolder(folder.uploadStreamToBlockBlobOptions, folder.containerURL, subFolderPath))
+			subFolders = append(subFolders, NewFolderWithOptions(folder.uploadStreamToBlockBlobOptions, folder.containerURL, subFolderPath, folder.options))
 		}
 
 	}
@@ -145,16 +190,20 @@ func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []stora
 }
 
 func (folder *Folder) GetSubFolder(subFolderRelativePath string) storage.Folder {
-	return NewFolder(
+	return NewFolderWithOptions(
 		folder.uploadStreamToBlockBlobOptions,
 		folder.containerURL,
-		storage.AddDelimiterToPath(storage.JoinPath(folder.path, subFolderRelativePath)))
+		storage.AddDelimiterToPath(storage.JoinPath(folder.path, subFolderRelativePath)),
+		folder.options)
 }
 
 func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, error) {
 	//Download blob using blobURL obtained from full path to blob
 	path := storage.JoinPath(folder.path, objectRelativePath)
 	blobURL := folder.containerURL.NewBlockBlobURL(path)
+	if folder.options.ParallelRead.Enabled() {
+		return folder.readObjectInParallel(path, blobURL)
+	}
 	downloadResponse, err := blobURL.Download(context.Background(), 0, 0, azblob.BlobAccessConditions{}, false)
 	if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
 		return nil, storage.NewObjectNotFoundError(path)
@@ -168,21 +217,193 @@ func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, erro
 	return content, nil
 }
 
+// readObjectInParallel downloads blobs bigger than one chunk by concurrent range requests.
+// Ranges are requested with the ETag of the blob, so a concurrent overwrite fails the read instead of mixing versions
+func (folder *Folder) readObjectInParallel(path string, blobURL azblob.BlockBlobURL) (io.ReadCloser, error) {
+	properties, err := blobURL.GetProperties(context.Background(), azblob.BlobAccessConditions{})
+	if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return nil, storage.NewObjectNotFoundError(path)
+	}
+	if err != nil {
+		return nil, NewFolderError(err, "Unable to stat blob %s.", path)
+	}
+	accessConditions := azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: properties.ETag()},
+	}
+	readRange := func(offset, length int64) (io.ReadCloser, error) {
+		downloadResponse, err := blobURL.Download(context.Background(), offset, length, accessConditions, false)
+		if err != nil {
+			return nil, err
+		}
+		return downloadResponse.Body(azblob.RetryReaderOptions{}), nil
+	}
+	size := properties.ContentLength()
+	if size <= folder.options.ParallelRead.ChunkSize {
+		// Zero count means the whole blob
+		return readRange(0, 0)
+	}
+	return storage.NewParallelReader(size, readRange, folder.options.ParallelRead), nil
+}
+
+// SignedURL returns blob url with service SAS, which allows only reading or only writing the blob
+func (folder *Folder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	if err := storage.CheckSignedURLMethod(method); err != nil {
+		return "", err
+	}
+	if folder.options.Credential == nil {
+		return "", storage.NewUnsupportedOperationError("Azure without shared key credential", "signed URLs")
+	}
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	blobURLParts := azblob.NewBlobURLParts(folder.containerURL.NewBlockBlobURL(path).URL())
+	permissions := azblob.BlobSASPermissions{Read: true}
+	if method == http.MethodPut {
+		permissions = azblob.BlobSASPermissions{Create: true, Write: true}
+	}
+	sasQueryParameters, err := azblob.BlobSASSignatureValues{
+		Protocol:      azblob.SASProtocolHTTPS,
+		ExpiryTime:    time.Now().UTC().Add(expiry),
+		ContainerName: blobURLParts.ContainerName,
+		BlobName:      blobURLParts.BlobName,
+		Permissions:   permissions.String(),
+	}.NewSASQueryParameters(folder.options.Credential)
+	if err != nil {
+		return "", NewFolderError(err, "Unable to sign url of blob %v", path)
+	}
+	blobURLParts.SAS = sasQueryParameters
+	signedURL := blobURLParts.URL()
+	return signedURL.String(), nil
+}
+
 func (folder *Folder) PutObject(name string, content io.Reader) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{})
+}
+
+// PutObjectWithStorageClass uploads the blob and sets its access tier, empty tier means the account default
+func (folder *Folder) PutObjectWithStorageClass(name string, content io.Reader, storageClass string) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{StorageClass: storageClass})
+}
+
+// PutObjectWithCondition checks ETag of the blob when the block list is committed, which is the version of the blob
+func (folder *Folder) PutObjectWithCondition(name string, content io.Reader, condition storage.PutCondition) (string, error) {
+	return folder.putObject(name, content, storage.PutOptions{Condition: &condition})
+}
+
+// PutObjectWithOptions uploads the blob with HTTP headers and metadata, which Azure returns on download
+func (folder *Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	_, err := folder.putObject(name, content, options)
+	return err
+}
+
+// putObject returns ETag of the uploaded blob, setting the access tier does not change it
+func (folder *Folder) putObject(name string, content io.Reader, options storage.PutOptions) (version string, err error) {
 	tracelog.DebugLogger.Printf("Put %v into %v\n", name, folder.path)
 	//Upload content to a block blob using full path
 	path := storage.JoinPath(folder.path, name)
 	blobURL := folder.containerURL.NewBlockBlobURL(path)
-	_, err := azblob.UploadStreamToBlockBlob(context.Background(), content, blobURL, folder.uploadStreamToBlockBlobOptions)
+	uploadOptions := folder.uploadStreamToBlockBlobOptions
+	uploadOptions.BlobHTTPHeaders = azblob.BlobHTTPHeaders{
+		ContentType:     options.ContentType,
+		ContentEncoding: options.ContentEncoding,
+		CacheControl:    options.CacheControl,
+	}
+	uploadOptions.Metadata = options.Metadata
+	if options.Progress != nil && folder.options.Pipeline != nil {
+		blobURL = blobURL.WithPipeline(&progressPipeline{folder.options.Pipeline, options.Progress})
+	} else {
+		content = storage.TrackProgress(content, options.Progress)
+	}
+	if options.Condition != nil && options.Condition.IfNoneMatch {
+		uploadOptions.AccessConditions.ModifiedAccessConditions.IfNoneMatch = azblob.ETagAny
+	}
+	if options.Condition != nil && options.Condition.IfMatch != "" {
+		uploadOptions.AccessConditions.ModifiedAccessConditions.IfMatch = azblob.ETag(options.Condition.IfMatch)
+	}
+	response, err := azblob.UploadStreamToBlockBlob(context.Background(), content, blobURL, uploadOptions)
+	if stgErr, ok := err.(azblob.StorageError); ok &&
+		(stgErr.ServiceCode() == azblob.ServiceCodeConditionNotMet || stgErr.ServiceCode() == azblob.ServiceCodeBlobAlreadyExists) {
+		return "", storage.NewPreconditionFailedError(path)
+	}
 	if err != nil {
-		return NewFolderError(err, "Unable to upload blob %v", name)
+		return "", NewFolderError(err, "Unable to upload blob %v", name)
+	}
+	accessTier := azblob.AccessTierType(options.StorageClass)
+	if accessTier == "" {
+		accessTier = folder.options.AccessTier
+	}
+	if accessTier != "" {
+		_, err = blobURL.SetTier(context.Background(), accessTier, azblob.LeaseAccessConditions{})
+		if err != nil {
+			return "", NewFolderError(err, "Unable to set access tier of blob %v to %v", name, accessTier)
+		}
 	}
 
 	tracelog.DebugLogger.Printf("Put %v done\n", name)
+	return string(response.ETag()), nil
+}
+
+// PutObjectWithProgress counts bytes of sent blocks, so progress is not ahead of the upload by buffered blocks
+func (folder *Folder) PutObjectWithProgress(name string, content io.Reader, tracker *storage.ProgressTracker) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{Progress: tracker})
+}
+
+// progressPipeline adds the size of blocks and blobs to the tracker when they are sent successfully,
+// failed attempts are retried inside the underlying pipeline, so they are not counted
+type progressPipeline struct {
+	pipeline pipeline.Pipeline
+	tracker  *storage.ProgressTracker
+}
+
+func (p *progressPipeline) Do(ctx context.Context, methodFactory pipeline.Factory, request pipeline.Request) (pipeline.Response, error) {
+	response, err := p.pipeline.Do(ctx, methodFactory, request)
+	if err == nil && request.Method == http.MethodPut {
+		// Block list and access tier are put without content of the blob
+		switch request.URL.Query().Get("comp") {
+		case "", "block":
+			p.tracker.Add(request.ContentLength)
+		}
+	}
+	return response, err
+}
+
+func (folder *Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	properties, err := folder.containerURL.NewBlockBlobURL(path).GetProperties(context.Background(), azblob.BlobAccessConditions{})
+	if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return storage.ObjectAttributes{}, storage.NewObjectNotFoundError(path)
+	}
+	if err != nil {
+		return storage.ObjectAttributes{}, NewFolderError(err, "Unable to stat blob %v", path)
+	}
+	return storage.ObjectAttributes{
+		PutOptions: storage.PutOptions{
+			ContentType:     properties.ContentType(),
+			ContentEncoding: properties.ContentEncoding(),
+			CacheControl:    properties.CacheControl(),
+			Metadata:        properties.NewMetadata(),
+		},
+		Size:         properties.ContentLength(),
+		LastModified: properties.LastModified(),
+		Version:      string(properties.ETag()),
+	}, nil
+}
+
+// SetStorageClass sets access tier of the blob. Blobs moved to Archive tier can not be read until they are rehydrated
+func (folder *Folder) SetStorageClass(objectRelativePath, storageClass string) error {
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	blobURL := folder.containerURL.NewBlockBlobURL(path)
+	_, err := blobURL.SetTier(context.Background(), azblob.AccessTierType(storageClass), azblob.LeaseAccessConditions{})
+	if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return storage.NewObjectNotFoundError(path)
+	}
+	if err != nil {
+		return NewFolderError(err, "Unable to set access tier of blob %v to %v", path, storageClass)
+	}
 	return nil
 }
 
+// DeleteObjects tries to delete every object, failures are reported together by storage.DeleteObjectsError
 func (folder *Folder) DeleteObjects(objectRelativePaths []string) error {
+	var failures []storage.DeleteFailure
 	for _, objectRelativePath := range objectRelativePaths {
 		//Delete blob using blobURL obtained from full path to blob
 		path := storage.JoinPath(folder.path, objectRelativePath)
@@ -193,11 +414,13 @@ func (folder *Folder) DeleteObjects(objectRelativePaths []string) error {
 			continue
 		}
 		if err != nil {
-			return NewFolderError(err, "Unable to delete object %v", path)
-		} else {
-			//blob is deleted
+			tracelog.WarningLogger.Printf("Unable to delete object %v: %v\n", path, err)
+			failures = append(failures, storage.DeleteFailure{ObjectRelativePath: objectRelativePath, Err: err})
 		}
 	}
+	if len(failures) > 0 {
+		return storage.NewDeleteObjectsError("Azure", failures)
+	}
 	return nil
 }
 
@@ -216,3 +439,78 @@ func getUploadStreamToBlockBlobOptions(settings map[string]string) azblob.Upload
 	}
 	return azblob.UploadStreamToBlockBlobOptions{MaxBuffers: maxBuffers, BufferSize: bufferSize}
 }
+
+// ListObjectVersions lists the base blob and its snapshots, the base blob has empty version id
+func (folder *Folder) ListObjectVersions(objectRelativePath string) ([]storage.ObjectVersion, error) {
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	options := azblob.ListBlobsSegmentOptions{
+		Details: azblob.BlobListingDetails{Snapshots: true},
+		Prefix:  path,
+	}
+	var versions []storage.ObjectVersion
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		blobs, err := folder.containerURL.ListBlobsFlatSegment(context.Background(), marker, options)
+		if err != nil {
+			return nil, NewFolderError(err, "Unable to list snapshots of %v", path)
+		}
+		for _, blob := range blobs.Segment.BlobItems {
+			if blob.Name != path {
+				continue
+			}
+			version := storage.ObjectVersion{
+				ObjectRelativePath: objectRelativePath,
+				VersionID:          blob.Snapshot,
+				IsLatest:           blob.Snapshot == "",
+				LastModified:       time.Time(blob.Properties.LastModified),
+			}
+			if blob.Properties.ContentLength != nil {
+				version.Size = *blob.Properties.ContentLength
+			}
+			versions = append(versions, version)
+		}
+		marker = blobs.NextMarker
+	}
+	// Snapshot times have fixed width, so they are compared as strings
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].IsLatest != versions[j].IsLatest {
+			return versions[i].IsLatest
+		}
+		return versions[i].VersionID > versions[j].VersionID
+	})
+	return versions, nil
+}
+
+func (folder *Folder) ReadObjectVersion(objectRelativePath, versionID string) (io.ReadCloser, error) {
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	blobURL := folder.containerURL.NewBlockBlobURL(path).WithSnapshot(versionID)
+	downloadResponse, err := blobURL.Download(context.Background(), 0, 0, azblob.BlobAccessConditions{}, false)
+	if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return nil, storage.NewObjectNotFoundError(path + "?snapshot=" + versionID)
+	}
+	if err != nil {
+		return nil, NewFolderError(err, "Unable to download snapshot %s of blob %s.", versionID, path)
+	}
+	return downloadResponse.Body(azblob.RetryReaderOptions{}), nil
+}
+
+// DeleteObjectVersions deletes snapshots, the base blob can be deleted only after all of its snapshots
+func (folder *Folder) DeleteObjectVersions(versions []storage.ObjectVersion) error {
+	var failures []storage.DeleteFailure
+	for _, version := range versions {
+		path := storage.JoinPath(folder.path, version.ObjectRelativePath)
+		blobURL := folder.containerURL.NewBlockBlobURL(path).WithSnapshot(version.VersionID)
+		tracelog.DebugLogger.Printf("Delete %v?snapshot=%v\n", path, version.VersionID)
+		_, err := blobURL.Delete(context.Background(), azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+		if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+			continue
+		}
+		if err != nil {
+			tracelog.WarningLogger.Printf("Unable to delete snapshot %v of object %v: %v\n", version.VersionID, path, err)
+			failures = append(failures, storage.DeleteFailure{ObjectRelativePath: version.ObjectRelativePath, Err: err})
+		}
+	}
+	if len(failures) > 0 {
+		return storage.NewDeleteObjectsError("Azure", failures)
+	}
+	return nil
+}
@@ -1,9 +1,17 @@
 package azure
 
 import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/stretchr/testify/assert"
 	"github.com/tinsane/storages/storage"
-	"testing"
 )
 
 func TestAzureFolder(t *testing.T) {
@@ -16,3 +24,56 @@ func TestAzureFolder(t *testing.T) {
 
 	storage.RunFolderTest(storageFolder, t)
 }
+
+// sentPipeline succeeds without sending requests
+type sentPipeline struct{}
+
+func (sentPipeline) Do(ctx context.Context, methodFactory pipeline.Factory, request pipeline.Request) (pipeline.Response, error) {
+	return pipeline.NewHTTPResponse(&http.Response{StatusCode: http.StatusCreated}), nil
+}
+
+func TestProgressPipelineCountsSentBlocks(t *testing.T) {
+	tracker := storage.NewProgressTracker(0, storage.ProgressOptions{})
+	progressPipeline := &progressPipeline{sentPipeline{}, tracker}
+	for _, query := range []string{"comp=block&blockid=1", "", "comp=blocklist", "comp=tier"} {
+		blobURL, err := url.Parse("https://account.blob.core.windows.net/container/blob?" + query)
+		assert.NoError(t, err)
+		request, err := pipeline.NewRequest(http.MethodPut, *blobURL, bytes.NewReader(make([]byte, 10)))
+		assert.NoError(t, err)
+		_, err = progressPipeline.Do(context.Background(), nil, request)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int64(20), tracker.Progress().Transferred)
+}
+
+func TestSignedURLNeedsSharedKeyCredential(t *testing.T) {
+	containerURL, err := url.Parse("https://account.blob.core.windows.net/container")
+	assert.NoError(t, err)
+	folder := NewFolder(azblob.UploadStreamToBlockBlobOptions{},
+		azblob.NewContainerURL(*containerURL, sentPipeline{}), "folder/")
+	_, err = folder.SignedURL("object", http.MethodGet, time.Minute)
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+
+	credential, err := azblob.NewSharedKeyCredential("account", "a2V5")
+	assert.NoError(t, err)
+	folder = NewFolderWithOptions(azblob.UploadStreamToBlockBlobOptions{},
+		azblob.NewContainerURL(*containerURL, sentPipeline{}), "folder/", FolderOptions{Credential: credential})
+	signedURL, err := folder.SignedURL("object", http.MethodGet, time.Minute)
+	assert.NoError(t, err)
+	assert.Contains(t, signedURL, "https://account.blob.core.windows.net/container/folder/object?")
+}
+
+func TestNewLockFallsBackToConditionalLockOutsideLeaseDurations(t *testing.T) {
+	containerURL, err := url.Parse("https://account.blob.core.windows.net/container")
+	assert.NoError(t, err)
+	folder := NewFolder(azblob.UploadStreamToBlockBlobOptions{},
+		azblob.NewContainerURL(*containerURL, sentPipeline{}), "folder/")
+
+	lock, err := storage.NewLock(folder, "lock", "owner", 30*time.Second)
+	assert.NoError(t, err)
+	assert.IsType(t, &leaseLock{}, lock)
+	lock, err = storage.NewLock(folder, "lock", "owner", 5*time.Minute)
+	assert.NoError(t, err)
+	_, isLeaseLock := lock.(*leaseLock)
+	assert.False(t, isLeaseLock)
+}
@@ -0,0 +1,136 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/tinsane/storages/storage"
+	"github.com/tinsane/tracelog"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const (
+	minLeaseDuration = 15 * time.Second
+	maxLeaseDuration = 60 * time.Second
+	leaseOwnerKey    = "owner"
+)
+
+// NewLock returns the lock on the blob lease. Azure allows leases of 15 to 60 seconds only,
+// other TTLs are unsupported, so storage.NewLock falls back to the lock on conditional writes
+func (folder *Folder) NewLock(name, owner string, ttl time.Duration) (storage.Lock, error) {
+	if ttl < minLeaseDuration || ttl > maxLeaseDuration {
+		return nil, storage.NewUnsupportedOperationError("Azure", fmt.Sprintf("leases of %v", ttl))
+	}
+	leaseID, err := newLeaseID()
+	if err != nil {
+		return nil, NewFolderError(err, "Unable to generate lease id for lock %v", name)
+	}
+	return &leaseLock{folder, name, owner, ttl, leaseID}, nil
+}
+
+type leaseLock struct {
+	folder  *Folder
+	name    string
+	owner   string
+	ttl     time.Duration
+	leaseID string
+}
+
+func (lock *leaseLock) Acquire() error {
+	// The blob must exist to be leased, it is created once and never changed by the lock.
+	// Writes to the leased blob fail, so the existing blob is not written even conditionally
+	exists, err := lock.folder.Exists(lock.name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = lock.folder.PutObjectWithCondition(lock.name, &bytes.Buffer{}, storage.PutCondition{IfNoneMatch: true})
+		if _, ok := err.(storage.PreconditionFailedError); !ok && err != nil {
+			return err
+		}
+	}
+	blobURL := lock.blobURL()
+	_, err = blobURL.AcquireLease(context.Background(), lock.leaseID, int32(lock.ttl.Seconds()), azblob.ModifiedAccessConditions{})
+	if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeLeaseAlreadyPresent {
+		return lock.heldError()
+	}
+	if err != nil {
+		return NewFolderError(err, "Unable to acquire lease of blob %v", lock.path())
+	}
+	_, err = blobURL.SetMetadata(context.Background(), azblob.Metadata{leaseOwnerKey: lock.owner},
+		azblob.BlobAccessConditions{LeaseAccessConditions: azblob.LeaseAccessConditions{LeaseID: lock.leaseID}})
+	if err != nil {
+		return NewFolderError(err, "Unable to set owner of blob %v", lock.path())
+	}
+	return nil
+}
+
+func (lock *leaseLock) Renew() error {
+	_, err := lock.blobURL().RenewLease(context.Background(), lock.leaseID, azblob.ModifiedAccessConditions{})
+	if isLeaseLost(err) {
+		return storage.NewLockLostError(lock.name)
+	}
+	if err != nil {
+		return NewFolderError(err, "Unable to renew lease of blob %v", lock.path())
+	}
+	return nil
+}
+
+func (lock *leaseLock) Release() error {
+	_, err := lock.blobURL().ReleaseLease(context.Background(), lock.leaseID, azblob.ModifiedAccessConditions{})
+	if isLeaseLost(err) {
+		return storage.NewLockLostError(lock.name)
+	}
+	if err != nil {
+		return NewFolderError(err, "Unable to release lease of blob %v", lock.path())
+	}
+	return nil
+}
+
+// heldError reports the owner stored in metadata, Azure does not tell when the lease of another owner expires
+func (lock *leaseLock) heldError() error {
+	properties, err := lock.blobURL().GetProperties(context.Background(), azblob.BlobAccessConditions{})
+	if err != nil {
+		return NewFolderError(err, "Unable to get owner of blob %v", lock.path())
+	}
+	owner := properties.NewMetadata()[leaseOwnerKey]
+	tracelog.DebugLogger.Printf("Lock %v is held by %v\n", lock.path(), owner)
+	return storage.NewLockHeldError(lock.name, owner, time.Time{})
+}
+
+func (lock *leaseLock) path() string {
+	return storage.JoinPath(lock.folder.path, lock.name)
+}
+
+func (lock *leaseLock) blobURL() azblob.BlockBlobURL {
+	return lock.folder.containerURL.NewBlockBlobURL(lock.path())
+}
+
+func isLeaseLost(err error) bool {
+	stgErr, ok := err.(azblob.StorageError)
+	if !ok {
+		return false
+	}
+	switch stgErr.ServiceCode() {
+	case azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation, azblob.ServiceCodeLeaseLost,
+		azblob.ServiceCodeLeaseNotPresentWithLeaseOperation:
+		return true
+	}
+	return false
+}
+
+// newLeaseID returns random UUID, Azure accepts lease ids in GUID format only
+func newLeaseID() (string, error) {
+	uuid := make([]byte, 16)
+	_, err := rand.Read(uuid)
+	if err != nil {
+		return "", err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
+}
@@ -0,0 +1,286 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tinsane/tracelog"
+)
+
+const dirDefaultMode = 0755
+
+// fileNamePattern matches files of the cache: sha256 of the key and a random suffix of ioutil.TempFile,
+// so other files in the directory are never removed
+var fileNamePattern = regexp.MustCompile(`^[0-9a-f]{64}-[0-9]+$`)
+
+// Options of the cache, zero TTL means cached objects do not expire
+type Options struct {
+	// MaxSize is the total size of cached objects, least recently used objects are evicted above it
+	MaxSize int64
+	// MaxObjectSize limits the size of a single cached object, bigger objects are streamed from the storage.
+	// Zero means MaxSize
+	MaxObjectSize int64
+	TTL           time.Duration
+	// Validate compares the version of the cached object with the storage on every read,
+	// it is used only if the storage implements storage.ObjectAttributesKeeper
+	Validate bool
+}
+
+// Cache keeps objects in the local directory, it is shared by the caching folder and its subfolders.
+// Objects are identified by their paths, so the cache must not be shared between different storages
+type Cache struct {
+	directory string
+	options   Options
+	mutex     sync.Mutex
+	entries   map[string]*list.Element
+	// recent has the most recently used entries at the front
+	recent *list.List
+	size   int64
+	// generations count invalidations of keys which are being read, so a read which started before a write
+	// does not cache the content written before it. Keys are removed when the last read ends
+	generations map[string]uint64
+	readers     map[string]int
+}
+
+type entry struct {
+	key string
+	// fileName is unique for every entry, so removing the replaced entry never removes the file of the new one
+	fileName string
+	size     int64
+	cachedAt time.Time
+	// version is empty if the storage does not return versions or validation is disabled
+	version string
+}
+
+// NewCache removes files left in the directory by previous runs, because their versions are unknown
+func NewCache(directory string, options Options) (*Cache, error) {
+	if err := os.MkdirAll(directory, dirDefaultMode); err != nil {
+		return nil, errors.Wrapf(err, "failed to create cache directory '%s'", directory)
+	}
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list cache directory '%s'", directory)
+	}
+	for _, file := range files {
+		if file.IsDir() || !fileNamePattern.MatchString(file.Name()) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(directory, file.Name())); err != nil {
+			return nil, errors.Wrapf(err, "failed to remove stale cache file '%s'", file.Name())
+		}
+	}
+	if options.MaxObjectSize == 0 || options.MaxObjectSize > options.MaxSize {
+		options.MaxObjectSize = options.MaxSize
+	}
+	return &Cache{directory: directory, options: options, entries: make(map[string]*list.Element), recent: list.New(),
+		generations: make(map[string]uint64), readers: make(map[string]int)}, nil
+}
+
+// Size returns the total size of cached objects
+func (cache *Cache) Size() int64 {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.size
+}
+
+// get returns the cached entry, which is not expired
+func (cache *Cache) get(key string) (entry, bool) {
+	cache.mutex.Lock()
+	element, ok := cache.entries[key]
+	if !ok {
+		cache.mutex.Unlock()
+		return entry{}, false
+	}
+	cached := element.Value.(entry)
+	if cache.options.TTL > 0 && time.Since(cached.cachedAt) > cache.options.TTL {
+		cache.remove(element)
+		cache.mutex.Unlock()
+		cache.deleteFiles(cached.fileName)
+		return entry{}, false
+	}
+	cache.recent.MoveToFront(element)
+	cache.mutex.Unlock()
+	return cached, true
+}
+
+// open returns the reader of the cached file, ok is false if it was evicted or can not be opened.
+// Evicted files are removed from the directory only, so files which are being read stay readable
+func (cache *Cache) open(cached entry) (reader io.ReadCloser, ok bool) {
+	file, err := os.Open(filepath.Join(cache.directory, cached.fileName))
+	if os.IsNotExist(err) {
+		return nil, false
+	}
+	if err != nil {
+		tracelog.WarningLogger.Printf("Failed to open cached object %s: %v\n", cached.key, err)
+		cache.invalidate(cached.key)
+		return nil, false
+	}
+	return file, true
+}
+
+// startRead returns the generation of the key, it is called before the object is read from the storage.
+// Every startRead is followed by endRead or by tee, which ends the read when the content is cached or abandoned
+func (cache *Cache) startRead(key string) (generation uint64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.readers[key]++
+	return cache.generations[key]
+}
+
+func (cache *Cache) endRead(key string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.release(key)
+}
+
+// release is called under the mutex
+func (cache *Cache) release(key string) {
+	cache.readers[key]--
+	if cache.readers[key] == 0 {
+		delete(cache.readers, key)
+		delete(cache.generations, key)
+	}
+}
+
+// tee returns the reader of content, which writes it to the cache file on the way. The object is cached
+// when the content is read to the end, objects bigger than MaxObjectSize are not cached. The object is not cached
+// either if it was invalidated after startRead returned the generation
+func (cache *Cache) tee(key, version string, generation uint64, content io.ReadCloser) io.ReadCloser {
+	if cache.options.MaxObjectSize <= 0 {
+		cache.endRead(key)
+		return content
+	}
+	hash := sha256.Sum256([]byte(key))
+	file, err := ioutil.TempFile(cache.directory, hex.EncodeToString(hash[:])+"-")
+	if err != nil {
+		tracelog.WarningLogger.Printf("Failed to cache object %s: %v\n", key, err)
+		cache.endRead(key)
+		return content
+	}
+	return &teeReader{cache: cache, key: key, version: version, generation: generation, content: content, file: file}
+}
+
+// add accounts the file written by teeReader and evicts least recently used entries above MaxSize
+func (cache *Cache) add(added entry, generation uint64) {
+	var removedFiles []string
+	cache.mutex.Lock()
+	stale := cache.generations[added.key] != generation
+	cache.release(added.key)
+	if stale {
+		cache.mutex.Unlock()
+		cache.deleteFiles(added.fileName)
+		return
+	}
+	if element, ok := cache.entries[added.key]; ok {
+		// The object was cached concurrently, the newer file replaces it
+		removedFiles = append(removedFiles, cache.remove(element))
+	}
+	cache.entries[added.key] = cache.recent.PushFront(added)
+	cache.size += added.size
+	for cache.size > cache.options.MaxSize {
+		removedFiles = append(removedFiles, cache.remove(cache.recent.Back()))
+	}
+	cache.mutex.Unlock()
+	cache.deleteFiles(removedFiles...)
+}
+
+func (cache *Cache) invalidate(key string) {
+	cache.mutex.Lock()
+	if cache.readers[key] > 0 {
+		cache.generations[key]++
+	}
+	element, ok := cache.entries[key]
+	if !ok {
+		cache.mutex.Unlock()
+		return
+	}
+	fileName := cache.remove(element)
+	cache.mutex.Unlock()
+	cache.deleteFiles(fileName)
+}
+
+// remove is called under the mutex, it returns the file of the entry, which is deleted after the mutex is released
+func (cache *Cache) remove(element *list.Element) (fileName string) {
+	removed := element.Value.(entry)
+	cache.recent.Remove(element)
+	delete(cache.entries, removed.key)
+	cache.size -= removed.size
+	return removed.fileName
+}
+
+func (cache *Cache) deleteFiles(fileNames ...string) {
+	for _, fileName := range fileNames {
+		err := os.Remove(filepath.Join(cache.directory, fileName))
+		if err != nil && !os.IsNotExist(err) {
+			tracelog.WarningLogger.Printf("Failed to remove cached file %s: %v\n", fileName, err)
+		}
+	}
+}
+
+// teeReader writes content to the cache file while it is read. Writing stops without failing the read
+// if the content is bigger than MaxObjectSize or the file can not be written
+type teeReader struct {
+	cache      *Cache
+	key        string
+	version    string
+	generation uint64
+	content    io.ReadCloser
+	// file is nil after the object was cached or abandoned
+	file *os.File
+	size int64
+}
+
+func (reader *teeReader) Read(p []byte) (n int, err error) {
+	n, err = reader.content.Read(p)
+	if reader.file != nil && n > 0 {
+		reader.size += int64(n)
+		if reader.size > reader.cache.options.MaxObjectSize {
+			reader.abandon()
+		} else if _, writeErr := reader.file.Write(p[:n]); writeErr != nil {
+			tracelog.WarningLogger.Printf("Failed to cache object %s: %v\n", reader.key, writeErr)
+			reader.abandon()
+		}
+	}
+	if reader.file != nil && err == io.EOF {
+		reader.commit()
+	}
+	return
+}
+
+func (reader *teeReader) commit() {
+	file := reader.file
+	reader.file = nil
+	if err := file.Close(); err != nil {
+		tracelog.WarningLogger.Printf("Failed to cache object %s: %v\n", reader.key, err)
+		reader.cache.deleteFiles(filepath.Base(file.Name()))
+		reader.cache.endRead(reader.key)
+		return
+	}
+	reader.cache.add(entry{reader.key, filepath.Base(file.Name()), reader.size, time.Now(), reader.version}, reader.generation)
+}
+
+// abandon removes the partial file
+func (reader *teeReader) abandon() {
+	file := reader.file
+	reader.file = nil
+	file.Close()
+	reader.cache.deleteFiles(filepath.Base(file.Name()))
+	reader.cache.endRead(reader.key)
+}
+
+// Close abandons the partial file if the content was not read to the end
+func (reader *teeReader) Close() error {
+	if reader.file != nil {
+		reader.abandon()
+	}
+	return reader.content.Close()
+}
@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"io"
+	"time"
+
+	"github.com/tinsane/storages/storage"
+	"github.com/tinsane/tracelog"
+)
+
+// Folder reads objects through the local cache. Objects written or deleted through the folder are invalidated,
+// changes made by others are noticed only after TTL or by validation of versions
+type Folder struct {
+	underlying storage.Folder
+	cache      *Cache
+}
+
+func NewFolder(underlying storage.Folder, cache *Cache) *Folder {
+	return &Folder{underlying, cache}
+}
+
+func (folder *Folder) key(objectRelativePath string) string {
+	return storage.JoinPath(folder.underlying.GetPath(), objectRelativePath)
+}
+
+func (folder *Folder) GetPath() string {
+	return folder.underlying.GetPath()
+}
+
+func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []storage.Folder, err error) {
+	objects, underlyingSubFolders, err := folder.underlying.ListFolder()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, subFolder := range underlyingSubFolders {
+		subFolders = append(subFolders, NewFolder(subFolder, folder.cache))
+	}
+	return objects, subFolders, nil
+}
+
+func (folder *Folder) DeleteObjects(objectRelativePaths []string) error {
+	err := folder.underlying.DeleteObjects(objectRelativePaths)
+	// Some objects may be deleted even if the deletion failed
+	for _, objectRelativePath := range objectRelativePaths {
+		folder.cache.invalidate(folder.key(objectRelativePath))
+	}
+	return err
+}
+
+func (folder *Folder) Exists(objectRelativePath string) (bool, error) {
+	return folder.underlying.Exists(objectRelativePath)
+}
+
+func (folder *Folder) GetSubFolder(subFolderRelativePath string) storage.Folder {
+	return NewFolder(folder.underlying.GetSubFolder(subFolderRelativePath), folder.cache)
+}
+
+// Invalidate removes the object from the cache, so the next read downloads it again
+func (folder *Folder) Invalidate(objectRelativePath string) {
+	folder.cache.invalidate(folder.key(objectRelativePath))
+}
+
+// ReadObject streams the cached file or the object from the storage, which is cached while it is read
+func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, error) {
+	key := folder.key(objectRelativePath)
+	generation := folder.cache.startRead(key)
+	version, err := folder.currentVersion(objectRelativePath)
+	if err != nil {
+		folder.cache.endRead(key)
+		return nil, err
+	}
+	if cached, ok := folder.cache.get(key); ok && cached.version == version {
+		if reader, ok := folder.cache.open(cached); ok {
+			tracelog.DebugLogger.Printf("Read %s from cache\n", key)
+			folder.cache.endRead(key)
+			return reader, nil
+		}
+	}
+
+	reader, err := folder.underlying.ReadObject(objectRelativePath)
+	if err != nil {
+		folder.cache.invalidate(key)
+		folder.cache.endRead(key)
+		return nil, err
+	}
+	return folder.cache.tee(key, version, generation, reader), nil
+}
+
+// currentVersion returns the version of the object in the storage if validation is enabled.
+// Version is read before content, so the cached content may only be newer than the version, never older
+func (folder *Folder) currentVersion(objectRelativePath string) (string, error) {
+	if !folder.cache.options.Validate {
+		return "", nil
+	}
+	attributes, err := storage.StatObject(folder.underlying, objectRelativePath)
+	if _, unsupported := err.(storage.UnsupportedOperationError); unsupported {
+		// Wrapping folders keep attributes only if the wrapped folder does
+		return "", nil
+	}
+	if err != nil {
+		folder.cache.invalidate(folder.key(objectRelativePath))
+		return "", err
+	}
+	return attributes.Version, nil
+}
+
+// PutObject invalidates the object before and after the write, reads which started before the write
+// do not cache the old content
+func (folder *Folder) PutObject(name string, content io.Reader) error {
+	return folder.put(name, func() error {
+		return folder.underlying.PutObject(name, content)
+	})
+}
+
+func (folder *Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	return folder.put(name, func() error {
+		return storage.PutObjectWithOptions(folder.underlying, name, content, options)
+	})
+}
+
+func (folder *Folder) PutObjectWithCondition(name string, content io.Reader,
+	condition storage.PutCondition) (version string, err error) {
+	err = folder.put(name, func() (err error) {
+		version, err = storage.PutObjectWithCondition(folder.underlying, name, content, condition)
+		return err
+	})
+	return version, err
+}
+
+func (folder *Folder) PutObjectWithStorageClass(name string, content io.Reader, storageClass string) error {
+	return folder.put(name, func() error {
+		return storage.PutObjectWithStorageClass(folder.underlying, name, content, storageClass)
+	})
+}
+
+func (folder *Folder) PutObjectWithProgress(name string, content io.Reader, tracker *storage.ProgressTracker) error {
+	return folder.put(name, func() error {
+		return storage.PutObjectWithTracker(folder.underlying, name, content, tracker)
+	})
+}
+
+// SetStorageClass invalidates the object, because some storages change the version of the object
+func (folder *Folder) SetStorageClass(objectRelativePath, storageClass string) error {
+	return folder.put(objectRelativePath, func() error {
+		return storage.SetStorageClass(folder.underlying, objectRelativePath, storageClass)
+	})
+}
+
+func (folder *Folder) put(name string, write func() error) error {
+	key := folder.key(name)
+	folder.cache.invalidate(key)
+	err := write()
+	folder.cache.invalidate(key)
+	return err
+}
+
+// StatObject is not cached, so it returns the current version of the object
+func (folder *Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	return storage.StatObject(folder.underlying, objectRelativePath)
+}
+
+func (folder *Folder) ListObjectVersions(objectRelativePath string) ([]storage.ObjectVersion, error) {
+	return storage.ListObjectVersions(folder.underlying, objectRelativePath)
+}
+
+// ReadObjectVersion is not cached, versions are read rarely
+func (folder *Folder) ReadObjectVersion(objectRelativePath, versionID string) (io.ReadCloser, error) {
+	return storage.ReadObjectVersion(folder.underlying, objectRelativePath, versionID)
+}
+
+// DeleteObjectVersions invalidates the objects, because the previous version may become current
+func (folder *Folder) DeleteObjectVersions(versions []storage.ObjectVersion) error {
+	err := storage.DeleteObjectVersions(folder.underlying, versions)
+	for _, version := range versions {
+		folder.cache.invalidate(folder.key(version.ObjectRelativePath))
+	}
+	return err
+}
+
+func (folder *Folder) ObjectLockEnabled() bool {
+	return storage.ObjectLockEnabled(folder.underlying)
+}
+
+func (folder *Folder) GetObjectLock(objectRelativePath string) (storage.ObjectLock, error) {
+	return storage.GetObjectLock(folder.underlying, objectRelativePath)
+}
+
+func (folder *Folder) RestoreObject(objectRelativePath string, days int64, tier string) error {
+	return storage.RestoreObject(folder.underlying, objectRelativePath, days, tier)
+}
+
+func (folder *Folder) GetRestoreStatus(objectRelativePath string) (storage.RestoreStatus, error) {
+	return storage.GetRestoreStatus(folder.underlying, objectRelativePath)
+}
+
+func (folder *Folder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	return storage.SignedURL(folder.underlying, objectRelativePath, method, expiry)
+}
+
+// NewLock takes the lock on the underlying folder, so lock objects are never read from the cache
+func (folder *Folder) NewLock(name, owner string, ttl time.Duration) (storage.Lock, error) {
+	return storage.NewLock(folder.underlying, name, owner, ttl)
+}
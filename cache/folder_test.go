@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/memory"
+	"github.com/tinsane/storages/storage"
+	"github.com/tinsane/storages/throttle"
+)
+
+func newCachingFolder(t *testing.T, options Options) (*Folder, *memory.Folder, func()) {
+	tmpDir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	cache, err := NewCache(tmpDir, options)
+	assert.NoError(t, err)
+	underlying := memory.NewFolder("in_memory/", memory.NewStorage())
+	return NewFolder(underlying, cache), underlying, func() { os.RemoveAll(tmpDir) }
+}
+
+func readString(t *testing.T, folder storage.Folder, name string) string {
+	reader, err := folder.ReadObject(name)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	return string(content)
+}
+
+func TestCachingFolderReadsThroughCache(t *testing.T) {
+	folder, underlying, cleanup := newCachingFolder(t, Options{MaxSize: 1024})
+	defer cleanup()
+	assert.NoError(t, underlying.PutObject("sub/sentinel", strings.NewReader("first")))
+	subFolder := folder.GetSubFolder("sub/")
+
+	assert.Equal(t, "first", readString(t, subFolder, "sentinel"))
+	// Changes made bypassing the caching folder are not noticed until invalidation
+	assert.NoError(t, underlying.PutObject("sub/sentinel", strings.NewReader("second")))
+	assert.Equal(t, "first", readString(t, subFolder, "sentinel"))
+	folder.Invalidate("sub/sentinel")
+	assert.Equal(t, "second", readString(t, subFolder, "sentinel"))
+
+	assert.NoError(t, subFolder.PutObject("sentinel", strings.NewReader("third")))
+	assert.Equal(t, "third", readString(t, subFolder, "sentinel"))
+	assert.NoError(t, subFolder.DeleteObjects([]string{"sentinel"}))
+	_, err := subFolder.ReadObject("sentinel")
+	assert.IsType(t, storage.ObjectNotFoundError{}, err)
+}
+
+func TestCachingFolderValidatesVersions(t *testing.T) {
+	folder, underlying, cleanup := newCachingFolder(t, Options{MaxSize: 1024, Validate: true})
+	defer cleanup()
+	assert.NoError(t, underlying.PutObject("sentinel", strings.NewReader("first")))
+
+	assert.Equal(t, "first", readString(t, folder, "sentinel"))
+	assert.NoError(t, underlying.PutObject("sentinel", strings.NewReader("second")))
+	assert.Equal(t, "second", readString(t, folder, "sentinel"))
+}
+
+func TestCachingFolderValidatesVersionsThroughWrappers(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	cache, err := NewCache(tmpDir, Options{MaxSize: 1024, Validate: true})
+	assert.NoError(t, err)
+	underlying := memory.NewFolder("in_memory/", memory.NewStorage())
+	folder := NewFolder(throttle.NewFolder(underlying, throttle.NewLimiter(throttle.Limits{})), cache)
+	assert.NoError(t, underlying.PutObject("sentinel", strings.NewReader("first")))
+
+	assert.Equal(t, "first", readString(t, folder, "sentinel"))
+	assert.NoError(t, underlying.PutObject("sentinel", strings.NewReader("second")))
+	assert.Equal(t, "second", readString(t, folder, "sentinel"))
+
+	assert.NoError(t, storage.PutObjectWithOptions(folder, "sentinel", bytes.NewReader([]byte("third")), storage.PutOptions{}))
+	assert.Equal(t, "third", readString(t, folder, "sentinel"))
+}
+
+func TestCachingFolderExpiresObjects(t *testing.T) {
+	folder, underlying, cleanup := newCachingFolder(t, Options{MaxSize: 1024, TTL: 10 * time.Millisecond})
+	defer cleanup()
+	assert.NoError(t, underlying.PutObject("sentinel", strings.NewReader("first")))
+
+	assert.Equal(t, "first", readString(t, folder, "sentinel"))
+	assert.NoError(t, underlying.PutObject("sentinel", strings.NewReader("second")))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "second", readString(t, folder, "sentinel"))
+}
+
+func TestCachingFolderEvictsLeastRecentlyUsed(t *testing.T) {
+	folder, underlying, cleanup := newCachingFolder(t, Options{MaxSize: 10})
+	defer cleanup()
+	for _, name := range []string{"a", "b", "c"} {
+		assert.NoError(t, underlying.PutObject(name, strings.NewReader(name+name+name+name)))
+	}
+	assert.NoError(t, underlying.PutObject("big", strings.NewReader("bigger than the cache")))
+
+	readString(t, folder, "a")
+	readString(t, folder, "b")
+	readString(t, folder, "a")
+	readString(t, folder, "c")
+	assert.Equal(t, int64(8), folder.cache.Size())
+	_, cached := folder.cache.get(folder.key("b"))
+	assert.False(t, cached)
+	_, cached = folder.cache.get(folder.key("a"))
+	assert.True(t, cached)
+
+	assert.Equal(t, "bigger than the cache", readString(t, folder, "big"))
+	_, cached = folder.cache.get(folder.key("big"))
+	assert.False(t, cached)
+}
+
+func TestCachingFolderCachesObjectsReadToTheEnd(t *testing.T) {
+	folder, underlying, cleanup := newCachingFolder(t, Options{MaxSize: 1024, MaxObjectSize: 8})
+	defer cleanup()
+	assert.NoError(t, underlying.PutObject("small", strings.NewReader("small")))
+	assert.NoError(t, underlying.PutObject("big", strings.NewReader("bigger than an object")))
+
+	reader, err := folder.ReadObject("small")
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	_, cached := folder.cache.get(folder.key("small"))
+	assert.False(t, cached)
+
+	assert.Equal(t, "small", readString(t, folder, "small"))
+	assert.Equal(t, "bigger than an object", readString(t, folder, "big"))
+	assert.Equal(t, int64(5), folder.cache.Size())
+	_, cached = folder.cache.get(folder.key("big"))
+	assert.False(t, cached)
+
+	assert.NoError(t, underlying.DeleteObjects([]string{"small"}))
+	assert.Equal(t, "small", readString(t, folder, "small"))
+}
+
+func TestCachingFolderDoesNotCacheReadsStartedBeforeWrite(t *testing.T) {
+	folder, underlying, cleanup := newCachingFolder(t, Options{MaxSize: 1024})
+	defer cleanup()
+	assert.NoError(t, underlying.PutObject("object", strings.NewReader("old")))
+
+	reader, err := folder.ReadObject("object")
+	assert.NoError(t, err)
+	assert.NoError(t, folder.PutObject("object", strings.NewReader("new")))
+	content, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, "old", string(content))
+
+	_, cached := folder.cache.get(folder.key("object"))
+	assert.False(t, cached)
+	assert.Equal(t, "new", readString(t, folder, "object"))
+	assert.Empty(t, folder.cache.readers)
+	assert.Empty(t, folder.cache.generations)
+}
+
+func TestCachingFolderInvalidatesDeletedVersions(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	cache, err := NewCache(tmpDir, Options{MaxSize: 1024})
+	assert.NoError(t, err)
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewVersionedStorage()), cache)
+	assert.NoError(t, folder.PutObject("object", strings.NewReader("first")))
+	assert.NoError(t, storage.PutObjectWithProgress(folder, "object", strings.NewReader("second"), 6,
+		storage.ProgressOptions{}))
+	assert.Equal(t, "second", readString(t, folder, "object"))
+
+	versions, err := storage.ListObjectVersions(folder, "object")
+	assert.NoError(t, err)
+	assert.NoError(t, storage.DeleteObjectVersions(folder, versions[:1]))
+	assert.Equal(t, "first", readString(t, folder, "object"))
+	assert.False(t, storage.ObjectLockEnabled(folder))
+	_, err = storage.GetRestoreStatus(folder, "object")
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+}
+
+func TestNewCacheRemovesOnlyCacheFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	cache, err := NewCache(tmpDir, Options{MaxSize: 1024})
+	assert.NoError(t, err)
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewStorage()), cache)
+	assert.NoError(t, folder.PutObject("sentinel", strings.NewReader("sentinel")))
+	readString(t, folder, "sentinel")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "precious"), []byte("data"), 0644))
+
+	_, err = NewCache(tmpDir, Options{MaxSize: 1024})
+	assert.NoError(t, err)
+	files, err := ioutil.ReadDir(tmpDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, "precious", files[0].Name())
+}
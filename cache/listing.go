@@ -0,0 +1,375 @@
+package cache
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinsane/storages/storage"
+)
+
+// ListingCache keeps results of ListFolder by folder path, it is shared by the listing folder and its subfolders.
+// Zero TTL means listings are kept until they are invalidated
+type ListingCache struct {
+	ttl      time.Duration
+	mutex    sync.Mutex
+	listings map[string]*listing
+	// generations of keys are taken from sequence on every write through listing folders, listings which ran
+	// concurrently with a write or an invalidation are not stored, because they may miss the change
+	generations   map[string]uint64
+	sequence      uint64
+	invalidatedAt uint64
+}
+
+type listing struct {
+	// folder is the listed folder of the underlying storage, subfolders added to the listing are taken from it
+	folder  storage.Folder
+	objects map[string]storage.Object
+	// subFolders are folders of the underlying storage, they are wrapped on return
+	subFolders map[string]storage.Folder
+	listedAt   time.Time
+}
+
+func NewListingCache(ttl time.Duration) *ListingCache {
+	return &ListingCache{ttl: ttl, listings: make(map[string]*listing), generations: make(map[string]uint64)}
+}
+
+// Invalidate drops all cached listings
+func (cache *ListingCache) Invalidate() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.listings = make(map[string]*listing)
+	cache.markInvalidated()
+}
+
+// addToParents is called under the mutex, the folder of the key is added to cached listings of all its parents
+// up to the root of the storage, including parents of the folder where the listing folder was created
+func (cache *ListingCache) addToParents(key string) {
+	if key == "" {
+		return
+	}
+	parts := strings.Split(strings.TrimSuffix(key, "/"), "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		parentKey := listingKey(strings.Join(parts[:i], "/"))
+		cache.touch(parentKey)
+		if parent, ok := cache.listings[parentKey]; ok {
+			if _, ok := parent.subFolders[parts[i]+"/"]; !ok {
+				parent.subFolders[parts[i]+"/"] = parent.folder.GetSubFolder(parts[i] + "/")
+			}
+		}
+	}
+}
+
+// removeFromParents is called under the mutex, after objects of the folder of the key were deleted.
+// Folders exist while they have objects, so the folder is removed from the listing of its parent if its own
+// listing is empty. The listing of the parent is dropped if it is not known whether the folder is empty
+func (cache *ListingCache) removeFromParents(key string) {
+	if key == "" {
+		return
+	}
+	parts := strings.Split(strings.TrimSuffix(key, "/"), "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		cached, known := cache.listings[listingKey(strings.Join(parts[:i+1], "/"))]
+		if known && (len(cached.objects) > 0 || len(cached.subFolders) > 0) {
+			return
+		}
+		parentKey := listingKey(strings.Join(parts[:i], "/"))
+		cache.touch(parentKey)
+		parent, ok := cache.listings[parentKey]
+		if !ok {
+			continue
+		}
+		if known {
+			delete(parent.subFolders, parts[i]+"/")
+		} else {
+			delete(cache.listings, parentKey)
+		}
+	}
+}
+
+// touch is called under the mutex, when the listing of the key is changed
+func (cache *ListingCache) touch(key string) {
+	cache.sequence++
+	cache.generations[key] = cache.sequence
+}
+
+// markInvalidated is called under the mutex, generations of keys are not needed after it
+func (cache *ListingCache) markInvalidated() {
+	cache.sequence++
+	cache.invalidatedAt = cache.sequence
+	cache.generations = make(map[string]uint64)
+}
+
+// changedSince is called under the mutex
+func (cache *ListingCache) changedSince(key string, sequence uint64) bool {
+	return cache.invalidatedAt > sequence || cache.generations[key] > sequence
+}
+
+func listingKey(path string) string {
+	return storage.AddDelimiterToPath(storage.JoinPath(path))
+}
+
+// ListingFolder caches listings of the underlying folder. Objects written or deleted through the folder
+// are added to or removed from cached listings, so a sequence of listings is consistent with own changes
+type ListingFolder struct {
+	underlying storage.Folder
+	cache      *ListingCache
+}
+
+func NewListingFolder(underlying storage.Folder, cache *ListingCache) *ListingFolder {
+	return &ListingFolder{underlying, cache}
+}
+
+func (folder *ListingFolder) GetPath() string {
+	return folder.underlying.GetPath()
+}
+
+func (folder *ListingFolder) ListFolder() (objects []storage.Object, subFolders []storage.Folder, err error) {
+	key := listingKey(folder.underlying.GetPath())
+	folder.cache.mutex.Lock()
+	cached, ok := folder.cache.listings[key]
+	if ok && (folder.cache.ttl == 0 || time.Since(cached.listedAt) <= folder.cache.ttl) {
+		objects, subFolders = folder.fromListing(cached)
+		folder.cache.mutex.Unlock()
+		return objects, subFolders, nil
+	}
+	startedAt := folder.cache.sequence
+	folder.cache.mutex.Unlock()
+
+	listedAt := time.Now()
+	objects, underlyingSubFolders, err := folder.underlying.ListFolder()
+	if err != nil {
+		return nil, nil, err
+	}
+	cached = &listing{
+		folder:     folder.underlying,
+		objects:    make(map[string]storage.Object, len(objects)),
+		subFolders: make(map[string]storage.Folder, len(underlyingSubFolders)),
+		listedAt:   listedAt,
+	}
+	for _, object := range objects {
+		cached.objects[object.GetName()] = object
+	}
+	for _, subFolder := range underlyingSubFolders {
+		name := strings.TrimPrefix(listingKey(subFolder.GetPath()), key)
+		cached.subFolders[name] = subFolder
+	}
+	folder.cache.mutex.Lock()
+	defer folder.cache.mutex.Unlock()
+	if !folder.cache.changedSince(key, startedAt) {
+		folder.cache.listings[key] = cached
+	}
+	objects, subFolders = folder.fromListing(cached)
+	return objects, subFolders, nil
+}
+
+// fromListing is called under the mutex, results are sorted by name to be the same on every call
+func (folder *ListingFolder) fromListing(cached *listing) (objects []storage.Object, subFolders []storage.Folder) {
+	for _, object := range cached.objects {
+		objects = append(objects, object)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].GetName() < objects[j].GetName()
+	})
+	names := make([]string, 0, len(cached.subFolders))
+	for name := range cached.subFolders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		subFolders = append(subFolders, NewListingFolder(cached.subFolders[name], folder.cache))
+	}
+	return objects, subFolders
+}
+
+func (folder *ListingFolder) DeleteObjects(objectRelativePaths []string) error {
+	err := folder.underlying.DeleteObjects(objectRelativePaths)
+	folder.cache.mutex.Lock()
+	defer folder.cache.mutex.Unlock()
+	for _, objectRelativePath := range objectRelativePaths {
+		dir, name := folder.splitPath(objectRelativePath)
+		key := folder.dirKey(dir)
+		folder.cache.touch(key)
+		cached, ok := folder.cache.listings[key]
+		if !ok {
+			continue
+		}
+		if err != nil {
+			// Some objects may be deleted even if the deletion failed
+			delete(folder.cache.listings, key)
+			continue
+		}
+		delete(cached.objects, name)
+	}
+	for _, objectRelativePath := range objectRelativePaths {
+		dir, _ := folder.splitPath(objectRelativePath)
+		folder.cache.removeFromParents(folder.dirKey(dir))
+	}
+	return err
+}
+
+func (folder *ListingFolder) Exists(objectRelativePath string) (bool, error) {
+	return folder.underlying.Exists(objectRelativePath)
+}
+
+func (folder *ListingFolder) GetSubFolder(subFolderRelativePath string) storage.Folder {
+	return NewListingFolder(folder.underlying.GetSubFolder(subFolderRelativePath), folder.cache)
+}
+
+func (folder *ListingFolder) ReadObject(objectRelativePath string) (io.ReadCloser, error) {
+	return folder.underlying.ReadObject(objectRelativePath)
+}
+
+func (folder *ListingFolder) PutObject(name string, content io.Reader) error {
+	return folder.put(name, func() error {
+		return folder.underlying.PutObject(name, content)
+	})
+}
+
+func (folder *ListingFolder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	return folder.put(name, func() error {
+		return storage.PutObjectWithOptions(folder.underlying, name, content, options)
+	})
+}
+
+func (folder *ListingFolder) PutObjectWithCondition(name string, content io.Reader,
+	condition storage.PutCondition) (version string, err error) {
+	err = folder.put(name, func() (err error) {
+		version, err = storage.PutObjectWithCondition(folder.underlying, name, content, condition)
+		return err
+	})
+	return version, err
+}
+
+// put adds the object to the cached listing of its folder and its subfolders to cached listings of parents.
+// The object is taken from StatObject of the storage, the listing is dropped if the storage can not stat objects
+func (folder *ListingFolder) put(name string, write func() error) error {
+	err := write()
+	dir, objectName := folder.splitPath(name)
+	var object storage.Object
+	if err == nil {
+		if attributes, statErr := storage.StatObject(folder.underlying, name); statErr == nil {
+			object = storage.NewLocalObject(objectName, attributes.LastModified)
+		}
+	}
+	folder.cache.mutex.Lock()
+	defer folder.cache.mutex.Unlock()
+	key := folder.dirKey(dir)
+	folder.cache.touch(key)
+	if err != nil {
+		// The object may be written even if the upload failed
+		delete(folder.cache.listings, key)
+		return err
+	}
+	folder.cache.addToParents(key)
+	if cached, ok := folder.cache.listings[key]; ok {
+		if object != nil {
+			cached.objects[objectName] = object
+		} else {
+			delete(folder.cache.listings, key)
+		}
+	}
+	return nil
+}
+
+func (folder *ListingFolder) PutObjectWithStorageClass(name string, content io.Reader, storageClass string) error {
+	return folder.put(name, func() error {
+		return storage.PutObjectWithStorageClass(folder.underlying, name, content, storageClass)
+	})
+}
+
+func (folder *ListingFolder) PutObjectWithProgress(name string, content io.Reader, tracker *storage.ProgressTracker) error {
+	return folder.put(name, func() error {
+		return storage.PutObjectWithTracker(folder.underlying, name, content, tracker)
+	})
+}
+
+func (folder *ListingFolder) SetStorageClass(objectRelativePath, storageClass string) error {
+	return storage.SetStorageClass(folder.underlying, objectRelativePath, storageClass)
+}
+
+func (folder *ListingFolder) ListObjectVersions(objectRelativePath string) ([]storage.ObjectVersion, error) {
+	return storage.ListObjectVersions(folder.underlying, objectRelativePath)
+}
+
+func (folder *ListingFolder) ReadObjectVersion(objectRelativePath, versionID string) (io.ReadCloser, error) {
+	return storage.ReadObjectVersion(folder.underlying, objectRelativePath, versionID)
+}
+
+// DeleteObjectVersions drops listings of folders of the objects and their parents, because deleted objects
+// may be restored from previous versions
+func (folder *ListingFolder) DeleteObjectVersions(versions []storage.ObjectVersion) error {
+	err := storage.DeleteObjectVersions(folder.underlying, versions)
+	folder.cache.mutex.Lock()
+	defer folder.cache.mutex.Unlock()
+	for _, version := range versions {
+		dir, _ := folder.splitPath(version.ObjectRelativePath)
+		key := folder.dirKey(dir)
+		folder.cache.touch(key)
+		delete(folder.cache.listings, key)
+		folder.cache.removeFromParents(key)
+	}
+	return err
+}
+
+func (folder *ListingFolder) ObjectLockEnabled() bool {
+	return storage.ObjectLockEnabled(folder.underlying)
+}
+
+func (folder *ListingFolder) GetObjectLock(objectRelativePath string) (storage.ObjectLock, error) {
+	return storage.GetObjectLock(folder.underlying, objectRelativePath)
+}
+
+func (folder *ListingFolder) RestoreObject(objectRelativePath string, days int64, tier string) error {
+	return storage.RestoreObject(folder.underlying, objectRelativePath, days, tier)
+}
+
+func (folder *ListingFolder) GetRestoreStatus(objectRelativePath string) (storage.RestoreStatus, error) {
+	return storage.GetRestoreStatus(folder.underlying, objectRelativePath)
+}
+
+// StatObject is not cached
+func (folder *ListingFolder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	return storage.StatObject(folder.underlying, objectRelativePath)
+}
+
+func (folder *ListingFolder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	return storage.SignedURL(folder.underlying, objectRelativePath, method, expiry)
+}
+
+// NewLock returns the native lock of the underlying folder, so cached listings do not see objects of native locks
+// until they are invalidated. Folders without native locks write objects of conditional locks through the listing folder
+func (folder *ListingFolder) NewLock(name, owner string, ttl time.Duration) (storage.Lock, error) {
+	return storage.NewNativeLock(folder.underlying, name, owner, ttl)
+}
+
+// InvalidateListings drops cached listings of the folder and all of its subfolders
+func (folder *ListingFolder) InvalidateListings() {
+	prefix := listingKey(folder.underlying.GetPath())
+	folder.cache.mutex.Lock()
+	defer folder.cache.mutex.Unlock()
+	for key := range folder.cache.listings {
+		if strings.HasPrefix(key, prefix) {
+			delete(folder.cache.listings, key)
+		}
+	}
+	// Listings of subfolders, which are running now, may be not cached yet
+	folder.cache.markInvalidated()
+}
+
+// dirKey returns the key of the listing of the folder relative to this folder
+func (folder *ListingFolder) dirKey(dir string) string {
+	return listingKey(storage.JoinPath(folder.underlying.GetPath(), dir))
+}
+
+// splitPath returns the folder of the object relative to this folder and the name of the object
+func (folder *ListingFolder) splitPath(objectRelativePath string) (dir, name string) {
+	objectRelativePath = strings.TrimPrefix(objectRelativePath, "/")
+	index := strings.LastIndex(objectRelativePath, "/")
+	if index < 0 {
+		return "", objectRelativePath
+	}
+	return objectRelativePath[:index], objectRelativePath[index+1:]
+}
@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/memory"
+	"github.com/tinsane/storages/storage"
+)
+
+func listNames(t *testing.T, folder storage.Folder) (objectNames []string, subFolderPaths []string) {
+	objects, subFolders, err := folder.ListFolder()
+	assert.NoError(t, err)
+	for _, object := range objects {
+		objectNames = append(objectNames, object.GetName())
+	}
+	for _, subFolder := range subFolders {
+		subFolderPaths = append(subFolderPaths, subFolder.GetPath())
+	}
+	return objectNames, subFolderPaths
+}
+
+func TestListingFolderKeepsSnapshot(t *testing.T) {
+	underlying := memory.NewFolder("in_memory/", memory.NewStorage())
+	assert.NoError(t, underlying.PutObject("a", strings.NewReader("a")))
+	folder := NewListingFolder(underlying, NewListingCache(0))
+
+	objects, _ := listNames(t, folder)
+	assert.Equal(t, []string{"a"}, objects)
+	// Changes made bypassing the listing folder are not noticed until invalidation
+	assert.NoError(t, underlying.PutObject("b", strings.NewReader("b")))
+	objects, _ = listNames(t, folder)
+	assert.Equal(t, []string{"a"}, objects)
+
+	folder.InvalidateListings()
+	objects, _ = listNames(t, folder)
+	assert.Equal(t, []string{"a", "b"}, objects)
+}
+
+func TestListingFolderUpdatesOwnChanges(t *testing.T) {
+	underlying := memory.NewFolder("in_memory/", memory.NewStorage())
+	assert.NoError(t, underlying.PutObject("a", strings.NewReader("a")))
+	folder := NewListingFolder(underlying, NewListingCache(time.Hour))
+	listNames(t, folder)
+
+	assert.NoError(t, folder.PutObject("b", strings.NewReader("b")))
+	assert.NoError(t, folder.PutObject("sub/c", strings.NewReader("c")))
+	assert.NoError(t, folder.DeleteObjects([]string{"a"}))
+	objects, subFolders := listNames(t, folder)
+	assert.Equal(t, []string{"b"}, objects)
+	assert.Equal(t, []string{"in_memory/sub/"}, subFolders)
+
+	_, listed, err := folder.ListFolder()
+	assert.NoError(t, err)
+	subObjects, _ := listNames(t, listed[0])
+	assert.Equal(t, []string{"c"}, subObjects)
+	// The subfolder shares the cache, so its own deletions are seen by the listing of the subfolder
+	assert.NoError(t, listed[0].DeleteObjects([]string{"c"}))
+	subObjects, _ = listNames(t, folder.GetSubFolder("sub/"))
+	assert.Empty(t, subObjects)
+}
+
+func TestListingCacheExpires(t *testing.T) {
+	underlying := memory.NewFolder("in_memory/", memory.NewStorage())
+	folder := NewListingFolder(underlying, NewListingCache(time.Millisecond))
+	listNames(t, folder)
+
+	assert.NoError(t, underlying.PutObject("a", strings.NewReader("a")))
+	time.Sleep(10 * time.Millisecond)
+	objects, _ := listNames(t, folder)
+	assert.Equal(t, []string{"a"}, objects)
+}
+
+// blockingListFolder lists the folder and waits before returning the result
+type blockingListFolder struct {
+	storage.Folder
+	listed  chan struct{}
+	proceed chan struct{}
+}
+
+func (folder *blockingListFolder) ListFolder() ([]storage.Object, []storage.Folder, error) {
+	objects, subFolders, err := folder.Folder.ListFolder()
+	folder.listed <- struct{}{}
+	<-folder.proceed
+	return objects, subFolders, err
+}
+
+func TestListingFolderDoesNotStoreListingsConcurrentWithWrites(t *testing.T) {
+	underlying := &blockingListFolder{memory.NewFolder("in_memory/", memory.NewStorage()), make(chan struct{}), make(chan struct{})}
+	folder := NewListingFolder(underlying, NewListingCache(0))
+
+	listed := make(chan []string)
+	go func() {
+		objects, _ := listNames(t, folder)
+		listed <- objects
+	}()
+	<-underlying.listed
+	assert.NoError(t, folder.PutObject("a", strings.NewReader("a")))
+	close(underlying.proceed)
+	assert.Empty(t, <-listed)
+
+	go func() { <-underlying.listed }()
+	objects, _ := listNames(t, folder)
+	assert.Equal(t, []string{"a"}, objects)
+}
+
+func TestListingFolderAddsObjectsOfStorage(t *testing.T) {
+	underlying := memory.NewFolder("in_memory/", memory.NewStorage())
+	folder := NewListingFolder(underlying, NewListingCache(0))
+	listNames(t, folder)
+
+	assert.NoError(t, folder.PutObject("a", strings.NewReader("a")))
+	attributes, err := storage.StatObject(underlying, "a")
+	assert.NoError(t, err)
+	objects, _, err := folder.ListFolder()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(objects))
+	assert.Equal(t, attributes.LastModified, objects[0].GetLastModified())
+}
+
+func TestListingFolderUpdatesParentsAboveSubFolder(t *testing.T) {
+	cache := NewListingCache(0)
+	folder := NewListingFolder(memory.NewFolder("in_memory/", memory.NewStorage()), cache)
+	listNames(t, folder)
+
+	// The subfolder is created from the root, so the root listing is updated by the write below it
+	subFolder := NewListingFolder(memory.NewFolder("in_memory/sub/", memory.NewStorage()), cache)
+	assert.NoError(t, subFolder.PutObject("nested/object", strings.NewReader("a")))
+	_, subFolders := listNames(t, folder)
+	assert.Equal(t, []string{"in_memory/sub/"}, subFolders)
+}
+
+func TestListingFolderRemovesEmptySubFolders(t *testing.T) {
+	folder := NewListingFolder(memory.NewFolder("in_memory/", memory.NewStorage()), NewListingCache(0))
+	assert.NoError(t, folder.PutObject("a/b/object", strings.NewReader("a")))
+	assert.NoError(t, folder.PutObject("c/object", strings.NewReader("c")))
+	listNames(t, folder)
+	listNames(t, folder.GetSubFolder("a/"))
+	listNames(t, folder.GetSubFolder("a/b/"))
+
+	assert.NoError(t, folder.DeleteObjects([]string{"a/b/object"}))
+	_, subFolders := listNames(t, folder)
+	assert.Equal(t, []string{"in_memory/c/"}, subFolders)
+
+	// The listing of c/ is not cached, so the listing of its parent is dropped
+	assert.NoError(t, folder.DeleteObjects([]string{"c/object"}))
+	_, subFolders = listNames(t, folder)
+	assert.Empty(t, subFolders)
+}
+
+func TestListingFolderDropsListingsOnDeletedVersions(t *testing.T) {
+	folder := NewListingFolder(memory.NewFolder("in_memory/", memory.NewVersionedStorage()), NewListingCache(0))
+	assert.NoError(t, folder.PutObject("sub/object", strings.NewReader("a")))
+	assert.NoError(t, storage.PutObjectWithProgress(folder, "object", strings.NewReader("b"), 1,
+		storage.ProgressOptions{}))
+	objects, subFolders := listNames(t, folder)
+	assert.Equal(t, []string{"object"}, objects)
+	assert.Equal(t, []string{"in_memory/sub/"}, subFolders)
+
+	versions, err := storage.ListObjectVersions(folder, "object")
+	assert.NoError(t, err)
+	assert.NoError(t, storage.DeleteObjectVersions(folder, versions))
+	objects, _ = listNames(t, folder)
+	assert.Empty(t, objects)
+}
@@ -0,0 +1,44 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockDirectory takes exclusive flock of the directory, so conditional writes are serialized between processes.
+// The lock is released when the returned file is closed
+func lockDirectory(dirPath string) (*os.File, error) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(dir.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		_ = dir.Close()
+		return nil, err
+	}
+	return dir, nil
+}
+
+// tryLockFile takes exclusive flock of the file without waiting, it is false if the file is locked by another open file
+func tryLockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// getFileVersion changes on every write, because objects are replaced by rename and get a new inode.
+// Modification time and size tell apart a file which got the inode of a removed one
+func getFileVersion(fileInfo os.FileInfo) string {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Sprintf("%d-%d", fileInfo.ModTime().UnixNano(), fileInfo.Size())
+	}
+	return fmt.Sprintf("%d-%d-%d", stat.Ino, fileInfo.ModTime().UnixNano(), fileInfo.Size())
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package fs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/tinsane/storages/storage"
+)
+
+// lockDirectory is not implemented without flock, so conditional writes and locks are not supported
+func lockDirectory(dirPath string) (*os.File, error) {
+	return nil, storage.NewUnsupportedOperationError("FS on this platform", "conditional writes")
+}
+
+func tryLockFile(file *os.File) (bool, error) {
+	return false, storage.NewUnsupportedOperationError("FS on this platform", "locks")
+}
+
+func getFileVersion(fileInfo os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", fileInfo.ModTime().UnixNano(), fileInfo.Size())
+}
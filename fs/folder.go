@@ -1,15 +1,35 @@
 package fs
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
 	"github.com/tinsane/storages/storage"
 	"github.com/tinsane/tracelog"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"time"
 )
 
-const dirDefaultMode = 0755
+const (
+	dirDefaultMode = 0755
+
+	// Temp files, options and locks of objects are kept in the hidden directory next to them,
+	// so names of objects never collide with them. Objects with this name are not listed
+	reservedDirName = ".storages"
+	tempDirName     = "tmp"
+	optionsDirName  = "options"
+	locksDirName    = "locks"
+	// Random names of temp files collide only if another writer uses the same name at the same time
+	maxTempFileAttempts = 100
+	// Temp files older than this are considered leftovers of crashed writers
+	staleTempFileAge = time.Hour
+)
 
 func NewError(err error, format string, args ...interface{}) storage.Error {
 	return storage.NewError(err, "FS", format, args...)
@@ -25,11 +45,16 @@ func NewFolder(rootPath string, subPath string) *Folder {
 	return &Folder{rootPath, subPath}
 }
 
+// ConfigureFolder removes temp files left by crashed writers, folders created by NewFolder do not do it
 func ConfigureFolder(path string, settings map[string]string) (storage.Folder, error) {
 	if _, err := os.Stat(path); err != nil {
 		return nil, NewError(err, "Folder not exists or is inaccessible")
 	}
-	return NewFolder(path, ""), nil
+	folder := NewFolder(path, "")
+	if err := folder.RemoveStaleTempFiles(); err != nil {
+		tracelog.WarningLogger.Printf("Failed to remove stale temp files of %v: %v\n", path, err)
+	}
+	return folder, nil
 }
 
 func (folder *Folder) GetPath() string {
@@ -42,6 +67,9 @@ func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []stora
 		return nil, nil, NewError(err, "Unable to read folder")
 	}
 	for _, fileInfo := range files {
+		if fileInfo.Name() == reservedDirName {
+			continue
+		}
 		if fileInfo.IsDir() {
 			// I do not use GetSubfolder() intentially
 			subPath := path.Join(folder.subpath, fileInfo.Name()) + "/"
@@ -62,6 +90,10 @@ func (folder *Folder) DeleteObjects(objectRelativePaths []string) error {
 		if err != nil {
 			return NewError(err, "Unable to delete object %v", fileName)
 		}
+		err = os.Remove(getOptionsFilePath(folder.GetFilePath(fileName)))
+		if err != nil && !os.IsNotExist(err) {
+			return NewError(err, "Unable to delete options of object %v", fileName)
+		}
 	}
 	return nil
 }
@@ -99,24 +131,306 @@ func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, erro
 	return file, nil
 }
 
+// PutObject replaces the object atomically, options of the previous object are not returned for it
 func (folder *Folder) PutObject(name string, content io.Reader) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{})
+}
+
+// PutObjectWithOptions stores non-empty options in a sidecar file with the version of the object.
+// The sidecar is written before the object is moved into place, StatObject ignores sidecars of other versions
+func (folder *Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	_, err := folder.putObject(name, content, options)
+	return err
+}
+
+// putObject returns the version of the temp file, which the object keeps when it is moved into place
+func (folder *Folder) putObject(name string, content io.Reader, options storage.PutOptions) (version string, err error) {
 	tracelog.DebugLogger.Printf("Put %v into %v\n", name, folder.subpath)
 	filePath := folder.GetFilePath(name)
-	file, err := OpenFileWithDir(filePath)
+	content = storage.TrackProgress(content, options.Progress)
+	beforeMove := func(tempPath string) error {
+		tempInfo, err := os.Stat(tempPath)
+		if err != nil {
+			return NewError(err, "Unable to stat %v", tempPath)
+		}
+		version = getFileVersion(tempInfo)
+		if options.ContentType == "" && options.ContentEncoding == "" && options.CacheControl == "" && len(options.Metadata) == 0 {
+			return nil
+		}
+		return writeOptionsFile(filePath, version, options)
+	}
+	moveIntoPlace := func(tempPath string) error {
+		err := beforeMove(tempPath)
+		if err != nil {
+			return err
+		}
+		return renameFile(tempPath, filePath)
+	}
+	if options.Condition != nil {
+		moveIntoPlace = func(tempPath string) error {
+			return moveIntoPlaceWithCondition(tempPath, filePath, *options.Condition, beforeMove)
+		}
+	}
+	err = writeFileAtomicallyWith(getTempDir(filePath), filePath, content, moveIntoPlace)
+	if err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// optionsFile is the content of the sidecar file
+type optionsFile struct {
+	// Version of the object, which the options belong to
+	Version string             `json:"version"`
+	Options storage.PutOptions `json:"options"`
+}
+
+func writeOptionsFile(filePath, version string, options storage.PutOptions) error {
+	optionsJSON, err := json.Marshal(optionsFile{version, options})
+	if err != nil {
+		return NewError(err, "Unable to marshal options of %v", filePath)
+	}
+	optionsPath := getOptionsFilePath(filePath)
+	err = os.MkdirAll(path.Dir(optionsPath), dirDefaultMode)
+	if err != nil {
+		return NewError(err, "Unable to create directory of options of %v", filePath)
+	}
+	return writeFileAtomicallyWith(getTempDir(filePath), optionsPath, bytes.NewReader(optionsJSON), func(tempPath string) error {
+		return renameFile(tempPath, optionsPath)
+	})
+}
+
+// StatObject returns options stored by PutObjectWithOptions, they are empty for objects put by PutObject
+func (folder *Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	filePath := folder.GetFilePath(objectRelativePath)
+	fileInfo, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return storage.ObjectAttributes{}, storage.NewObjectNotFoundError(filePath)
+	}
+	if err != nil {
+		return storage.ObjectAttributes{}, NewError(err, "Unable to stat object %v", filePath)
+	}
+	attributes := storage.ObjectAttributes{
+		Size:         fileInfo.Size(),
+		LastModified: fileInfo.ModTime(),
+		Version:      getFileVersion(fileInfo),
+	}
+	optionsJSON, err := ioutil.ReadFile(getOptionsFilePath(filePath))
+	if os.IsNotExist(err) {
+		return attributes, nil
+	}
+	if err != nil {
+		return storage.ObjectAttributes{}, NewError(err, "Unable to read options of %v", filePath)
+	}
+	var options optionsFile
+	err = json.Unmarshal(optionsJSON, &options)
+	if err != nil {
+		return storage.ObjectAttributes{}, NewError(err, "Unable to unmarshal options of %v", filePath)
+	}
+	// Options of the overwritten object or of the write, which has not finished yet, are not returned
+	if options.Version == attributes.Version {
+		attributes.PutOptions = options.Options
+	}
+	return attributes, nil
+}
+
+// PutObjectWithCondition checks the condition right before the object is moved into place
+// under flock of the directory, which other conditional writers take too
+func (folder *Folder) PutObjectWithCondition(name string, content io.Reader, condition storage.PutCondition) (string, error) {
+	return folder.putObject(name, content, storage.PutOptions{Condition: &condition})
+}
+
+// moveIntoPlaceWithCondition creates the object by hard link of the temp file for IfNoneMatch, which fails
+// if the object was created by an unconditional write meanwhile
+func moveIntoPlaceWithCondition(tempPath, filePath string, condition storage.PutCondition,
+	beforeMove func(tempPath string) error) error {
+	if !condition.IfNoneMatch && condition.IfMatch == "" {
+		err := beforeMove(tempPath)
+		if err != nil {
+			return err
+		}
+		return renameFile(tempPath, filePath)
+	}
+	dir, err := lockDirectory(path.Dir(filePath))
+	_, unsupported := err.(storage.UnsupportedOperationError)
+	if unsupported && condition.IfMatch != "" {
+		return err
+	}
+	// Without flock the link alone makes IfNoneMatch atomic
+	if err != nil && !unsupported {
+		return NewError(err, "Unable to lock directory of %v", filePath)
+	}
+	if dir != nil {
+		defer dir.Close()
+	}
+	fileInfo, err := os.Stat(filePath)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return NewError(err, "Unable to stat object %v", filePath)
+	}
+	if condition.IfNoneMatch && exists || condition.IfMatch != "" && (!exists || getFileVersion(fileInfo) != condition.IfMatch) {
+		return storage.NewPreconditionFailedError(filePath)
+	}
+	err = beforeMove(tempPath)
 	if err != nil {
-		return NewError(err, "Unable to open file %v", filePath)
+		return err
 	}
+	if !condition.IfNoneMatch {
+		return renameFile(tempPath, filePath)
+	}
+	err = os.Link(tempPath, filePath)
+	if os.IsExist(err) {
+		return storage.NewPreconditionFailedError(filePath)
+	}
+	if err != nil {
+		return NewError(err, "Unable to link %v to %v", tempPath, filePath)
+	}
+	return nil
+}
+
+// writeFileAtomicallyWith writes content into a temp file in tempDir, which must be on the same file system,
+// fsyncs it and moves it into place by the given function, so the file either appears completely or does not
+// appear at all. The temp file is removed afterwards
+func writeFileAtomicallyWith(tempDir, filePath string, content io.Reader, moveIntoPlace func(tempPath string) error) error {
+	file, err := createTempFileWithDir(tempDir, path.Base(filePath)+"_")
+	if err != nil {
+		return NewError(err, "Unable to create temp file for %v", filePath)
+	}
+	tempPath := file.Name()
+	defer func() {
+		if file != nil {
+			_ = file.Close()
+		}
+		_ = os.Remove(tempPath)
+	}()
 	_, err = io.Copy(file, content)
 	if err != nil {
 		return NewError(err, "Unable to copy data to %v", filePath)
 	}
+	err = file.Sync()
+	if err != nil {
+		return NewError(err, "Unable to sync %v", filePath)
+	}
 	err = file.Close()
+	file = nil
 	if err != nil {
 		return NewError(err, "Unable to close %v", filePath)
 	}
+	// File system sets modification time with coarse granularity, precise one is used as the version of the object
+	now := time.Now()
+	err = os.Chtimes(tempPath, now, now)
+	if err != nil {
+		return NewError(err, "Unable to set modification time of %v", filePath)
+	}
+	err = moveIntoPlace(tempPath)
+	if err != nil {
+		return err
+	}
+	err = syncDir(path.Dir(filePath))
+	if err != nil {
+		return NewError(err, "Unable to sync directory of %v", filePath)
+	}
 	return nil
 }
 
+func renameFile(tempPath, filePath string) error {
+	err := os.Rename(tempPath, filePath)
+	if err != nil {
+		return NewError(err, "Unable to rename %v to %v", tempPath, filePath)
+	}
+	return nil
+}
+
+// CreateTempFileWithDir creates temp file in the hidden directory next to filePath, creating directories if needed.
+// The file has the same permissions as the one created by os.Create, so readers of the object are not restricted
+func CreateTempFileWithDir(filePath string) (*os.File, error) {
+	return createTempFileWithDir(getTempDir(filePath), path.Base(filePath)+"_")
+}
+
+func createTempFileWithDir(dir, prefix string) (*os.File, error) {
+	file, err := createTempFile(dir, prefix)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(dir, dirDefaultMode)
+		if err != nil {
+			return nil, err
+		}
+		file, err = createTempFile(dir, prefix)
+	}
+	return file, err
+}
+
+// createTempFile is ioutil.TempFile with 0666 permissions, umask is applied to them by the system
+func createTempFile(dir, prefix string) (*os.File, error) {
+	suffix := make([]byte, 8)
+	for i := 0; i < maxTempFileAttempts; i++ {
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		tempPath := path.Join(dir, prefix+hex.EncodeToString(suffix))
+		file, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, err
+	}
+	return nil, errors.Errorf("unable to create temp file in %v after %d attempts", dir, maxTempFileAttempts)
+}
+
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// getReservedPath returns the path of the file of given kind, which belongs to the object
+func getReservedPath(filePath, kind string) string {
+	return path.Join(path.Dir(filePath), reservedDirName, kind, path.Base(filePath))
+}
+
+// getTempDir is in the directory of the object, so temp files are renamed within the same file system
+func getTempDir(filePath string) string {
+	return path.Join(path.Dir(filePath), reservedDirName, tempDirName)
+}
+
+func getOptionsFilePath(filePath string) string {
+	return getReservedPath(filePath, optionsDirName) + ".json"
+}
+
+func isTempFile(filePath string) bool {
+	dir := path.Dir(filePath)
+	return path.Base(dir) == tempDirName && path.Base(path.Dir(dir)) == reservedDirName
+}
+
+// RemoveStaleTempFiles removes temp files left in the folder and its subfolders by crashed writers, it is called
+// by ConfigureFolder. Temp files are removed by PutObject itself, so only ones older than staleTempFileAge are stale
+func (folder *Folder) RemoveStaleTempFiles() error {
+	root := path.Join(folder.rootPath, folder.subpath)
+	return filepath.Walk(root, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return NewError(err, "Unable to walk %v", filePath)
+		}
+		if fileInfo.IsDir() || !isTempFile(filePath) || time.Since(fileInfo.ModTime()) < staleTempFileAge {
+			return nil
+		}
+		tracelog.DebugLogger.Printf("Remove stale temp file %v\n", filePath)
+		err = os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return NewError(err, "Unable to remove stale temp file %v", filePath)
+		}
+		return nil
+	})
+}
+
 func OpenFileWithDir(filePath string) (*os.File, error) {
 	file, err := os.Create(filePath)
 	if os.IsNotExist(err) {
@@ -142,3 +456,8 @@ func (folder *Folder) EnsureExists() error {
 	}
 	return err
 }
+
+// SignedURL is not supported, there is no server to share files from
+func (folder *Folder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	return "", storage.NewUnsupportedOperationError("FS", "signed URLs")
+}
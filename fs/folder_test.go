@@ -1,12 +1,21 @@
 package fs
 
 import (
+	"bufio"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/tinsane/storages/storage"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestFSFolder(t *testing.T) {
@@ -22,6 +31,66 @@ func TestFSFolder(t *testing.T) {
 	storage.RunFolderTest(storageFolder, t)
 }
 
+func TestFSFolderPutObjectKeepsPermissionsOfCreate(t *testing.T) {
+	tmpDir := setupTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	folder := NewFolder(tmpDir, "")
+
+	created, err := os.Create(filepath.Join(tmpDir, "created"))
+	assert.NoError(t, err)
+	assert.NoError(t, created.Close())
+	err = folder.PutObject("file0", strings.NewReader("data0"))
+	assert.NoError(t, err)
+
+	createdInfo, err := os.Stat(filepath.Join(tmpDir, "created"))
+	assert.NoError(t, err)
+	putInfo, err := os.Stat(filepath.Join(tmpDir, "file0"))
+	assert.NoError(t, err)
+	assert.Equal(t, createdInfo.Mode().Perm(), putInfo.Mode().Perm())
+}
+
+func TestFSFolderPutObjectHidesTempFiles(t *testing.T) {
+	tmpDir := setupTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	folder := NewFolder(tmpDir, "")
+
+	freshTempPath := filepath.Join(tmpDir, reservedDirName, tempDirName, "fresh_123")
+	staleTempPath := filepath.Join(tmpDir, reservedDirName, tempDirName, "stale_123")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(freshTempPath), 0755))
+	for _, tempPath := range []string{freshTempPath, staleTempPath} {
+		err := ioutil.WriteFile(tempPath, []byte("partial"), 0644)
+		assert.NoError(t, err)
+	}
+	staleTime := time.Now().Add(-2 * staleTempFileAge)
+	err := os.Chtimes(staleTempPath, staleTime, staleTime)
+	assert.NoError(t, err)
+
+	// Names of objects do not collide with temp files and options
+	for _, name := range []string{"file0", ".tmp_put_file0", ".options_file0.json"} {
+		err = folder.PutObject(name, strings.NewReader("data0"))
+		assert.NoError(t, err)
+	}
+
+	objects, subFolders, err := folder.ListFolder()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(objects))
+	assert.Empty(t, subFolders)
+	// Listing does not change the folder
+	_, err = os.Stat(staleTempPath)
+	assert.NoError(t, err)
+
+	_, err = ConfigureFolder(tmpDir, nil)
+	assert.NoError(t, err)
+	_, err = os.Stat(freshTempPath)
+	assert.NoError(t, err)
+	_, err = os.Stat(staleTempPath)
+	assert.True(t, os.IsNotExist(err))
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "file0"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data0", string(data))
+}
+
 func setupTmpDir(t *testing.T) string {
 	cwd, err := filepath.Abs("./")
 	if err != nil {
@@ -38,3 +107,166 @@ func setupTmpDir(t *testing.T) string {
 	}
 	return tmpDir
 }
+
+func TestFSFolderSignedURLIsUnsupported(t *testing.T) {
+	folder := NewFolder(os.TempDir(), "")
+
+	_, err := storage.SignedURL(folder, "file", http.MethodGet, time.Hour)
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+}
+
+func TestFSFolderPutObjectWithOptions(t *testing.T) {
+	tmpDir := setupTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	folder := NewFolder(tmpDir, "")
+
+	options := storage.PutOptions{ContentType: "application/json", CacheControl: "no-cache",
+		Metadata: map[string]string{"backup-name": "base_123"}}
+	err := storage.PutObjectWithOptions(folder, "sub/sentinel.json", strings.NewReader("{}"), options)
+	assert.NoError(t, err)
+	attributes, err := storage.StatObject(folder, "sub/sentinel.json")
+	assert.NoError(t, err)
+	assert.Equal(t, options, attributes.PutOptions)
+	assert.Equal(t, int64(2), attributes.Size)
+
+	objects, _, err := folder.GetSubFolder("sub").ListFolder()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(objects))
+	assert.Equal(t, "sentinel.json", objects[0].GetName())
+
+	err = folder.PutObject("sub/sentinel.json", strings.NewReader("{}"))
+	assert.NoError(t, err)
+	attributes, err = folder.StatObject("sub/sentinel.json")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.PutOptions{}, attributes.PutOptions)
+
+	err = folder.PutObjectWithOptions("sub/sentinel.json", strings.NewReader("{}"), options)
+	assert.NoError(t, err)
+	// Options belong to the version of the object, so they are not returned for the object replaced bypassing the folder
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "sub", "sentinel.json"), []byte("{\"replaced\": true}"), 0644)
+	assert.NoError(t, err)
+	attributes, err = folder.StatObject("sub/sentinel.json")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.PutOptions{}, attributes.PutOptions)
+
+	err = folder.PutObjectWithOptions("sub/sentinel.json", strings.NewReader("{}"), options)
+	assert.NoError(t, err)
+	err = folder.DeleteObjects([]string{"sub/sentinel.json"})
+	assert.NoError(t, err)
+	objects, _, err = folder.GetSubFolder("sub").ListFolder()
+	assert.NoError(t, err)
+	assert.Empty(t, objects)
+	_, err = os.Stat(getOptionsFilePath(filepath.Join(tmpDir, "sub", "sentinel.json")))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFSFolderPutObjectWithCondition(t *testing.T) {
+	tmpDir := setupTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	folder := NewFolder(tmpDir, "")
+
+	version, err := folder.PutObjectWithCondition("sentinel", strings.NewReader("v1"), storage.PutCondition{IfNoneMatch: true})
+	assert.NoError(t, err)
+	_, err = folder.PutObjectWithCondition("sentinel", strings.NewReader("v2"), storage.PutCondition{IfNoneMatch: true})
+	assert.IsType(t, storage.PreconditionFailedError{}, err)
+
+	attributes, err := folder.StatObject("sentinel")
+	assert.NoError(t, err)
+	assert.Equal(t, attributes.Version, version)
+	_, err = folder.PutObjectWithCondition("sentinel", strings.NewReader("v2"), storage.PutCondition{IfMatch: attributes.Version})
+	assert.NoError(t, err)
+	_, err = folder.PutObjectWithCondition("sentinel", strings.NewReader("v3"), storage.PutCondition{IfMatch: attributes.Version})
+	assert.IsType(t, storage.PreconditionFailedError{}, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "sentinel"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(data))
+	objects, _, err := folder.ListFolder()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(objects))
+}
+
+func TestFSFolderConditionalPutsOfDifferentFolders(t *testing.T) {
+	tmpDir := setupTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	folders := []*Folder{NewFolder(tmpDir, ""), NewFolder(tmpDir, "")}
+	assert.NoError(t, folders[0].PutObject("counter", strings.NewReader("0")))
+
+	// Every increment is a read-modify-write, so lost updates show up as a smaller counter
+	var increments int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(folder *Folder) {
+			defer wg.Done()
+			for attempt := 0; attempt < 20; attempt++ {
+				attributes, err := folder.StatObject("counter")
+				assert.NoError(t, err)
+				data, err := ioutil.ReadFile(filepath.Join(tmpDir, "counter"))
+				assert.NoError(t, err)
+				value, err := strconv.Atoi(string(data))
+				assert.NoError(t, err)
+				_, err = folder.PutObjectWithCondition("counter", strings.NewReader(strconv.Itoa(value+1)),
+					storage.PutCondition{IfMatch: attributes.Version})
+				if _, ok := err.(storage.PreconditionFailedError); ok {
+					continue
+				}
+				assert.NoError(t, err)
+				atomic.AddInt32(&increments, 1)
+			}
+		}(folders[i%2])
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "counter"))
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(int(increments)), string(data))
+}
+
+// TestFSLockHelperProcess holds the lock in a separate process until its stdin is closed
+func TestFSLockHelperProcess(t *testing.T) {
+	dir := os.Getenv("FS_LOCK_HELPER_DIR")
+	if dir == "" {
+		return
+	}
+	lock, err := NewFolder(dir, "").NewLock("lock", "helper", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Acquire())
+	fmt.Println("acquired")
+	_, _ = ioutil.ReadAll(os.Stdin)
+	assert.NoError(t, lock.Release())
+}
+
+func TestFSLockIsExclusiveBetweenProcesses(t *testing.T) {
+	tmpDir := setupTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	helper := exec.Command(os.Args[0], "-test.run=^TestFSLockHelperProcess$")
+	helper.Env = append(os.Environ(), "FS_LOCK_HELPER_DIR="+tmpDir)
+	stdin, err := helper.StdinPipe()
+	assert.NoError(t, err)
+	stdout, err := helper.StdoutPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, helper.Start())
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "acquired\n", line)
+
+	lock, err := storage.NewLock(NewFolder(tmpDir, ""), "lock", "runner", time.Minute)
+	assert.NoError(t, err)
+	err = lock.Acquire()
+	assert.IsType(t, storage.LockHeldError{}, err)
+	assert.Equal(t, "helper", err.(storage.LockHeldError).Owner)
+
+	assert.NoError(t, stdin.Close())
+	_, _ = ioutil.ReadAll(stdout)
+	assert.NoError(t, helper.Wait())
+	assert.NoError(t, lock.Acquire())
+	assert.NoError(t, lock.Renew())
+	assert.NoError(t, lock.Release())
+	assert.IsType(t, storage.LockLostError{}, lock.Renew())
+
+	// Lock files are not objects
+	objects, _, err := NewFolder(tmpDir, "").ListFolder()
+	assert.NoError(t, err)
+	assert.Empty(t, objects)
+}
@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/tinsane/storages/storage"
+)
+
+// flockLock is flock of the lock file, which is released by Release or by exit of the holder process.
+// It does not expire, so TTL is not used and Renew only checks that the lock is held. Lock files are kept
+// in the hidden directory, so they are not listed and not removed with objects
+type flockLock struct {
+	filePath string
+	name     string
+	owner    string
+	// file is open while the lock is held
+	file *os.File
+}
+
+// NewLock returns the lock, which is exclusive between processes on the same host
+func (folder *Folder) NewLock(name, owner string, ttl time.Duration) (storage.Lock, error) {
+	return &flockLock{filePath: getReservedPath(folder.GetFilePath(name), locksDirName), name: name, owner: owner}, nil
+}
+
+func (lock *flockLock) Acquire() error {
+	if lock.file != nil {
+		return nil
+	}
+	err := os.MkdirAll(path.Dir(lock.filePath), dirDefaultMode)
+	if err != nil {
+		return NewError(err, "Unable to create directory of lock %v", lock.filePath)
+	}
+	file, err := os.OpenFile(lock.filePath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return NewError(err, "Unable to open lock %v", lock.filePath)
+	}
+	locked, err := tryLockFile(file)
+	if err != nil {
+		_ = file.Close()
+		if _, ok := err.(storage.UnsupportedOperationError); ok {
+			return err
+		}
+		return NewError(err, "Unable to lock %v", lock.filePath)
+	}
+	if !locked {
+		// Holder writes its name right after locking, so the owner may be empty for a moment
+		owner, _ := ioutil.ReadAll(file)
+		_ = file.Close()
+		return storage.NewLockHeldError(lock.name, string(owner), time.Time{})
+	}
+	err = writeOwner(file, lock.owner)
+	if err != nil {
+		_ = file.Close()
+		return NewError(err, "Unable to write owner of lock %v", lock.filePath)
+	}
+	lock.file = file
+	return nil
+}
+
+func (lock *flockLock) Renew() error {
+	if lock.file == nil {
+		return storage.NewLockLostError(lock.name)
+	}
+	return nil
+}
+
+// Release clears the owner and closes the file, which releases the flock
+func (lock *flockLock) Release() error {
+	if lock.file == nil {
+		return nil
+	}
+	file := lock.file
+	lock.file = nil
+	err := writeOwner(file, "")
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return NewError(err, "Unable to release lock %v", lock.filePath)
+	}
+	return nil
+}
+
+func writeOwner(file *os.File, owner string) error {
+	err := file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt([]byte(owner), 0)
+	return err
+}
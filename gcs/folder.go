@@ -2,33 +2,110 @@ package gcs
 
 import (
 	"context"
+	"github.com/pkg/errors"
 	"github.com/tinsane/storages/storage"
 	"github.com/tinsane/tracelog"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	gcs "cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
 const (
 	ContextTimeout        = "GCS_CONTEXT_TIMEOUT"
 	defaultContextTimeout = 60 * 60 // 1 hour
+	// Large objects are downloaded by concurrent range requests if concurrency is greater than 1
+	DownloadConcurrencySetting = "GCS_DOWNLOAD_CONCURRENCY"
+	DownloadChunkSizeSetting   = "GCS_DOWNLOAD_CHUNK_SIZE"
+	DownloadMemoryLimitSetting = "GCS_DOWNLOAD_MEMORY_LIMIT"
+	// Service account key used to sign URLs, GOOGLE_APPLICATION_CREDENTIALS is used if not set
+	SigningCredentialsFileSetting = "GCS_SIGNING_CREDENTIALS_FILE"
+	applicationCredentialsEnv     = "GOOGLE_APPLICATION_CREDENTIALS"
+	// Storage class of uploaded objects, the default class of the bucket is used if not set
+	StorageClassSetting = "GCS_STORAGE_CLASS"
 )
 
 var SettingList = []string{
 	ContextTimeout,
+	DownloadConcurrencySetting,
+	DownloadChunkSizeSetting,
+	DownloadMemoryLimitSetting,
+	SigningCredentialsFileSetting,
+	StorageClassSetting,
 }
 
 func NewError(err error, format string, args ...interface{}) storage.Error {
 	return storage.NewError(err, "GCS", format, args...)
 }
 
+// SigningConfig is needed to sign URLs, bucket handle does not expose its name
+type SigningConfig struct {
+	BucketName string
+	// Email and private key of the service account, URLs are not signed if the key is not set
+	GoogleAccessID string
+	PrivateKey     []byte
+}
+
+// configureSigning loads the service account key once. Application credentials may be not a service account,
+// so they are ignored with a warning if they can not be used for signing
+func configureSigning(bucketName string, settings map[string]string) (SigningConfig, error) {
+	config := SigningConfig{BucketName: bucketName}
+	credentialsFile, ok := settings[SigningCredentialsFileSetting]
+	if !ok {
+		credentialsFile = os.Getenv(applicationCredentialsEnv)
+	}
+	if credentialsFile == "" {
+		return config, nil
+	}
+	jwtConfig, err := loadServiceAccountKey(credentialsFile)
+	if err != nil && ok {
+		return config, err
+	}
+	if err != nil {
+		tracelog.WarningLogger.Printf("URLs will not be signed: %v\n", err)
+		return config, nil
+	}
+	config.GoogleAccessID, config.PrivateKey = jwtConfig.Email, jwtConfig.PrivateKey
+	return config, nil
+}
+
+func loadServiceAccountKey(credentialsFile string) (*jwt.Config, error) {
+	jsonKey, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, NewError(err, "Unable to read credentials file %v", credentialsFile)
+	}
+	jwtConfig, err := google.JWTConfigFromJSON(jsonKey)
+	if err != nil {
+		return nil, NewError(err, "Unable to parse service account key %v", credentialsFile)
+	}
+	return jwtConfig, nil
+}
+
+// FolderOptions are optional settings of the folder, zero value uses defaults
+type FolderOptions struct {
+	ParallelRead storage.ParallelReadOptions
+	// URLs are not signed if signing is not configured
+	Signing SigningConfig
+	// Empty storage class means the default class of the bucket
+	StorageClass string
+}
+
 func NewFolder(bucket *gcs.BucketHandle, path string, contextTimeout int) *Folder {
-	return &Folder{bucket, path, contextTimeout}
+	return NewFolderWithOptions(bucket, path, contextTimeout, FolderOptions{})
+}
+
+func NewFolderWithOptions(bucket *gcs.BucketHandle, path string, contextTimeout int, options FolderOptions) *Folder {
+	return &Folder{bucket, path, contextTimeout, options}
 }
 
 func ConfigureFolder(prefix string, settings map[string]string) (storage.Folder, error) {
@@ -56,7 +133,17 @@ func ConfigureFolder(prefix string, settings map[string]string) (storage.Folder,
 			return nil, NewError(err, "Unable to parse Context Timeout %v", prefix)
 		}
 	}
-	return NewFolder(bucket, path, contextTimeout), nil
+	parallelReadOptions, err := storage.ConfigureParallelReadOptions(settings,
+		DownloadConcurrencySetting, DownloadChunkSizeSetting, DownloadMemoryLimitSetting)
+	if err != nil {
+		return nil, NewError(err, "Invalid download settings")
+	}
+	signingConfig, err := configureSigning(bucketName, settings)
+	if err != nil {
+		return nil, err
+	}
+	options := FolderOptions{ParallelRead: parallelReadOptions, Signing: signingConfig, StorageClass: settings[StorageClassSetting]}
+	return NewFolderWithOptions(bucket, path, contextTimeout, options), nil
 }
 
 // Folder represents folder in GCP
@@ -64,6 +151,7 @@ type Folder struct {
 	bucket         *gcs.BucketHandle
 	path           string
 	contextTimeout int
+	options        FolderOptions
 }
 
 func (folder *Folder) GetPath() string {
@@ -84,7 +172,7 @@ func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []stora
 			return nil, nil, NewError(err, "Unable to iterate %v", folder.path)
 		}
 		if objAttrs.Prefix != "" {
-			subFolders = append(subFolders, NewFolder(folder.bucket, objAttrs.Prefix, folder.contextTimeout))
+			subFolders = append(subFolders, NewFolderWithOptions(folder.bucket, objAttrs.Prefix, folder.contextTimeout, folder.options))
 		} else {
 			objName := strings.TrimPrefix(objAttrs.Name, prefix)
 			objects = append(objects, storage.NewLocalObject(objName, objAttrs.Updated))
@@ -97,18 +185,24 @@ func (folder *Folder) createTimeoutContext() (context.Context, context.CancelFun
 	return context.WithTimeout(context.Background(), time.Second*time.Duration(folder.contextTimeout))
 }
 
+// DeleteObjects tries to delete every object, failures are reported together by storage.DeleteObjectsError
 func (folder *Folder) DeleteObjects(objectRelativePaths []string) error {
+	var failures []storage.DeleteFailure
 	for _, objectRelativePath := range objectRelativePaths {
 		path := storage.JoinPath(folder.path, objectRelativePath)
 		object := folder.bucket.Object(path)
 		tracelog.DebugLogger.Printf("Delete %v\n", path)
 		ctx, cancel := folder.createTimeoutContext()
-		defer cancel()
 		err := object.Delete(ctx)
+		cancel()
 		if err != nil && err != gcs.ErrObjectNotExist {
-			return NewError(err, "Unable to delete object %v", path)
+			tracelog.WarningLogger.Printf("Unable to delete object %v: %v\n", path, err)
+			failures = append(failures, storage.DeleteFailure{ObjectRelativePath: objectRelativePath, Err: err})
 		}
 	}
+	if len(failures) > 0 {
+		return storage.NewDeleteObjectsError("GCS", failures)
+	}
 	return nil
 }
 
@@ -128,12 +222,15 @@ func (folder *Folder) Exists(objectRelativePath string) (bool, error) {
 }
 
 func (folder *Folder) GetSubFolder(subFolderRelativePath string) storage.Folder {
-	return NewFolder(folder.bucket, storage.JoinPath(folder.path, subFolderRelativePath), folder.contextTimeout)
+	return NewFolderWithOptions(folder.bucket, storage.JoinPath(folder.path, subFolderRelativePath), folder.contextTimeout, folder.options)
 }
 
 func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, error) {
 	path := storage.JoinPath(folder.path, objectRelativePath)
 	object := folder.bucket.Object(path)
+	if folder.options.ParallelRead.Enabled() {
+		return folder.readObjectInParallel(path, object)
+	}
 	reader, err := object.NewReader(context.Background())
 	if err == gcs.ErrObjectNotExist {
 		return nil, storage.NewObjectNotFoundError(path)
@@ -141,20 +238,253 @@ func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, erro
 	return ioutil.NopCloser(reader), err
 }
 
+// readObjectInParallel downloads objects bigger than one chunk by concurrent range requests.
+// All ranges are read from the same generation of the object, even if it is overwritten meanwhile
+func (folder *Folder) readObjectInParallel(path string, object *gcs.ObjectHandle) (io.ReadCloser, error) {
+	ctx, cancel := folder.createTimeoutContext()
+	defer cancel()
+	attrs, err := object.Attrs(ctx)
+	if err == gcs.ErrObjectNotExist {
+		return nil, storage.NewObjectNotFoundError(path)
+	}
+	if err != nil {
+		return nil, NewError(err, "Unable to stat object %v", path)
+	}
+	generationObject := object.Generation(attrs.Generation)
+	if attrs.Size <= folder.options.ParallelRead.ChunkSize {
+		reader, err := generationObject.NewReader(context.Background())
+		if err == gcs.ErrObjectNotExist {
+			return nil, storage.NewObjectNotFoundError(path)
+		}
+		return reader, err
+	}
+	readRange := func(offset, length int64) (io.ReadCloser, error) {
+		return generationObject.NewRangeReader(context.Background(), offset, length)
+	}
+	return storage.NewParallelReader(attrs.Size, readRange, folder.options.ParallelRead), nil
+}
+
+// SignedURL returns V4 signed URL, the private key of the service account is used locally.
+// GCS limits expiry to 7 days
+func (folder *Folder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	if err := storage.CheckSignedURLMethod(method); err != nil {
+		return "", err
+	}
+	if len(folder.options.Signing.PrivateKey) == 0 {
+		return "", NewError(errors.New("service account key is not set"),
+			"Unable to sign url, set %s or %s", SigningCredentialsFileSetting, applicationCredentialsEnv)
+	}
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	signedURL, err := gcs.SignedURL(folder.options.Signing.BucketName, path, &gcs.SignedURLOptions{
+		GoogleAccessID: folder.options.Signing.GoogleAccessID,
+		PrivateKey:     folder.options.Signing.PrivateKey,
+		Method:         method,
+		Expires:        time.Now().Add(expiry),
+		Scheme:         gcs.SigningSchemeV4,
+	})
+	if err != nil {
+		return "", NewError(err, "Unable to sign url of object %v", path)
+	}
+	return signedURL, nil
+}
+
 func (folder *Folder) PutObject(name string, content io.Reader) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{})
+}
+
+// PutObjectWithStorageClass uploads the object to the given storage class, empty class means the bucket default
+func (folder *Folder) PutObjectWithStorageClass(name string, content io.Reader, storageClass string) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{StorageClass: storageClass})
+}
+
+// PutObjectWithCondition uploads the object with precondition on its generation, which is the version of the object
+func (folder *Folder) PutObjectWithCondition(name string, content io.Reader, condition storage.PutCondition) (string, error) {
+	return folder.putObject(name, content, storage.PutOptions{Condition: &condition})
+}
+
+// PutObjectWithOptions uploads the object with attributes, content type is detected by GCS if it is not set
+func (folder *Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	_, err := folder.putObject(name, content, options)
+	return err
+}
+
+// putObject returns the generation of the uploaded object
+func (folder *Folder) putObject(name string, content io.Reader, options storage.PutOptions) (version string, err error) {
 	tracelog.DebugLogger.Printf("Put %v into %v\n", name, folder.path)
-	object := folder.bucket.Object(storage.JoinPath(folder.path, name))
+	object := folder.getObject(name)
+	if options.Condition != nil && options.Condition.IfNoneMatch {
+		object = object.If(gcs.Conditions{DoesNotExist: true})
+	} else if options.Condition != nil && options.Condition.IfMatch != "" {
+		generation, err := strconv.ParseInt(options.Condition.IfMatch, 10, 64)
+		if err != nil {
+			return "", NewError(err, "Invalid generation %v", options.Condition.IfMatch)
+		}
+		object = object.If(gcs.Conditions{GenerationMatch: generation})
+	}
 	ctx, cancel := folder.createTimeoutContext()
 	defer cancel()
 	writer := object.NewWriter(ctx)
-	_, err := io.Copy(writer, content)
+	writer.StorageClass = options.StorageClass
+	if writer.StorageClass == "" {
+		writer.StorageClass = folder.options.StorageClass
+	}
+	writer.ContentType = options.ContentType
+	writer.ContentEncoding = options.ContentEncoding
+	writer.CacheControl = options.CacheControl
+	writer.Metadata = options.Metadata
+	var reported int64
+	if options.Progress != nil {
+		// Progress is reported for chunks of resumable uploads, it is called from the goroutine of the writer
+		writer.ProgressFunc = func(uploaded int64) {
+			options.Progress.Add(uploaded - atomic.SwapInt64(&reported, uploaded))
+		}
+	}
+	written, err := io.Copy(writer, content)
+	if isPreconditionFailed(err) {
+		return "", storage.NewPreconditionFailedError(object.ObjectName())
+	}
 	if err != nil {
-		return NewError(err, "Unable to copy to object")
+		return "", NewError(err, "Unable to copy to object")
 	}
 	tracelog.DebugLogger.Printf("Put %v done\n", name)
 	err = writer.Close()
+	if isPreconditionFailed(err) {
+		return "", storage.NewPreconditionFailedError(object.ObjectName())
+	}
 	if err != nil {
-		return NewError(err, "Unable to Close object")
+		return "", NewError(err, "Unable to Close object")
+	}
+	if options.Progress != nil {
+		// Objects uploaded by a single request are not reported by the writer
+		options.Progress.Add(written - atomic.SwapInt64(&reported, written))
+	}
+	return strconv.FormatInt(writer.Attrs().Generation, 10), nil
+}
+
+// PutObjectWithProgress counts bytes of uploaded chunks, so progress is not ahead of the upload by the chunk buffer
+func (folder *Folder) PutObjectWithProgress(name string, content io.Reader, tracker *storage.ProgressTracker) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{Progress: tracker})
+}
+
+func (folder *Folder) getObject(name string) *gcs.ObjectHandle {
+	return folder.bucket.Object(storage.JoinPath(folder.path, name))
+}
+
+// isPreconditionFailed is true if conditional write failed, the upload fails with this error on write or close
+func isPreconditionFailed(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusPreconditionFailed
+}
+
+func (folder *Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	ctx, cancel := folder.createTimeoutContext()
+	defer cancel()
+	attrs, err := folder.bucket.Object(path).Attrs(ctx)
+	if err == gcs.ErrObjectNotExist {
+		return storage.ObjectAttributes{}, storage.NewObjectNotFoundError(path)
+	}
+	if err != nil {
+		return storage.ObjectAttributes{}, NewError(err, "Unable to stat object %v", path)
+	}
+	return storage.ObjectAttributes{
+		PutOptions: storage.PutOptions{
+			ContentType:     attrs.ContentType,
+			ContentEncoding: attrs.ContentEncoding,
+			CacheControl:    attrs.CacheControl,
+			Metadata:        attrs.Metadata,
+		},
+		Size:         attrs.Size,
+		LastModified: attrs.Updated,
+		Version:      strconv.FormatInt(attrs.Generation, 10),
+	}, nil
+}
+
+// SetStorageClass rewrites the object with the new storage class on the server side
+func (folder *Folder) SetStorageClass(objectRelativePath, storageClass string) error {
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	object := folder.bucket.Object(path)
+	ctx, cancel := folder.createTimeoutContext()
+	defer cancel()
+	copier := object.CopierFrom(object)
+	copier.StorageClass = storageClass
+	_, err := copier.Run(ctx)
+	if err == gcs.ErrObjectNotExist {
+		return storage.NewObjectNotFoundError(path)
+	}
+	if err != nil {
+		return NewError(err, "Unable to set storage class of object %v to %v", path, storageClass)
+	}
+	return nil
+}
+
+// ListObjectVersions lists live and noncurrent generations of the object, the bucket must have versioning enabled.
+// GCS has no delete markers, the deleted object has noncurrent generations only
+func (folder *Folder) ListObjectVersions(objectRelativePath string) ([]storage.ObjectVersion, error) {
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	ctx, cancel := folder.createTimeoutContext()
+	defer cancel()
+	it := folder.bucket.Objects(ctx, &gcs.Query{Prefix: path, Versions: true})
+	var versions []storage.ObjectVersion
+	for {
+		objAttrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, NewError(err, "Unable to list versions of %v", path)
+		}
+		if objAttrs.Name != path {
+			continue
+		}
+		versions = append(versions, storage.ObjectVersion{
+			ObjectRelativePath: objectRelativePath,
+			VersionID:          strconv.FormatInt(objAttrs.Generation, 10),
+			IsLatest:           objAttrs.Deleted.IsZero(),
+			LastModified:       objAttrs.Updated,
+			Size:               objAttrs.Size,
+		})
+	}
+	// Generations are listed in ascending order
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	return versions, nil
+}
+
+func (folder *Folder) ReadObjectVersion(objectRelativePath, versionID string) (io.ReadCloser, error) {
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	generation, err := strconv.ParseInt(versionID, 10, 64)
+	if err != nil {
+		return nil, NewError(err, "Invalid generation %v of object %v", versionID, path)
+	}
+	reader, err := folder.bucket.Object(path).Generation(generation).NewReader(context.Background())
+	if err == gcs.ErrObjectNotExist {
+		return nil, storage.NewObjectNotFoundError(path + "#" + versionID)
+	}
+	return ioutil.NopCloser(reader), err
+}
+
+// DeleteObjectVersions deletes generations permanently, deletion of the live generation does not restore the previous one
+func (folder *Folder) DeleteObjectVersions(versions []storage.ObjectVersion) error {
+	var failures []storage.DeleteFailure
+	for _, version := range versions {
+		path := storage.JoinPath(folder.path, version.ObjectRelativePath)
+		generation, err := strconv.ParseInt(version.VersionID, 10, 64)
+		if err != nil {
+			return NewError(err, "Invalid generation %v of object %v", version.VersionID, path)
+		}
+		tracelog.DebugLogger.Printf("Delete %v#%v\n", path, generation)
+		ctx, cancel := folder.createTimeoutContext()
+		err = folder.bucket.Object(path).Generation(generation).Delete(ctx)
+		cancel()
+		if err != nil && err != gcs.ErrObjectNotExist {
+			tracelog.WarningLogger.Printf("Unable to delete object %v#%v: %v\n", path, generation, err)
+			failures = append(failures, storage.DeleteFailure{ObjectRelativePath: version.ObjectRelativePath, Err: err})
+		}
+	}
+	if len(failures) > 0 {
+		return storage.NewDeleteObjectsError("GCS", failures)
 	}
 	return nil
 }
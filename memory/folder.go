@@ -7,8 +7,10 @@ import (
 	"io"
 	"io/ioutil"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Folder struct {
@@ -73,11 +75,102 @@ func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, erro
 }
 
 func (folder *Folder) PutObject(name string, content io.Reader) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{})
+}
+
+// PutObjectWithOptions compares the generation of the object with the condition and stores the new one atomically
+func (folder *Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	_, err := folder.putObject(name, content, options)
+	return err
+}
+
+// putObject returns the generation of the stored object
+func (folder *Folder) putObject(name string, content io.Reader, options storage.PutOptions) (version string, err error) {
 	data, err := ioutil.ReadAll(content)
 	objectPath := folder.path + name
 	if err != nil {
-		return errors.Wrapf(err, "failed to put '%s' in memory storage", objectPath)
+		return "", errors.Wrapf(err, "failed to put '%s' in memory storage", objectPath)
+	}
+	if options.Progress != nil {
+		options.Progress.Add(int64(len(data)))
+	}
+	var condition storage.PutCondition
+	if options.Condition != nil {
+		condition = *options.Condition
+	}
+	// Options of the upload are not stored with the object
+	options.StorageClass, options.Condition, options.Progress = "", nil, nil
+	generation, stored := folder.Storage.CompareAndStore(objectPath, *bytes.NewBuffer(data), options,
+		func(current TimeStampedData, exists bool) bool {
+			if condition.IfNoneMatch && exists {
+				return false
+			}
+			return condition.IfMatch == "" || exists && strconv.FormatInt(current.Generation, 10) == condition.IfMatch
+		})
+	if !stored {
+		return "", storage.NewPreconditionFailedError(objectPath)
+	}
+	return strconv.FormatInt(generation, 10), nil
+}
+
+func (folder *Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	objectAbsPath := folder.path + objectRelativePath
+	object, exists := folder.Storage.Load(objectAbsPath)
+	if !exists {
+		return storage.ObjectAttributes{}, storage.NewObjectNotFoundError(objectAbsPath)
+	}
+	return storage.ObjectAttributes{
+		PutOptions:   object.Options,
+		Size:         int64(object.Data.Len()),
+		LastModified: object.Timestamp,
+		Version:      strconv.FormatInt(object.Generation, 10),
+	}, nil
+}
+
+func (folder *Folder) PutObjectWithCondition(name string, content io.Reader, condition storage.PutCondition) (string, error) {
+	return folder.putObject(name, content, storage.PutOptions{Condition: &condition})
+}
+
+// ListObjectVersions returns the current value only, unless the storage is created by NewVersionedStorage
+func (folder *Folder) ListObjectVersions(objectRelativePath string) ([]storage.ObjectVersion, error) {
+	values := folder.Storage.Versions(folder.path + objectRelativePath)
+	versions := make([]storage.ObjectVersion, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		versions = append(versions, storage.ObjectVersion{
+			ObjectRelativePath: objectRelativePath,
+			VersionID:          strconv.FormatInt(values[i].Generation, 10),
+			IsLatest:           i == len(values)-1,
+			IsDeleteMarker:     values[i].DeleteMarker,
+			LastModified:       values[i].Timestamp,
+			Size:               int64(values[i].Data.Len()),
+		})
+	}
+	return versions, nil
+}
+
+func (folder *Folder) ReadObjectVersion(objectRelativePath, versionID string) (io.ReadCloser, error) {
+	objectAbsPath := folder.path + objectRelativePath
+	for _, value := range folder.Storage.Versions(objectAbsPath) {
+		if strconv.FormatInt(value.Generation, 10) == versionID && !value.DeleteMarker {
+			return ioutil.NopCloser(&value.Data), nil
+		}
+	}
+	return nil, storage.NewObjectNotFoundError(objectAbsPath + "?versionId=" + versionID)
+}
+
+// DeleteObjectVersions deletes versions like S3 does, the previous version becomes current unless it is a delete marker
+func (folder *Folder) DeleteObjectVersions(versions []storage.ObjectVersion) error {
+	for _, version := range versions {
+		generation, err := strconv.ParseInt(version.VersionID, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "invalid version '%s' of '%s'", version.VersionID, version.ObjectRelativePath)
+		}
+		folder.Storage.DeleteVersion(folder.path+version.ObjectRelativePath, generation)
 	}
-	folder.Storage.Store(objectPath, *bytes.NewBuffer(data))
 	return nil
 }
+
+// SignedURL is not supported, objects are not reachable from outside of the process
+func (folder *Folder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	return "", storage.NewUnsupportedOperationError("Memory", "signed URLs")
+}
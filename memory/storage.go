@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"sync"
 	"time"
+
+	"github.com/tinsane/storages/storage"
 )
 
 // This function is needed for being cross-platform
@@ -18,19 +20,34 @@ func CeilTimeUpToMicroseconds(timeToCeil time.Time) time.Time {
 type TimeStampedData struct {
 	Data      bytes.Buffer
 	Timestamp time.Time
+	Options   storage.PutOptions
+	// Generation is unique for every write, it is used as the version of the object
+	Generation int64
+	// DeleteMarker is kept instead of the deleted object if versioning is enabled
+	DeleteMarker bool
 }
 
 func TimeStampData(data bytes.Buffer) TimeStampedData {
-	return TimeStampedData{data, CeilTimeUpToMicroseconds(time.Now())}
+	return TimeStampedData{data, CeilTimeUpToMicroseconds(time.Now()), storage.PutOptions{}, 0, false}
 }
 
 // Storage is supposed to be used for tests. It doesn't guarantee data safety!
 type Storage struct {
 	underlying *sync.Map
+	// Writes are serialized, so conditional writes can compare and swap
+	writeMutex *sync.Mutex
+	generation int64
+	// history keeps previous versions and delete markers of keys, oldest first, if versioning is enabled
+	history map[string][]TimeStampedData
 }
 
 func NewStorage() *Storage {
-	return &Storage{&sync.Map{}}
+	return &Storage{&sync.Map{}, &sync.Mutex{}, 0, nil}
+}
+
+// NewVersionedStorage emulates the bucket with versioning enabled, overwritten and deleted values are kept
+func NewVersionedStorage() *Storage {
+	return &Storage{&sync.Map{}, &sync.Mutex{}, 0, make(map[string][]TimeStampedData)}
 }
 
 func (storage *Storage) Load(key string) (value TimeStampedData, exists bool) {
@@ -42,13 +59,102 @@ func (storage *Storage) Load(key string) (value TimeStampedData, exists bool) {
 }
 
 func (storage *Storage) Store(key string, value bytes.Buffer) {
-	storage.underlying.Store(key, TimeStampData(value))
+	storage.writeMutex.Lock()
+	defer storage.writeMutex.Unlock()
+	storage.store(key, TimeStampData(value))
+}
+
+func (storage *Storage) StoreWithOptions(key string, value bytes.Buffer, options storage.PutOptions) {
+	data := TimeStampData(value)
+	data.Options = options
+	storage.writeMutex.Lock()
+	defer storage.writeMutex.Unlock()
+	storage.store(key, data)
+}
+
+// CompareAndStore stores the value only if check accepts the current one, exists is false if there is no current value.
+// It returns the generation of the stored value
+func (storage *Storage) CompareAndStore(key string, value bytes.Buffer, options storage.PutOptions,
+	check func(current TimeStampedData, exists bool) bool) (generation int64, stored bool) {
+	data := TimeStampData(value)
+	data.Options = options
+	storage.writeMutex.Lock()
+	defer storage.writeMutex.Unlock()
+	if !check(storage.Load(key)) {
+		return 0, false
+	}
+	return storage.store(key, data), true
+}
+
+func (storage *Storage) store(key string, data TimeStampedData) int64 {
+	storage.keepCurrent(key)
+	storage.generation++
+	data.Generation = storage.generation
+	storage.underlying.Store(key, data)
+	return data.Generation
 }
 
 func (storage *Storage) Delete(key string) {
+	storage.writeMutex.Lock()
+	defer storage.writeMutex.Unlock()
+	if storage.history != nil {
+		storage.keepCurrent(key)
+		storage.generation++
+		marker := TimeStampData(bytes.Buffer{})
+		marker.Generation = storage.generation
+		marker.DeleteMarker = true
+		storage.history[key] = append(storage.history[key], marker)
+	}
 	storage.underlying.Delete(key)
 }
 
+// keepCurrent moves the current value to history before it is overwritten or deleted
+func (storage *Storage) keepCurrent(key string) {
+	if storage.history == nil {
+		return
+	}
+	if current, exists := storage.Load(key); exists {
+		storage.history[key] = append(storage.history[key], current)
+	}
+}
+
+// Versions returns previous values and delete markers of the key and its current value, oldest first
+func (storage *Storage) Versions(key string) []TimeStampedData {
+	storage.writeMutex.Lock()
+	defer storage.writeMutex.Unlock()
+	versions := append([]TimeStampedData(nil), storage.history[key]...)
+	if current, exists := storage.Load(key); exists {
+		versions = append(versions, current)
+	}
+	return versions
+}
+
+// DeleteVersion removes the version permanently. If the current value is removed, the previous version becomes
+// current unless it is a delete marker
+func (storage *Storage) DeleteVersion(key string, generation int64) {
+	storage.writeMutex.Lock()
+	defer storage.writeMutex.Unlock()
+	if current, exists := storage.Load(key); exists && current.Generation == generation {
+		storage.underlying.Delete(key)
+	}
+	history := storage.history[key]
+	for i, version := range history {
+		if version.Generation == generation {
+			history = append(history[:i], history[i+1:]...)
+			break
+		}
+	}
+	if _, exists := storage.Load(key); !exists && len(history) > 0 && !history[len(history)-1].DeleteMarker {
+		storage.underlying.Store(key, history[len(history)-1])
+		history = history[:len(history)-1]
+	}
+	if len(history) == 0 {
+		delete(storage.history, key)
+	} else {
+		storage.history[key] = history
+	}
+}
+
 func (storage *Storage) Range(callback func(key string, value TimeStampedData) bool) {
 	storage.underlying.Range(func(iKey, iValue interface{}) bool {
 		return callback(iKey.(string), iValue.(TimeStampedData))
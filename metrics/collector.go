@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tinsane/storages/storage"
+)
+
+// Operations of the instrumented folder
+const (
+	ListFolderOperation    = "ListFolder"
+	ReadObjectOperation    = "ReadObject"
+	PutObjectOperation     = "PutObject"
+	DeleteObjectsOperation = "DeleteObjects"
+	ExistsOperation        = "Exists"
+	StatObjectOperation    = "StatObject"
+
+	ListObjectVersionsOperation   = "ListObjectVersions"
+	DeleteObjectVersionsOperation = "DeleteObjectVersions"
+	SetStorageClassOperation      = "SetStorageClass"
+	GetObjectLockOperation        = "GetObjectLock"
+	RestoreObjectOperation        = "RestoreObject"
+	GetRestoreStatusOperation     = "GetRestoreStatus"
+)
+
+// Directions of transferred bytes
+const (
+	UploadDirection   = "upload"
+	DownloadDirection = "download"
+)
+
+// Error classes, successful operations have empty class
+const (
+	NotFoundErrorClass           = "not_found"
+	PreconditionFailedErrorClass = "precondition_failed"
+	ArchivedErrorClass           = "archived"
+	UnsupportedErrorClass        = "unsupported"
+	DeleteFailedErrorClass       = "delete_failed"
+	OtherErrorClass              = "other"
+)
+
+// Collector receives metrics of folder operations. Backend is the storage name passed to storage.NewError,
+// e.g. S3, GCS, Azure, Swift or FS
+type Collector interface {
+	// ObserveOperation is called once for every operation, errorClass is empty if the operation succeeded
+	ObserveOperation(backend, operation, errorClass string, duration time.Duration)
+	AddTransferredBytes(backend, direction string, bytes int64)
+}
+
+// ErrorClass returns the class of the storage error, errors wrapped by errors.Wrap are classified by their cause
+func ErrorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	switch errors.Cause(err).(type) {
+	case storage.ObjectNotFoundError:
+		return NotFoundErrorClass
+	case storage.PreconditionFailedError:
+		return PreconditionFailedErrorClass
+	case storage.ObjectArchivedError:
+		return ArchivedErrorClass
+	case storage.UnsupportedOperationError:
+		return UnsupportedErrorClass
+	case storage.DeleteObjectsError:
+		return DeleteFailedErrorClass
+	}
+	return OtherErrorClass
+}
+
+type operationKey struct {
+	backend   string
+	operation string
+}
+
+type errorKey struct {
+	operationKey
+	errorClass string
+}
+
+type bytesKey struct {
+	backend   string
+	direction string
+}
+
+// MemoryCollector keeps all observations in memory, it is supposed to be used for tests
+type MemoryCollector struct {
+	mutex     sync.Mutex
+	durations map[operationKey][]time.Duration
+	errors    map[errorKey]int
+	bytes     map[bytesKey]int64
+}
+
+func NewMemoryCollector() *MemoryCollector {
+	return &MemoryCollector{
+		durations: make(map[operationKey][]time.Duration),
+		errors:    make(map[errorKey]int),
+		bytes:     make(map[bytesKey]int64),
+	}
+}
+
+func (collector *MemoryCollector) ObserveOperation(backend, operation, errorClass string, duration time.Duration) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	key := operationKey{backend, operation}
+	collector.durations[key] = append(collector.durations[key], duration)
+	if errorClass != "" {
+		collector.errors[errorKey{key, errorClass}]++
+	}
+}
+
+func (collector *MemoryCollector) AddTransferredBytes(backend, direction string, bytes int64) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.bytes[bytesKey{backend, direction}] += bytes
+}
+
+func (collector *MemoryCollector) OperationCount(backend, operation string) int {
+	return len(collector.Durations(backend, operation))
+}
+
+func (collector *MemoryCollector) Durations(backend, operation string) []time.Duration {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	return append([]time.Duration(nil), collector.durations[operationKey{backend, operation}]...)
+}
+
+func (collector *MemoryCollector) ErrorCount(backend, operation, errorClass string) int {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	return collector.errors[errorKey{operationKey{backend, operation}, errorClass}]
+}
+
+func (collector *MemoryCollector) TransferredBytes(backend, direction string) int64 {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	return collector.bytes[bytesKey{backend, direction}]
+}
@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tinsane/storages/storage"
+)
+
+// Folder reports operations of the underlying folder to the collector. Subfolders report to the same collector
+type Folder struct {
+	underlying storage.Folder
+	backend    string
+	collector  Collector
+}
+
+func NewFolder(underlying storage.Folder, backend string, collector Collector) *Folder {
+	return &Folder{underlying, backend, collector}
+}
+
+func (folder *Folder) observe(operation string, start time.Time, err error) {
+	folder.collector.ObserveOperation(folder.backend, operation, ErrorClass(err), time.Since(start))
+}
+
+func (folder *Folder) GetPath() string {
+	return folder.underlying.GetPath()
+}
+
+func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []storage.Folder, err error) {
+	start := time.Now()
+	objects, underlyingSubFolders, err := folder.underlying.ListFolder()
+	folder.observe(ListFolderOperation, start, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, subFolder := range underlyingSubFolders {
+		subFolders = append(subFolders, NewFolder(subFolder, folder.backend, folder.collector))
+	}
+	return objects, subFolders, nil
+}
+
+func (folder *Folder) DeleteObjects(objectRelativePaths []string) error {
+	start := time.Now()
+	err := folder.underlying.DeleteObjects(objectRelativePaths)
+	folder.observe(DeleteObjectsOperation, start, err)
+	return err
+}
+
+func (folder *Folder) Exists(objectRelativePath string) (bool, error) {
+	start := time.Now()
+	exists, err := folder.underlying.Exists(objectRelativePath)
+	folder.observe(ExistsOperation, start, err)
+	return exists, err
+}
+
+func (folder *Folder) GetSubFolder(subFolderRelativePath string) storage.Folder {
+	return NewFolder(folder.underlying.GetSubFolder(subFolderRelativePath), folder.backend, folder.collector)
+}
+
+// ReadObject observes the latency of opening the object, downloaded bytes are reported when the reader is closed
+// or the content ends
+func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, error) {
+	start := time.Now()
+	reader, err := folder.underlying.ReadObject(objectRelativePath)
+	folder.observe(ReadObjectOperation, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{reader: reader, closer: reader, report: folder.reportBytes(DownloadDirection)}, nil
+}
+
+func (folder *Folder) PutObject(name string, content io.Reader) error {
+	return folder.put(content, func(reader io.Reader) error {
+		return folder.underlying.PutObject(name, reader)
+	})
+}
+
+func (folder *Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	return folder.put(content, func(reader io.Reader) error {
+		return storage.PutObjectWithOptions(folder.underlying, name, reader, options)
+	})
+}
+
+// PutObjectWithCondition is observed as PutObject, writes which lost the race have precondition_failed error class
+func (folder *Folder) PutObjectWithCondition(name string, content io.Reader,
+	condition storage.PutCondition) (version string, err error) {
+	err = folder.put(content, func(reader io.Reader) (err error) {
+		version, err = storage.PutObjectWithCondition(folder.underlying, name, reader, condition)
+		return err
+	})
+	return version, err
+}
+
+// PutObjectWithStorageClass is observed as PutObject
+func (folder *Folder) PutObjectWithStorageClass(name string, content io.Reader, storageClass string) error {
+	return folder.put(content, func(reader io.Reader) error {
+		return storage.PutObjectWithStorageClass(folder.underlying, name, reader, storageClass)
+	})
+}
+
+// PutObjectWithProgress is observed as PutObject
+func (folder *Folder) PutObjectWithProgress(name string, content io.Reader, tracker *storage.ProgressTracker) error {
+	return folder.put(content, func(reader io.Reader) error {
+		return storage.PutObjectWithTracker(folder.underlying, name, reader, tracker)
+	})
+}
+
+func (folder *Folder) put(content io.Reader, write func(reader io.Reader) error) error {
+	start := time.Now()
+	reader := &countingReader{reader: content, report: folder.reportBytes(UploadDirection)}
+	err := write(reader)
+	folder.observe(PutObjectOperation, start, err)
+	if err == nil {
+		reader.flush()
+	}
+	return err
+}
+
+func (folder *Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	start := time.Now()
+	attributes, err := storage.StatObject(folder.underlying, objectRelativePath)
+	folder.observe(StatObjectOperation, start, err)
+	return attributes, err
+}
+
+func (folder *Folder) SetStorageClass(objectRelativePath, storageClass string) error {
+	start := time.Now()
+	err := storage.SetStorageClass(folder.underlying, objectRelativePath, storageClass)
+	folder.observe(SetStorageClassOperation, start, err)
+	return err
+}
+
+func (folder *Folder) ListObjectVersions(objectRelativePath string) ([]storage.ObjectVersion, error) {
+	start := time.Now()
+	versions, err := storage.ListObjectVersions(folder.underlying, objectRelativePath)
+	folder.observe(ListObjectVersionsOperation, start, err)
+	return versions, err
+}
+
+// ReadObjectVersion is observed as ReadObject
+func (folder *Folder) ReadObjectVersion(objectRelativePath, versionID string) (io.ReadCloser, error) {
+	start := time.Now()
+	reader, err := storage.ReadObjectVersion(folder.underlying, objectRelativePath, versionID)
+	folder.observe(ReadObjectOperation, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{reader: reader, closer: reader, report: folder.reportBytes(DownloadDirection)}, nil
+}
+
+func (folder *Folder) DeleteObjectVersions(versions []storage.ObjectVersion) error {
+	start := time.Now()
+	err := storage.DeleteObjectVersions(folder.underlying, versions)
+	folder.observe(DeleteObjectVersionsOperation, start, err)
+	return err
+}
+
+// ObjectLockEnabled is not observed, because it is the configuration of the folder
+func (folder *Folder) ObjectLockEnabled() bool {
+	return storage.ObjectLockEnabled(folder.underlying)
+}
+
+func (folder *Folder) GetObjectLock(objectRelativePath string) (storage.ObjectLock, error) {
+	start := time.Now()
+	lock, err := storage.GetObjectLock(folder.underlying, objectRelativePath)
+	folder.observe(GetObjectLockOperation, start, err)
+	return lock, err
+}
+
+func (folder *Folder) RestoreObject(objectRelativePath string, days int64, tier string) error {
+	start := time.Now()
+	err := storage.RestoreObject(folder.underlying, objectRelativePath, days, tier)
+	folder.observe(RestoreObjectOperation, start, err)
+	return err
+}
+
+func (folder *Folder) GetRestoreStatus(objectRelativePath string) (storage.RestoreStatus, error) {
+	start := time.Now()
+	status, err := storage.GetRestoreStatus(folder.underlying, objectRelativePath)
+	folder.observe(GetRestoreStatusOperation, start, err)
+	return status, err
+}
+
+// SignedURL is not observed, because URLs are signed locally
+func (folder *Folder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	return storage.SignedURL(folder.underlying, objectRelativePath, method, expiry)
+}
+
+// NewLock returns the native lock of the underlying folder, operations of the lock are not observed
+func (folder *Folder) NewLock(name, owner string, ttl time.Duration) (storage.Lock, error) {
+	return storage.NewNativeLock(folder.underlying, name, owner, ttl)
+}
+
+func (folder *Folder) reportBytes(direction string) func(bytes int64) {
+	return func(bytes int64) {
+		folder.collector.AddTransferredBytes(folder.backend, direction, bytes)
+	}
+}
+
+// countingReader reports bytes in batches instead of every read, so collectors are not called for every small buffer
+type countingReader struct {
+	reader     io.Reader
+	closer     io.Closer
+	report     func(bytes int64)
+	mutex      sync.Mutex
+	unreported int64
+}
+
+func (reader *countingReader) Read(p []byte) (n int, err error) {
+	n, err = reader.reader.Read(p)
+	reader.mutex.Lock()
+	reader.unreported += int64(n)
+	reader.mutex.Unlock()
+	if err == io.EOF {
+		reader.flush()
+	}
+	return
+}
+
+func (reader *countingReader) flush() {
+	reader.mutex.Lock()
+	bytes := reader.unreported
+	reader.unreported = 0
+	reader.mutex.Unlock()
+	if bytes > 0 {
+		reader.report(bytes)
+	}
+}
+
+func (reader *countingReader) Close() error {
+	reader.flush()
+	if reader.closer == nil {
+		return nil
+	}
+	return reader.closer.Close()
+}
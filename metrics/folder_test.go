@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/memory"
+	"github.com/tinsane/storages/storage"
+)
+
+func TestInstrumentedFolderCollectsMetrics(t *testing.T) {
+	collector := NewMemoryCollector()
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewStorage()), "Memory", collector)
+	subFolder := folder.GetSubFolder("sub/")
+	content := bytes.Repeat([]byte{1}, 1000)
+
+	assert.NoError(t, subFolder.PutObject("object", bytes.NewReader(content)))
+	reader, err := subFolder.ReadObject("object")
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	_, err = folder.ReadObject("missing")
+	assert.Error(t, err)
+	_, err = folder.Exists("object")
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, collector.OperationCount("Memory", PutObjectOperation))
+	assert.Equal(t, 2, collector.OperationCount("Memory", ReadObjectOperation))
+	assert.Equal(t, 1, collector.OperationCount("Memory", ExistsOperation))
+	assert.Equal(t, 1, collector.ErrorCount("Memory", ReadObjectOperation, NotFoundErrorClass))
+	assert.Equal(t, 0, collector.ErrorCount("Memory", PutObjectOperation, OtherErrorClass))
+	assert.Equal(t, int64(len(content)), collector.TransferredBytes("Memory", UploadDirection))
+	assert.Equal(t, int64(len(content)), collector.TransferredBytes("Memory", DownloadDirection))
+}
+
+func TestInstrumentedFolderCollectsMetricsOfOptionalOperations(t *testing.T) {
+	collector := NewMemoryCollector()
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewStorage()), "Memory", collector)
+
+	assert.NoError(t, storage.PutObjectWithOptions(folder, "object", bytes.NewReader([]byte("data")),
+		storage.PutOptions{ContentType: "text/plain"}))
+	_, err := storage.PutObjectWithCondition(folder, "object", bytes.NewReader(nil), storage.PutCondition{IfNoneMatch: true})
+	assert.IsType(t, storage.PreconditionFailedError{}, err)
+	attributes, err := storage.StatObject(folder, "object")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", attributes.ContentType)
+
+	assert.Equal(t, 2, collector.OperationCount("Memory", PutObjectOperation))
+	assert.Equal(t, 1, collector.ErrorCount("Memory", PutObjectOperation, PreconditionFailedErrorClass))
+	assert.Equal(t, 1, collector.OperationCount("Memory", StatObjectOperation))
+	assert.Equal(t, int64(4), collector.TransferredBytes("Memory", UploadDirection))
+}
+
+func TestInstrumentedFolderCollectsMetricsOfVersions(t *testing.T) {
+	collector := NewMemoryCollector()
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewVersionedStorage()), "Memory", collector)
+
+	assert.NoError(t, storage.PutObjectWithProgress(folder, "object", bytes.NewReader([]byte("first")), 5,
+		storage.ProgressOptions{}))
+	assert.NoError(t, folder.PutObject("object", bytes.NewReader([]byte("second"))))
+	versions, err := storage.ListObjectVersions(folder, "object")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	reader, err := storage.ReadObjectVersion(folder, "object", versions[1].VersionID)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+	assert.NoError(t, storage.DeleteObjectVersions(folder, versions[:1]))
+	err = storage.SetStorageClass(folder, "object", "COLD")
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+
+	assert.Equal(t, 2, collector.OperationCount("Memory", PutObjectOperation))
+	assert.Equal(t, 1, collector.OperationCount("Memory", ListObjectVersionsOperation))
+	assert.Equal(t, 1, collector.OperationCount("Memory", ReadObjectOperation))
+	assert.Equal(t, 1, collector.OperationCount("Memory", DeleteObjectVersionsOperation))
+	assert.Equal(t, 1, collector.OperationCount("Memory", SetStorageClassOperation))
+	assert.Equal(t, int64(11), collector.TransferredBytes("Memory", UploadDirection))
+	assert.Equal(t, int64(5), collector.TransferredBytes("Memory", DownloadDirection))
+}
+
+func TestErrorClass(t *testing.T) {
+	assert.Equal(t, "", ErrorClass(nil))
+	assert.Equal(t, NotFoundErrorClass, ErrorClass(errors.Wrap(storage.NewObjectNotFoundError("path"), "failed")))
+	assert.Equal(t, PreconditionFailedErrorClass, ErrorClass(storage.NewPreconditionFailedError("path")))
+	assert.Equal(t, DeleteFailedErrorClass, ErrorClass(storage.NewDeleteObjectsError("S3", nil)))
+	assert.Equal(t, OtherErrorClass, ErrorClass(errors.New("connection reset")))
+}
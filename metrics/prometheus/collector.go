@@ -0,0 +1,70 @@
+package prometheus
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tinsane/storages/metrics"
+)
+
+const subsystem = "storage"
+
+var _ metrics.Collector = (*Collector)(nil)
+
+// Collector exports metrics of instrumented folders to Prometheus
+type Collector struct {
+	operations *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	durations  *prometheus.HistogramVec
+	bytes      *prometheus.CounterVec
+}
+
+// NewCollector registers metrics in the registerer, e.g. prometheus.DefaultRegisterer
+func NewCollector(namespace string, registerer prometheus.Registerer) (*Collector, error) {
+	collector := &Collector{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "operations_total",
+			Help:      "Number of storage operations.",
+		}, []string{"backend", "operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "errors_total",
+			Help:      "Number of failed storage operations by error class.",
+		}, []string{"backend", "operation", "class"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of storage operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, []string{"backend", "operation"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "transferred_bytes_total",
+			Help:      "Number of bytes uploaded to or downloaded from the storage.",
+		}, []string{"backend", "direction"}),
+	}
+	for _, metric := range []prometheus.Collector{collector.operations, collector.errors, collector.durations, collector.bytes} {
+		if err := registerer.Register(metric); err != nil {
+			return nil, errors.Wrap(err, "failed to register storage metrics")
+		}
+	}
+	return collector, nil
+}
+
+func (collector *Collector) ObserveOperation(backend, operation, errorClass string, duration time.Duration) {
+	collector.operations.WithLabelValues(backend, operation).Inc()
+	collector.durations.WithLabelValues(backend, operation).Observe(duration.Seconds())
+	if errorClass != "" {
+		collector.errors.WithLabelValues(backend, operation, errorClass).Inc()
+	}
+}
+
+func (collector *Collector) AddTransferredBytes(backend, direction string, bytes int64) {
+	collector.bytes.WithLabelValues(backend, direction).Add(float64(bytes))
+}
@@ -0,0 +1,43 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/metrics"
+)
+
+func TestCollectorExportsMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	collector, err := NewCollector("test", registry)
+	assert.NoError(t, err)
+
+	collector.ObserveOperation("S3", metrics.PutObjectOperation, "", 10*time.Millisecond)
+	collector.ObserveOperation("S3", metrics.PutObjectOperation, metrics.OtherErrorClass, 30*time.Millisecond)
+	collector.AddTransferredBytes("S3", metrics.UploadDirection, 1000)
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			switch {
+			case metric.GetCounter() != nil:
+				values[family.GetName()] += metric.GetCounter().GetValue()
+			case metric.GetHistogram() != nil:
+				values[family.GetName()+"_count"] += float64(metric.GetHistogram().GetSampleCount())
+				values[family.GetName()+"_sum"] += metric.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	assert.Equal(t, 2.0, values["test_storage_operations_total"])
+	assert.Equal(t, 1.0, values["test_storage_errors_total"])
+	assert.Equal(t, 1000.0, values["test_storage_transferred_bytes_total"])
+	assert.Equal(t, 2.0, values["test_storage_operation_duration_seconds_count"])
+	assert.InDelta(t, 0.04, values["test_storage_operation_duration_seconds_sum"], 1e-9)
+
+	_, err = NewCollector("test", registry)
+	assert.Error(t, err)
+}
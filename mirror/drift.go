@@ -0,0 +1,77 @@
+package mirror
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tinsane/tracelog"
+)
+
+// Drift is an object, which may differ on the replica from other replicas, because an operation failed on it
+type Drift struct {
+	// Replica is the index of the replica passed to NewFolder
+	Replica int
+	// ObjectRelativePath is relative to the folder created by NewFolder, so it is the same for all replicas
+	ObjectRelativePath string
+	Operation          string
+	Err                error
+}
+
+// driftLog is shared by the mirror folder and its subfolders
+type driftLog struct {
+	mutex  sync.Mutex
+	drifts []Drift
+}
+
+func (log *driftLog) add(drift Drift) {
+	tracelog.WarningLogger.Printf("Replica %d drifted on %s of %s: %v\n",
+		drift.Replica, drift.Operation, drift.ObjectRelativePath, drift.Err)
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.drifts = append(log.drifts, drift)
+}
+
+// has is true if the replica drifted on the object since drifts were taken last time
+func (log *driftLog) has(replica int, objectRelativePath string) bool {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	for _, drift := range log.drifts {
+		if drift.Replica == replica && drift.ObjectRelativePath == objectRelativePath {
+			return true
+		}
+	}
+	return false
+}
+
+func (log *driftLog) take() []Drift {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	drifts := log.drifts
+	log.drifts = nil
+	return drifts
+}
+
+// QuorumError is returned when the operation succeeded on fewer replicas than the write quorum.
+// The operation is not rolled back on replicas where it succeeded, failed replicas are reported as drifted
+type QuorumError struct {
+	error
+	Succeeded int
+	Required  int
+	// Errors has the error of every failed replica
+	Errors map[int]error
+}
+
+func NewQuorumError(operation string, succeeded, required int, replicaErrors map[int]error) QuorumError {
+	return QuorumError{
+		errors.Errorf("Mirror error : %s succeeded on %d replicas, %d required: %v",
+			operation, succeeded, required, replicaErrors),
+		succeeded,
+		required,
+		replicaErrors,
+	}
+}
+
+func (err QuorumError) Error() string {
+	return fmt.Sprintf(tracelog.GetErrorFormatter(), err.error)
+}
@@ -0,0 +1,512 @@
+package mirror
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tinsane/storages/storage"
+)
+
+// Operations reported by drifts
+const (
+	ReadObjectOperation    = "ReadObject"
+	PutObjectOperation     = "PutObject"
+	DeleteObjectsOperation = "DeleteObjects"
+
+	SetStorageClassOperation      = "SetStorageClass"
+	DeleteObjectVersionsOperation = "DeleteObjectVersions"
+)
+
+// copyChunkSize is the size of chunks of content, which are written to every replica in turn
+const copyChunkSize = 32 * 1024
+
+// lastModifiedPrecision covers storages, which round modification time up to seconds
+const lastModifiedPrecision = time.Second
+
+// errReplicaFinished stops writes to the replica, which returned from PutObject before the end of content
+var errReplicaFinished = errors.New("replica finished the upload")
+
+// Folder writes objects to all replicas and reads them from the first replica, which is able to read.
+// Writes succeed when they succeed on the write quorum of replicas, replicas where they failed are reported by Drifts.
+// Conditional writes, locks, versions, object locks, restore and signed URLs use the first replica,
+// because versions of replicas are not comparable
+type Folder struct {
+	replicas    []storage.Folder
+	writeQuorum int
+	// path is relative to the folder created by NewFolder, it is used to report drifts
+	path   string
+	drifts *driftLog
+}
+
+// NewFolder takes replicas in the order of preference for reads
+func NewFolder(replicas []storage.Folder, writeQuorum int) (*Folder, error) {
+	if len(replicas) == 0 {
+		return nil, errors.New("Mirror error : no replicas")
+	}
+	if writeQuorum < 1 || writeQuorum > len(replicas) {
+		return nil, errors.Errorf("Mirror error : write quorum %d is out of range 1..%d", writeQuorum, len(replicas))
+	}
+	return &Folder{replicas, writeQuorum, "", &driftLog{}}, nil
+}
+
+// Drifts returns objects, which may differ between replicas since the previous call, so they can be synced
+func (folder *Folder) Drifts() []Drift {
+	return folder.drifts.take()
+}
+
+func (folder *Folder) addDrift(replica int, objectRelativePath, operation string, err error) {
+	folder.drifts.add(Drift{replica, storage.JoinPath(folder.path, objectRelativePath), operation, err})
+}
+
+// GetPath returns the path of the first replica
+func (folder *Folder) GetPath() string {
+	return folder.replicas[0].GetPath()
+}
+
+func (folder *Folder) GetSubFolder(subFolderRelativePath string) storage.Folder {
+	subFolders := make([]storage.Folder, len(folder.replicas))
+	for i, replica := range folder.replicas {
+		subFolders[i] = replica.GetSubFolder(subFolderRelativePath)
+	}
+	path := storage.AddDelimiterToPath(storage.JoinPath(folder.path, subFolderRelativePath))
+	return &Folder{subFolders, folder.writeQuorum, path, folder.drifts}
+}
+
+// ListFolder lists the first replica, which is able to list
+func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []storage.Folder, err error) {
+	var firstErr error
+	for _, replica := range folder.replicas {
+		objects, replicaSubFolders, err := replica.ListFolder()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, subFolder := range replicaSubFolders {
+			relativePath := strings.TrimPrefix(subFolder.GetPath(), storage.AddDelimiterToPath(replica.GetPath()))
+			subFolders = append(subFolders, folder.GetSubFolder(relativePath))
+		}
+		return objects, subFolders, nil
+	}
+	return nil, nil, firstErr
+}
+
+// Exists asks the first replica, which is able to answer
+func (folder *Folder) Exists(objectRelativePath string) (bool, error) {
+	var firstErr error
+	for _, replica := range folder.replicas {
+		exists, err := replica.Exists(objectRelativePath)
+		if err == nil {
+			return exists, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return false, firstErr
+}
+
+// ReadObject reads the first replica, which has the object. If reading fails in the middle,
+// it continues from the same offset on the next replica. Replicas, which failed before, are reported as drifted
+func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, error) {
+	reader := &failoverReader{folder: folder, objectRelativePath: objectRelativePath}
+	if err := reader.open(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// PutObject streams the content to all replicas at once, so the slowest replica sets the pace of the upload
+func (folder *Folder) PutObject(name string, content io.Reader) error {
+	return folder.put(name, content, func(replica storage.Folder, reader io.Reader) error {
+		return replica.PutObject(name, reader)
+	})
+}
+
+// PutObjectWithOptions writes the object with the condition like PutObjectWithCondition.
+// Progress counts bytes of the content once, not bytes sent to every replica
+func (folder *Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	content = storage.TrackProgress(content, options.Progress)
+	options.Progress = nil
+	if options.Condition != nil {
+		copyOptions := options
+		copyOptions.Condition = nil
+		return folder.putConditionally(name, func() error {
+			return storage.PutObjectWithOptions(folder.replicas[0], name, content, options)
+		}, func(replica storage.Folder, reader io.Reader) error {
+			return storage.PutObjectWithOptions(replica, name, reader, copyOptions)
+		})
+	}
+	return folder.put(name, content, func(replica storage.Folder, reader io.Reader) error {
+		return storage.PutObjectWithOptions(replica, name, reader, options)
+	})
+}
+
+// PutObjectWithCondition checks the condition on the first replica and returns its version,
+// versions are returned by its StatObject. The object is copied to other replicas after it is written to the first one
+func (folder *Folder) PutObjectWithCondition(name string, content io.Reader,
+	condition storage.PutCondition) (version string, err error) {
+	err = folder.putConditionally(name, func() (err error) {
+		version, err = storage.PutObjectWithCondition(folder.replicas[0], name, content, condition)
+		return err
+	}, func(replica storage.Folder, reader io.Reader) error {
+		return replica.PutObject(name, reader)
+	})
+	return version, err
+}
+
+// putConditionally copies the object from the first replica, so it may copy a newer object written concurrently
+func (folder *Folder) putConditionally(name string, write func() error,
+	copyTo func(replica storage.Folder, reader io.Reader) error) error {
+	if err := write(); err != nil {
+		return err
+	}
+	replicaErrors := make([]error, len(folder.replicas))
+	var wg sync.WaitGroup
+	for i := 1; i < len(folder.replicas); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reader, err := folder.replicas[0].ReadObject(name)
+			if err != nil {
+				replicaErrors[i] = err
+				return
+			}
+			defer reader.Close()
+			replicaErrors[i] = copyTo(folder.replicas[i], reader)
+		}(i)
+	}
+	wg.Wait()
+	return folder.checkQuorum(PutObjectOperation, []string{name}, replicaErrors)
+}
+
+// put streams the content to all replicas at once, so the slowest replica sets the pace of the upload
+func (folder *Folder) put(name string, content io.Reader, write func(replica storage.Folder, reader io.Reader) error) error {
+	readers := make([]*io.PipeReader, len(folder.replicas))
+	writers := make([]*io.PipeWriter, len(folder.replicas))
+	for i := range folder.replicas {
+		readers[i], writers[i] = io.Pipe()
+	}
+	replicaErrors := make([]error, len(folder.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range folder.replicas {
+		wg.Add(1)
+		go func(i int, replica storage.Folder) {
+			defer wg.Done()
+			replicaErrors[i] = write(replica, readers[i])
+			if replicaErrors[i] != nil {
+				readers[i].CloseWithError(replicaErrors[i])
+			} else {
+				readers[i].CloseWithError(errReplicaFinished)
+			}
+		}(i, replica)
+	}
+	copyErr := fanOut(content, writers)
+	for _, writer := range writers {
+		if copyErr != nil {
+			writer.CloseWithError(copyErr)
+		} else {
+			writer.Close()
+		}
+	}
+	wg.Wait()
+	if copyErr != nil {
+		// Replicas may keep partial objects, they are reported for the sync
+		for i := range folder.replicas {
+			folder.addDrift(i, name, PutObjectOperation, copyErr)
+		}
+		return errors.Wrapf(copyErr, "failed to read content of object '%s'", name)
+	}
+	return folder.checkQuorum(PutObjectOperation, []string{name}, replicaErrors)
+}
+
+// StatObject asks the first replica, which is able to answer
+func (folder *Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	var firstErr error
+	for _, replica := range folder.replicas {
+		attributes, err := storage.StatObject(replica, objectRelativePath)
+		if err == nil {
+			return attributes, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return storage.ObjectAttributes{}, firstErr
+}
+
+func (folder *Folder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	return storage.SignedURL(folder.replicas[0], objectRelativePath, method, expiry)
+}
+
+// NewLock returns the native lock of the first replica, lock objects are written by PutObjectWithCondition
+func (folder *Folder) NewLock(name, owner string, ttl time.Duration) (storage.Lock, error) {
+	return storage.NewNativeLock(folder.replicas[0], name, owner, ttl)
+}
+
+// PutObjectWithStorageClass writes replicas without storage classes by PutObject, like PutOptions.StorageClass does
+func (folder *Folder) PutObjectWithStorageClass(name string, content io.Reader, storageClass string) error {
+	return folder.put(name, content, func(replica storage.Folder, reader io.Reader) error {
+		if _, ok := replica.(storage.StorageClassSetter); !ok {
+			return replica.PutObject(name, reader)
+		}
+		return storage.PutObjectWithStorageClass(replica, name, reader, storageClass)
+	})
+}
+
+// SetStorageClass moves the object on replicas with storage classes, other replicas are skipped
+func (folder *Folder) SetStorageClass(objectRelativePath, storageClass string) error {
+	replicaErrors := make([]error, len(folder.replicas))
+	supported := false
+	for i, replica := range folder.replicas {
+		if _, ok := replica.(storage.StorageClassSetter); ok {
+			supported = true
+			replicaErrors[i] = storage.SetStorageClass(replica, objectRelativePath, storageClass)
+		}
+	}
+	if !supported {
+		return storage.NewUnsupportedOperationError("Mirror without storage classes", "storage classes")
+	}
+	return folder.checkQuorum(SetStorageClassOperation, []string{objectRelativePath}, replicaErrors)
+}
+
+// PutObjectWithProgress counts bytes of the content once, not bytes sent to every replica
+func (folder *Folder) PutObjectWithProgress(name string, content io.Reader, tracker *storage.ProgressTracker) error {
+	return folder.PutObject(name, storage.NewProgressReader(content, tracker))
+}
+
+func (folder *Folder) ListObjectVersions(objectRelativePath string) ([]storage.ObjectVersion, error) {
+	return storage.ListObjectVersions(folder.replicas[0], objectRelativePath)
+}
+
+func (folder *Folder) ReadObjectVersion(objectRelativePath, versionID string) (io.ReadCloser, error) {
+	return storage.ReadObjectVersion(folder.replicas[0], objectRelativePath, versionID)
+}
+
+// DeleteObjectVersions deletes versions of the first replica, other replicas are reported as drifted,
+// because the current object of the first replica may change
+func (folder *Folder) DeleteObjectVersions(versions []storage.ObjectVersion) error {
+	err := storage.DeleteObjectVersions(folder.replicas[0], versions)
+	if _, unsupported := err.(storage.UnsupportedOperationError); unsupported {
+		return err
+	}
+	for _, version := range versions {
+		for i := 1; i < len(folder.replicas); i++ {
+			folder.addDrift(i, version.ObjectRelativePath, DeleteObjectVersionsOperation, err)
+		}
+	}
+	return err
+}
+
+func (folder *Folder) ObjectLockEnabled() bool {
+	return storage.ObjectLockEnabled(folder.replicas[0])
+}
+
+func (folder *Folder) GetObjectLock(objectRelativePath string) (storage.ObjectLock, error) {
+	return storage.GetObjectLock(folder.replicas[0], objectRelativePath)
+}
+
+func (folder *Folder) RestoreObject(objectRelativePath string, days int64, tier string) error {
+	return storage.RestoreObject(folder.replicas[0], objectRelativePath, days, tier)
+}
+
+func (folder *Folder) GetRestoreStatus(objectRelativePath string) (storage.RestoreStatus, error) {
+	return storage.GetRestoreStatus(folder.replicas[0], objectRelativePath)
+}
+
+// fanOut writes every chunk of content to every writer, writers which failed are skipped
+func fanOut(content io.Reader, writers []*io.PipeWriter) error {
+	alive := len(writers)
+	failed := make([]bool, len(writers))
+	buffer := make([]byte, copyChunkSize)
+	for alive > 0 {
+		n, err := content.Read(buffer)
+		for i, writer := range writers {
+			if n == 0 || failed[i] {
+				continue
+			}
+			if _, writeErr := writer.Write(buffer[:n]); writeErr != nil {
+				failed[i] = true
+				alive--
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// All replicas failed, their errors are returned by PutObject
+	return nil
+}
+
+// DeleteObjects deletes objects on all replicas at once
+func (folder *Folder) DeleteObjects(objectRelativePaths []string) error {
+	replicaErrors := make([]error, len(folder.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range folder.replicas {
+		wg.Add(1)
+		go func(i int, replica storage.Folder) {
+			defer wg.Done()
+			replicaErrors[i] = replica.DeleteObjects(objectRelativePaths)
+		}(i, replica)
+	}
+	wg.Wait()
+	return folder.checkQuorum(DeleteObjectsOperation, objectRelativePaths, replicaErrors)
+}
+
+// checkQuorum reports failed replicas as drifted and returns QuorumError if too few replicas succeeded
+func (folder *Folder) checkQuorum(operation string, objectRelativePaths []string, replicaErrors []error) error {
+	failed := make(map[int]error)
+	for i, err := range replicaErrors {
+		if err == nil {
+			continue
+		}
+		failed[i] = err
+		if deleteErr, ok := errors.Cause(err).(storage.DeleteObjectsError); ok {
+			// Other objects are deleted on the replica
+			for _, failure := range deleteErr.Failures {
+				folder.addDrift(i, failure.ObjectRelativePath, operation, failure.Err)
+			}
+			continue
+		}
+		for _, objectRelativePath := range objectRelativePaths {
+			folder.addDrift(i, objectRelativePath, operation, err)
+		}
+	}
+	succeeded := len(replicaErrors) - len(failed)
+	if succeeded < folder.writeQuorum {
+		return NewQuorumError(operation, succeeded, folder.writeQuorum, failed)
+	}
+	return nil
+}
+
+// failoverReader switches to the next replica when reading fails
+type failoverReader struct {
+	folder             *Folder
+	objectRelativePath string
+	replica            int
+	reader             io.ReadCloser
+	offset             int64
+	openedAt           time.Time
+	// attributes of the object on the replica, where reading started, nil if the replica can not stat objects
+	attributes *storage.ObjectAttributes
+}
+
+// open opens the object on the current replica or on the next ones, skipping content, which was read already.
+// Replicas, which failed, are reported as drifted only if another replica has the object
+func (reader *failoverReader) open() error {
+	var firstErr error
+	failed := make(map[int]error)
+	for ; reader.replica < len(reader.folder.replicas); reader.replica++ {
+		replicaReader, err := reader.openReplica()
+		if err == nil {
+			for replica, replicaErr := range failed {
+				reader.folder.addDrift(replica, reader.objectRelativePath, ReadObjectOperation, replicaErr)
+			}
+			reader.reader = replicaReader
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		failed[reader.replica] = err
+	}
+	return firstErr
+}
+
+// openReplica stats the object before reading, so the content is not older than the version.
+// Reading continues at the offset only on the replica, which did not drift on the object and has the object
+// of the same MD5. If MD5 is unknown on either replica, the object must have the same size and be written before
+// the reading started. Other versions are not compared, they differ between storages
+func (reader *failoverReader) openReplica() (io.ReadCloser, error) {
+	replica := reader.folder.replicas[reader.replica]
+	if reader.offset == 0 {
+		reader.openedAt = time.Now()
+		if attributes, err := storage.StatObject(replica, reader.objectRelativePath); err == nil {
+			reader.attributes = &attributes
+		} else {
+			reader.attributes = nil
+		}
+		return replica.ReadObject(reader.objectRelativePath)
+	}
+
+	if reader.attributes == nil {
+		return nil, errors.Errorf("Mirror error : can not continue reading object '%s' at offset %d, "+
+			"its version is unknown", reader.objectRelativePath, reader.offset)
+	}
+	if reader.folder.drifts.has(reader.replica, storage.JoinPath(reader.folder.path, reader.objectRelativePath)) {
+		return nil, errors.Errorf("Mirror error : replica %d drifted on object '%s'",
+			reader.replica, reader.objectRelativePath)
+	}
+	attributes, err := storage.StatObject(replica, reader.objectRelativePath)
+	if err != nil {
+		return nil, err
+	}
+	hash, ok := contentMD5(attributes)
+	expectedHash, expectedOk := contentMD5(*reader.attributes)
+	comparable := ok && expectedOk
+	if comparable && hash != expectedHash || attributes.Size != reader.attributes.Size ||
+		!comparable && attributes.LastModified.After(reader.openedAt.Add(lastModifiedPrecision)) {
+		return nil, errors.Errorf("Mirror error : replica %d has another version of object '%s'",
+			reader.replica, reader.objectRelativePath)
+	}
+	replicaReader, err := replica.ReadObject(reader.objectRelativePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.CopyN(ioutil.Discard, replicaReader, reader.offset); err != nil {
+		replicaReader.Close()
+		return nil, err
+	}
+	return replicaReader, nil
+}
+
+// contentMD5 returns the version if it is MD5 of the content, like ETags of S3 objects uploaded in one part
+// and hashes of Swift objects
+func contentMD5(attributes storage.ObjectAttributes) (hash string, ok bool) {
+	hash = strings.ToLower(strings.Trim(attributes.Version, `"`))
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != md5.Size {
+		return "", false
+	}
+	return hash, true
+}
+
+func (reader *failoverReader) Read(p []byte) (n int, err error) {
+	n, err = reader.reader.Read(p)
+	reader.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	reader.folder.addDrift(reader.replica, reader.objectRelativePath, ReadObjectOperation, err)
+	reader.reader.Close()
+	reader.replica++
+	if reader.open() != nil {
+		reader.reader = ioutil.NopCloser(&errorReader{err})
+		return n, err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return reader.Read(p)
+}
+
+func (reader *failoverReader) Close() error {
+	return reader.reader.Close()
+}
+
+type errorReader struct {
+	err error
+}
+
+func (reader *errorReader) Read(p []byte) (n int, err error) {
+	return 0, reader.err
+}
@@ -0,0 +1,263 @@
+package mirror
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/memory"
+	"github.com/tinsane/storages/storage"
+)
+
+// brokenFolder fails writes and breaks reads after the first bytes
+type brokenFolder struct {
+	storage.Folder
+}
+
+func (folder *brokenFolder) GetSubFolder(subFolderRelativePath string) storage.Folder {
+	return &brokenFolder{folder.Folder.GetSubFolder(subFolderRelativePath)}
+}
+
+func (folder *brokenFolder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	return folder.PutObject(name, content)
+}
+
+func (folder *brokenFolder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	return storage.StatObject(folder.Folder, objectRelativePath)
+}
+
+func (folder *brokenFolder) PutObject(name string, content io.Reader) error {
+	// The replica fails in the middle of the upload
+	_, _ = io.CopyN(ioutil.Discard, content, 10)
+	return errors.New("connection reset")
+}
+
+func (folder *brokenFolder) ReadObject(objectRelativePath string) (io.ReadCloser, error) {
+	reader, err := folder.Folder.ReadObject(objectRelativePath)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(io.MultiReader(io.LimitReader(reader, 10), &errorReader{errors.New("connection reset")})), nil
+}
+
+func newReplica() storage.Folder {
+	return memory.NewFolder("in_memory/", memory.NewStorage())
+}
+
+func readAll(t *testing.T, folder storage.Folder, name string) []byte {
+	reader, err := folder.ReadObject(name)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	return content
+}
+
+func TestMirrorFolderWritesAllReplicas(t *testing.T) {
+	replicas := []storage.Folder{newReplica(), newReplica()}
+	folder, err := NewFolder(replicas, 2)
+	assert.NoError(t, err)
+	content := bytes.Repeat([]byte("mirror"), copyChunkSize)
+
+	subFolder := folder.GetSubFolder("sub/")
+	assert.NoError(t, subFolder.PutObject("object", bytes.NewReader(content)))
+	for _, replica := range replicas {
+		assert.Equal(t, content, readAll(t, replica, "sub/object"))
+	}
+	_, subFolders, err := folder.ListFolder()
+	assert.NoError(t, err)
+	assert.Len(t, subFolders, 1)
+	assert.Equal(t, content, readAll(t, subFolders[0], "object"))
+
+	assert.NoError(t, subFolder.DeleteObjects([]string{"object"}))
+	for _, replica := range replicas {
+		exists, err := replica.Exists("sub/object")
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	}
+	assert.Empty(t, folder.Drifts())
+}
+
+func TestMirrorFolderWriteQuorum(t *testing.T) {
+	replicas := []storage.Folder{&brokenFolder{newReplica()}, newReplica()}
+	_, err := NewFolder(replicas, 3)
+	assert.Error(t, err)
+
+	folder, err := NewFolder(replicas, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, folder.GetSubFolder("sub/").PutObject("object", strings.NewReader("content of the object")))
+	assert.Equal(t, "content of the object", string(readAll(t, replicas[1], "sub/object")))
+	drifts := folder.Drifts()
+	assert.Len(t, drifts, 1)
+	assert.Equal(t, 0, drifts[0].Replica)
+	assert.Equal(t, "sub/object", drifts[0].ObjectRelativePath)
+
+	folder, err = NewFolder(replicas, 2)
+	assert.NoError(t, err)
+	err = folder.PutObject("object", strings.NewReader("content of the object"))
+	assert.IsType(t, QuorumError{}, err)
+	assert.Equal(t, 1, err.(QuorumError).Succeeded)
+}
+
+func TestMirrorFolderReadFailover(t *testing.T) {
+	replicas := []storage.Folder{newReplica(), newReplica()}
+	assert.NoError(t, replicas[0].PutObject("broken", strings.NewReader("content of the object")))
+	assert.NoError(t, replicas[1].PutObject("broken", strings.NewReader("content of the object")))
+	assert.NoError(t, replicas[1].PutObject("missing", strings.NewReader("missing on the first replica")))
+	folder, err := NewFolder([]storage.Folder{&brokenFolder{replicas[0]}, replicas[1]}, 1)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "content of the object", string(readAll(t, folder, "broken")))
+	assert.Equal(t, "missing on the first replica", string(readAll(t, folder, "missing")))
+	drifts := folder.Drifts()
+	assert.Len(t, drifts, 2)
+	for _, drift := range drifts {
+		assert.Equal(t, 0, drift.Replica)
+	}
+
+	_, err = folder.ReadObject("nowhere")
+	assert.IsType(t, storage.ObjectNotFoundError{}, errors.Cause(err))
+	assert.Empty(t, folder.Drifts())
+}
+
+func TestMirrorFolderReadFailoverChecksVersion(t *testing.T) {
+	replicas := []storage.Folder{newReplica(), newReplica()}
+	assert.NoError(t, replicas[0].PutObject("object", strings.NewReader("content of the object")))
+	assert.NoError(t, replicas[1].PutObject("object", strings.NewReader("stale content")))
+	folder, err := NewFolder([]storage.Folder{&brokenFolder{replicas[0]}, replicas[1]}, 1)
+	assert.NoError(t, err)
+
+	reader, err := folder.ReadObject("object")
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	assert.Error(t, err)
+	assert.Equal(t, "content of", string(content))
+	assert.NoError(t, reader.Close())
+}
+
+func TestMirrorFolderConditionalWrites(t *testing.T) {
+	replicas := []storage.Folder{newReplica(), newReplica()}
+	folder, err := NewFolder(replicas, 2)
+	assert.NoError(t, err)
+
+	condition := storage.PutCondition{IfNoneMatch: true}
+	version, err := storage.PutObjectWithCondition(folder, "object", strings.NewReader("first"), condition)
+	assert.NoError(t, err)
+	_, err = storage.PutObjectWithCondition(folder, "object", strings.NewReader("second"), condition)
+	assert.IsType(t, storage.PreconditionFailedError{}, err)
+	for _, replica := range replicas {
+		assert.Equal(t, "first", string(readAll(t, replica, "object")))
+	}
+
+	attributes, err := storage.StatObject(folder, "object")
+	assert.NoError(t, err)
+	assert.Equal(t, attributes.Version, version)
+	err = storage.PutObjectWithOptions(folder, "object", strings.NewReader("third"),
+		storage.PutOptions{ContentType: "text/plain", Condition: &storage.PutCondition{IfMatch: attributes.Version}})
+	assert.NoError(t, err)
+	for _, replica := range replicas {
+		assert.Equal(t, "third", string(readAll(t, replica, "object")))
+		replicaAttributes, err := storage.StatObject(replica, "object")
+		assert.NoError(t, err)
+		assert.Equal(t, "text/plain", replicaAttributes.ContentType)
+	}
+	assert.Empty(t, folder.Drifts())
+}
+
+// md5Folder returns MD5 of the content as the version, like S3 and Swift do
+type md5Folder struct {
+	storage.Folder
+}
+
+func (folder *md5Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	return storage.PutObjectWithOptions(folder.Folder, name, content, options)
+}
+
+func (folder *md5Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	attributes, err := storage.StatObject(folder.Folder, objectRelativePath)
+	if err != nil {
+		return attributes, err
+	}
+	content, err := ioutil.ReadAll(readerOf(folder.Folder, objectRelativePath))
+	if err != nil {
+		return attributes, err
+	}
+	attributes.Version = fmt.Sprintf(`"%x"`, md5.Sum(content))
+	return attributes, nil
+}
+
+func readerOf(folder storage.Folder, name string) io.Reader {
+	reader, err := folder.ReadObject(name)
+	if err != nil {
+		return &errorReader{err}
+	}
+	return reader
+}
+
+func TestMirrorFolderReadFailoverComparesMD5(t *testing.T) {
+	replicas := []storage.Folder{newReplica(), newReplica()}
+	assert.NoError(t, replicas[0].PutObject("object", strings.NewReader("content of the object")))
+	assert.NoError(t, replicas[1].PutObject("object", strings.NewReader("CONTENT OF THE OBJECT")))
+	assert.NoError(t, replicas[0].PutObject("same", strings.NewReader("content of the object")))
+	assert.NoError(t, replicas[1].PutObject("same", strings.NewReader("content of the object")))
+	folder, err := NewFolder([]storage.Folder{&brokenFolder{&md5Folder{replicas[0]}}, &md5Folder{replicas[1]}}, 1)
+	assert.NoError(t, err)
+
+	// The size and the modification time are the same, but the content is not
+	reader, err := folder.ReadObject("object")
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.Error(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, "content of the object", string(readAll(t, folder, "same")))
+}
+
+func TestMirrorFolderReadFailoverSkipsDriftedReplicas(t *testing.T) {
+	replicas := []storage.Folder{newReplica(), newReplica()}
+	assert.NoError(t, replicas[0].PutObject("sub/object", strings.NewReader("content of the object")))
+	assert.NoError(t, replicas[1].PutObject("sub/object", strings.NewReader("content of the object")))
+	folder, err := NewFolder([]storage.Folder{&brokenFolder{replicas[0]}, replicas[1]}, 1)
+	assert.NoError(t, err)
+	folder.addDrift(1, "sub/object", PutObjectOperation, errors.New("connection reset"))
+
+	reader, err := folder.GetSubFolder("sub/").ReadObject("object")
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.Error(t, err)
+	assert.NoError(t, reader.Close())
+}
+
+func TestMirrorFolderForwardsOptionalInterfaces(t *testing.T) {
+	replicas := []storage.Folder{memory.NewFolder("in_memory/", memory.NewVersionedStorage()), newReplica()}
+	folder, err := NewFolder(replicas, 2)
+	assert.NoError(t, err)
+
+	assert.NoError(t, storage.PutObjectWithProgress(folder, "object", strings.NewReader("first"), 5,
+		storage.ProgressOptions{}))
+	assert.NoError(t, storage.PutObjectWithStorageClass(folder, "object", strings.NewReader("second"), "COLD"))
+	for _, replica := range replicas {
+		assert.Equal(t, "second", string(readAll(t, replica, "object")))
+	}
+	err = storage.SetStorageClass(folder, "object", "COLD")
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+
+	versions, err := storage.ListObjectVersions(folder, "object")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.NoError(t, storage.DeleteObjectVersions(folder, versions[:1]))
+	assert.Equal(t, "first", string(readAll(t, replicas[0], "object")))
+	drifts := folder.Drifts()
+	assert.Len(t, drifts, 1)
+	assert.Equal(t, 1, drifts[0].Replica)
+	assert.Equal(t, DeleteObjectVersionsOperation, drifts[0].Operation)
+
+	assert.False(t, storage.ObjectLockEnabled(folder))
+	_, err = storage.GetRestoreStatus(folder, "object")
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+}
@@ -1,19 +1,38 @@
 package s3
 
 import (
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/pkg/errors"
 	"github.com/tinsane/storages/storage"
+	"github.com/tinsane/tracelog"
 	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	NotFoundAWSErrorCode  = "NotFound"
-	NoSuchKeyAWSErrorCode = "NoSuchKey"
+	NotFoundAWSErrorCode       = "NotFound"
+	NoSuchKeyAWSErrorCode      = "NoSuchKey"
+	NotImplementedAWSErrorCode = "NotImplemented"
+	// Returned for buckets without Object Lock
+	ObjectLockConfigurationNotFoundAWSErrorCode = "ObjectLockConfigurationNotFoundError"
+	// Reading archived objects fails with InvalidObjectState until they are restored
+	InvalidObjectStateAWSErrorCode       = "InvalidObjectState"
+	RestoreAlreadyInProgressAWSErrorCode = "RestoreAlreadyInProgress"
+	// Conditional writes fail with these codes if the object was created or changed concurrently
+	PreconditionFailedAWSErrorCode         = "PreconditionFailed"
+	ConditionalRequestConflictAWSErrorCode = "ConditionalRequestConflict"
 
 	EndpointSetting          = "AWS_ENDPOINT"
 	RegionSetting            = "AWS_REGION"
@@ -29,6 +48,31 @@ const (
 	UploadConcurrencySetting = "UPLOAD_CONCURRENCY"
 	s3CertFile               = "S3_CA_CERT_FILE"
 	MaxPartSize              = "S3_MAX_PART_SIZE"
+	// Continue unfinished multipart upload of the same key instead of starting from scratch
+	ResumeMultipartUploadsSetting = "S3_RESUME_MULTIPART_UPLOADS"
+	// Only uploads of the same owner are resumed, hostname is the owner by default
+	MultipartUploadOwnerSetting = "S3_MULTIPART_UPLOAD_OWNER"
+	// Large objects are downloaded by concurrent range requests if concurrency is greater than 1
+	DownloadConcurrencySetting = "S3_DOWNLOAD_CONCURRENCY"
+	DownloadChunkSizeSetting   = "S3_DOWNLOAD_CHUNK_SIZE"
+	DownloadMemoryLimitSetting = "S3_DOWNLOAD_MEMORY_LIMIT"
+	// Credentials are taken from the shared config profile unless access key is set
+	ProfileSetting = "AWS_PROFILE"
+	// Role is assumed with credentials configured by other settings or with web identity token from the file
+	RoleArnSetting              = "AWS_ROLE_ARN"
+	RoleSessionNameSetting      = "AWS_ROLE_SESSION_NAME"
+	WebIdentityTokenFileSetting = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	// Server side encryption with customer-provided key: base64 encoded key or file with raw key
+	SseCustomerKeySetting       = "S3_SSE_C_KEY"
+	SseCustomerKeyFileSetting   = "S3_SSE_C_KEY_FILE"
+	SseCustomerAlgorithmSetting = "S3_SSE_C_ALGORITHM"
+	// Uploaded objects are locked for retention duration in GOVERNANCE or COMPLIANCE mode, bucket must have Object Lock enabled
+	ObjectLockModeSetting      = "S3_OBJECT_LOCK_MODE"
+	ObjectLockRetentionSetting = "S3_OBJECT_LOCK_RETENTION"
+	ObjectLockLegalHoldSetting = "S3_OBJECT_LOCK_LEGAL_HOLD"
+	// Listing compatibility for S3-like storages: "1" forces ListObjects V1, V2 falls back to V1 if it is not implemented
+	ListObjectsVersionSetting = "S3_LIST_OBJECTS_VERSION"
+	ListURLEncodedKeysSetting = "S3_LIST_URL_ENCODED_KEYS"
 )
 
 var (
@@ -43,13 +87,36 @@ var (
 		SecretAccessKeySetting,
 		SecretKeySetting,
 		SessionTokenSetting,
+		ProfileSetting,
+		RoleArnSetting,
+		RoleSessionNameSetting,
+		WebIdentityTokenFileSetting,
 		SseSetting,
 		SseKmsIdSetting,
 		StorageClassSetting,
 		UploadConcurrencySetting,
 		s3CertFile,
 		MaxPartSize,
+		ResumeMultipartUploadsSetting,
+		MultipartUploadOwnerSetting,
+		DownloadConcurrencySetting,
+		DownloadChunkSizeSetting,
+		DownloadMemoryLimitSetting,
+		SseCustomerKeySetting,
+		SseCustomerKeyFileSetting,
+		SseCustomerAlgorithmSetting,
+		ObjectLockModeSetting,
+		ObjectLockRetentionSetting,
+		ObjectLockLegalHoldSetting,
+		ListObjectsVersionSetting,
+		ListURLEncodedKeysSetting,
 	}
+	// DeleteRetries limit retries of keys which batch DeleteObjects failed to delete with retryable errors
+	DeleteRetries = 3
+	// DeleteRetryDelay is doubled on every retry of failed keys
+	DeleteRetryDelay = 100 * time.Millisecond
+
+	restoreHeaderFieldRegexp = regexp.MustCompile(`([a-z-]+)="([^"]*)"`)
 )
 
 func getFirstSettingOf(settings map[string]string, keys []string) string {
@@ -71,18 +138,94 @@ func NewConfiguringError(settingName string) storage.Error {
 }
 
 type Folder struct {
-	uploader Uploader
-	S3API    s3iface.S3API
-	Bucket   *string
-	Path     string
+	uploader            Uploader
+	S3API               s3iface.S3API
+	Bucket              *string
+	Path                string
+	parallelReadOptions storage.ParallelReadOptions
+	listingOptions      *ListingOptions
+	bucketObjectLock    *bucketObjectLock
+}
+
+// bucketObjectLock caches whether Object Lock is enabled on the bucket, it is shared by the folder and all its subfolders
+type bucketObjectLock struct {
+	once    sync.Once
+	enabled bool
+}
+
+// ListingOptions are shared by the folder and all its subfolders
+type ListingOptions struct {
+	UseListObjectsV1 bool
+	// URLEncodeKeys asks storage to encode keys in listings, so keys with control characters can be listed
+	URLEncodeKeys bool
+	// listObjectsV2NotImplemented is set once storage responded that V2 is not supported
+	listObjectsV2NotImplemented int32
+}
+
+func (options *ListingOptions) useListObjectsV1() bool {
+	return options.UseListObjectsV1 || atomic.LoadInt32(&options.listObjectsV2NotImplemented) == 1
+}
+
+func (options *ListingOptions) encodingType() *string {
+	if options.URLEncodeKeys {
+		return aws.String(s3.EncodingTypeUrl)
+	}
+	return nil
+}
+
+func (options *ListingOptions) decodeKey(key *string) (string, error) {
+	if !options.URLEncodeKeys {
+		return aws.StringValue(key), nil
+	}
+	decodedKey, err := url.QueryUnescape(aws.StringValue(key))
+	return decodedKey, errors.Wrapf(err, "failed to decode listed key '%s'", aws.StringValue(key))
+}
+
+func configureListingOptions(settings map[string]string) (*ListingOptions, error) {
+	options := &ListingOptions{}
+	if version, ok := settings[ListObjectsVersionSetting]; ok {
+		switch version {
+		case "1":
+			options.UseListObjectsV1 = true
+		case "2":
+		default:
+			return nil, NewFolderError(errors.New("Configuring error"),
+				"%s must be 1 or 2, got '%s'", ListObjectsVersionSetting, version)
+		}
+	}
+	if encodeKeys, ok := settings[ListURLEncodedKeysSetting]; ok {
+		var err error
+		options.URLEncodeKeys, err = strconv.ParseBool(encodeKeys)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", ListURLEncodedKeysSetting)
+		}
+	}
+	return options, nil
+}
+
+// FolderOptions are optional settings of the folder, zero value uses defaults
+type FolderOptions struct {
+	ParallelRead storage.ParallelReadOptions
+	// Listing is shared by the folder and all its subfolders, nil means ListObjectsV2 without key encoding
+	Listing *ListingOptions
 }
 
 func NewFolder(uploader Uploader, s3API s3iface.S3API, bucket, path string) *Folder {
+	return NewFolderWithOptions(uploader, s3API, bucket, path, FolderOptions{})
+}
+
+func NewFolderWithOptions(uploader Uploader, s3API s3iface.S3API, bucket, path string, options FolderOptions) *Folder {
+	if options.Listing == nil {
+		options.Listing = &ListingOptions{}
+	}
 	return &Folder{
 		uploader,
 		s3API,
 		aws.String(bucket),
 		storage.AddDelimiterToPath(path),
+		options.ParallelRead,
+		options.Listing,
+		&bucketObjectLock{},
 	}
 }
 
@@ -100,16 +243,22 @@ func ConfigureFolder(prefix string, settings map[string]string) (storage.Folder,
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to configure S3 uploader")
 	}
-	folder := NewFolder(*uploader, client, bucket, path)
+	parallelReadOptions, err := storage.ConfigureParallelReadOptions(settings,
+		DownloadConcurrencySetting, DownloadChunkSizeSetting, DownloadMemoryLimitSetting)
+	if err != nil {
+		return nil, NewFolderError(err, "Invalid download settings")
+	}
+	listingOptions, err := configureListingOptions(settings)
+	if err != nil {
+		return nil, err
+	}
+	folder := NewFolderWithOptions(*uploader, client, bucket, path, FolderOptions{parallelReadOptions, listingOptions})
 	return folder, nil
 }
 
 func (folder *Folder) Exists(objectRelativePath string) (bool, error) {
 	objectPath := folder.Path + objectRelativePath
-	stopSentinelObjectInput := &s3.HeadObjectInput{
-		Bucket: folder.Bucket,
-		Key:    aws.String(objectPath),
-	}
+	stopSentinelObjectInput := folder.createHeadObjectInput(objectPath)
 
 	_, err := folder.S3API.HeadObject(stopSentinelObjectInput)
 	if err != nil {
@@ -122,28 +271,354 @@ func (folder *Folder) Exists(objectRelativePath string) (bool, error) {
 }
 
 func (folder *Folder) PutObject(name string, content io.Reader) error {
-	return folder.uploader.upload(*folder.Bucket, folder.Path+name, content)
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{})
+}
+
+// PutObjectWithProgress counts bytes of uploaded parts, so progress is not ahead of the upload by buffered parts
+func (folder *Folder) PutObjectWithProgress(name string, content io.Reader, tracker *storage.ProgressTracker) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{Progress: tracker})
+}
+
+// PutObjectWithStorageClass uploads the object to the given storage class instead of S3_STORAGE_CLASS
+func (folder *Folder) PutObjectWithStorageClass(name string, content io.Reader, storageClass string) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{StorageClass: storageClass})
 }
 
 func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, error) {
 	objectPath := folder.Path + objectRelativePath
+	if folder.parallelReadOptions.Enabled() {
+		return folder.readObjectInParallel(objectPath)
+	}
+	return folder.getObject(folder.createGetObjectInput(objectPath))
+}
+
+// createGetObjectInput adds customer-provided key, objects encrypted with it can not be read without the key
+func (folder *Folder) createGetObjectInput(objectPath string) *s3.GetObjectInput {
 	input := &s3.GetObjectInput{
 		Bucket: folder.Bucket,
 		Key:    aws.String(objectPath),
 	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = folder.uploader.sseCustomerKeyParams()
+	return input
+}
 
+func (folder *Folder) createHeadObjectInput(objectPath string) *s3.HeadObjectInput {
+	input := &s3.HeadObjectInput{
+		Bucket: folder.Bucket,
+		Key:    aws.String(objectPath),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = folder.uploader.sseCustomerKeyParams()
+	return input
+}
+
+func (folder *Folder) getObject(input *s3.GetObjectInput) (io.ReadCloser, error) {
+	objectPath := aws.StringValue(input.Key)
 	object, err := folder.S3API.GetObject(input)
 	if err != nil {
 		if isAwsNotExist(err) {
 			return nil, storage.NewObjectNotFoundError(objectPath)
 		}
+		if isAwsArchived(err) {
+			return nil, storage.NewObjectArchivedError(objectPath)
+		}
 		return nil, errors.Wrapf(err, "failed to read object: '%s' from S3", objectPath)
 	}
 	return object.Body, nil
 }
 
+// readObjectInParallel downloads objects bigger than one chunk by concurrent range requests.
+// Ranges are requested with the ETag of the object, so a concurrent overwrite fails the read instead of mixing versions
+func (folder *Folder) readObjectInParallel(objectPath string) (io.ReadCloser, error) {
+	head, err := folder.S3API.HeadObject(folder.createHeadObjectInput(objectPath))
+	if err != nil {
+		if isAwsNotExist(err) {
+			return nil, storage.NewObjectNotFoundError(objectPath)
+		}
+		return nil, errors.Wrapf(err, "failed to read object: '%s' from S3", objectPath)
+	}
+	size := aws.Int64Value(head.ContentLength)
+	if size <= folder.parallelReadOptions.ChunkSize {
+		input := folder.createGetObjectInput(objectPath)
+		input.IfMatch = head.ETag
+		return folder.getObject(input)
+	}
+	readRange := func(offset, length int64) (io.ReadCloser, error) {
+		input := folder.createGetObjectInput(objectPath)
+		input.IfMatch = head.ETag
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		return folder.getObject(input)
+	}
+	return storage.NewParallelReader(size, readRange, folder.parallelReadOptions), nil
+}
+
+// ObjectLockEnabled is true if uploaded objects are locked or Object Lock is enabled on the bucket,
+// so objects may be locked by other clients. Bucket configuration is requested once
+func (folder *Folder) ObjectLockEnabled() bool {
+	if folder.uploader.objectLockMode != "" || folder.uploader.objectLockLegalHold {
+		return true
+	}
+	folder.bucketObjectLock.once.Do(func() {
+		folder.bucketObjectLock.enabled = folder.isBucketObjectLockEnabled()
+	})
+	return folder.bucketObjectLock.enabled
+}
+
+func (folder *Folder) isBucketObjectLockEnabled() bool {
+	output, err := folder.S3API.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{Bucket: folder.Bucket})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == ObjectLockConfigurationNotFoundAWSErrorCode ||
+			awsErr.Code() == NotImplementedAWSErrorCode) {
+			return false
+		}
+		// Locks of objects are checked, if it is unknown whether they can be locked
+		tracelog.WarningLogger.Printf("failed to get Object Lock configuration of bucket '%s': %v\n",
+			aws.StringValue(folder.Bucket), err)
+		return true
+	}
+	return output.ObjectLockConfiguration != nil &&
+		aws.StringValue(output.ObjectLockConfiguration.ObjectLockEnabled) == s3.ObjectLockEnabledEnabled
+}
+
+func (folder *Folder) GetObjectLock(objectRelativePath string) (storage.ObjectLock, error) {
+	objectPath := folder.Path + objectRelativePath
+	head, err := folder.S3API.HeadObject(folder.createHeadObjectInput(objectPath))
+	if err != nil {
+		if isAwsNotExist(err) {
+			return storage.ObjectLock{}, storage.NewObjectNotFoundError(objectPath)
+		}
+		return storage.ObjectLock{}, errors.Wrapf(err, "failed to get lock of s3 object '%s'", objectPath)
+	}
+	return storage.ObjectLock{
+		Mode:        aws.StringValue(head.ObjectLockMode),
+		RetainUntil: aws.TimeValue(head.ObjectLockRetainUntilDate),
+		LegalHold:   aws.StringValue(head.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn,
+	}, nil
+}
+
+// PutObjectWithOptions uploads the object with HTTP headers and user metadata, which S3 returns on download.
+// Storage class, condition and progress tracking are applied to the same upload, so they can be combined
+func (folder *Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	_, err := folder.putObject(name, content, options)
+	return err
+}
+
+// putObject returns ETag of the uploaded object
+func (folder *Folder) putObject(name string, content io.Reader, options storage.PutOptions) (version string, err error) {
+	objectPath := folder.Path + name
+	input := folder.uploader.createUploadInput(*folder.Bucket, objectPath, content)
+	input.ContentType = optionalString(options.ContentType)
+	input.ContentEncoding = optionalString(options.ContentEncoding)
+	input.CacheControl = optionalString(options.CacheControl)
+	if len(options.Metadata) > 0 {
+		input.Metadata = aws.StringMap(options.Metadata)
+	}
+	if options.StorageClass != "" {
+		input.StorageClass = aws.String(options.StorageClass)
+	}
+	requestOptions := []request.Option{recordETag(&version)}
+	if options.Condition != nil {
+		requestOptions = append(requestOptions, conditionHeaders(*options.Condition))
+	}
+	err = folder.uploader.upload(input, options.Progress, requestOptions...)
+	if isAwsPreconditionFailed(errors.Cause(err)) {
+		return "", storage.NewPreconditionFailedError(objectPath)
+	}
+	if err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+func (folder *Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	objectPath := folder.Path + objectRelativePath
+	head, err := folder.S3API.HeadObject(folder.createHeadObjectInput(objectPath))
+	if err != nil {
+		if isAwsNotExist(err) {
+			return storage.ObjectAttributes{}, storage.NewObjectNotFoundError(objectPath)
+		}
+		return storage.ObjectAttributes{}, errors.Wrapf(err, "failed to stat s3 object '%s'", objectPath)
+	}
+	return storage.ObjectAttributes{
+		PutOptions: storage.PutOptions{
+			ContentType:     aws.StringValue(head.ContentType),
+			ContentEncoding: aws.StringValue(head.ContentEncoding),
+			CacheControl:    aws.StringValue(head.CacheControl),
+			Metadata:        aws.StringValueMap(head.Metadata),
+		},
+		Size:         aws.Int64Value(head.ContentLength),
+		LastModified: aws.TimeValue(head.LastModified),
+		Version:      aws.StringValue(head.ETag),
+	}, nil
+}
+
+// PutObjectWithCondition streams the object through the uploader with If-None-Match or If-Match header,
+// which S3 checks when the object is completed
+func (folder *Folder) PutObjectWithCondition(name string, content io.Reader, condition storage.PutCondition) (string, error) {
+	return folder.putObject(name, content, storage.PutOptions{Condition: &condition})
+}
+
+// recordETag stores ETag returned by the request, which completes the object
+func recordETag(etag *string) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.Error != nil {
+				return
+			}
+			switch output := r.Data.(type) {
+			case *s3.PutObjectOutput:
+				*etag = aws.StringValue(output.ETag)
+			case *s3.CompleteMultipartUploadOutput:
+				*etag = aws.StringValue(output.ETag)
+			}
+		})
+	}
+}
+
+// conditionHeaders adds the condition to requests which complete the object.
+// SDK has no fields for conditional writes, which S3 added later than other conditional requests
+func conditionHeaders(condition storage.PutCondition) request.Option {
+	return func(r *request.Request) {
+		switch r.Params.(type) {
+		case *s3.PutObjectInput, *s3.CompleteMultipartUploadInput:
+			if condition.IfNoneMatch {
+				r.HTTPRequest.Header.Set("If-None-Match", "*")
+			}
+			if condition.IfMatch != "" {
+				r.HTTPRequest.Header.Set("If-Match", condition.IfMatch)
+			}
+		}
+	}
+}
+
+// SetStorageClass copies the object in place with the new storage class, it is limited to objects up to 5 GiB.
+// The copy gets a new version and a new retention if objects are locked
+func (folder *Folder) SetStorageClass(objectRelativePath, storageClass string) error {
+	objectPath := folder.Path + objectRelativePath
+	input := folder.uploader.createCopyObjectInput(*folder.Bucket, objectPath, objectPath)
+	input.StorageClass = aws.String(storageClass)
+	_, err := folder.S3API.CopyObject(input)
+	if err != nil {
+		if isAwsNotExist(err) {
+			return storage.NewObjectNotFoundError(objectPath)
+		}
+		return errors.Wrapf(err, "failed to set storage class of s3 object '%s' to %s", objectPath, storageClass)
+	}
+	return nil
+}
+
+// RestoreObject requests a temporary copy of the object stored in GLACIER or DEEP_ARCHIVE storage class.
+// Repeated requests while restore is in progress are not an error
+func (folder *Folder) RestoreObject(objectRelativePath string, days int64, tier string) error {
+	objectPath := folder.Path + objectRelativePath
+	input := &s3.RestoreObjectInput{
+		Bucket:         folder.Bucket,
+		Key:            aws.String(objectPath),
+		RestoreRequest: &s3.RestoreRequest{Days: aws.Int64(days)},
+	}
+	if tier != "" {
+		input.RestoreRequest.GlacierJobParameters = &s3.GlacierJobParameters{Tier: aws.String(tier)}
+	}
+	_, err := folder.S3API.RestoreObject(input)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == RestoreAlreadyInProgressAWSErrorCode {
+			return nil
+		}
+		if isAwsNotExist(err) {
+			return storage.NewObjectNotFoundError(objectPath)
+		}
+		return errors.Wrapf(err, "failed to restore s3 object '%s'", objectPath)
+	}
+	return nil
+}
+
+func (folder *Folder) GetRestoreStatus(objectRelativePath string) (storage.RestoreStatus, error) {
+	objectPath := folder.Path + objectRelativePath
+	head, err := folder.S3API.HeadObject(folder.createHeadObjectInput(objectPath))
+	if err != nil {
+		if isAwsNotExist(err) {
+			return storage.RestoreStatus{}, storage.NewObjectNotFoundError(objectPath)
+		}
+		return storage.RestoreStatus{}, errors.Wrapf(err, "failed to get restore status of s3 object '%s'", objectPath)
+	}
+	status, err := parseRestoreHeader(aws.StringValue(head.Restore))
+	if err != nil {
+		return storage.RestoreStatus{}, errors.Wrapf(err, "failed to get restore status of s3 object '%s'", objectPath)
+	}
+	status.StorageClass = aws.StringValue(head.StorageClass)
+	status.Archived = status.StorageClass == s3.StorageClassGlacier || status.StorageClass == s3.StorageClassDeepArchive
+	return status, nil
+}
+
+// parseRestoreHeader parses x-amz-restore header, e.g. ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+func parseRestoreHeader(header string) (status storage.RestoreStatus, err error) {
+	// Values are quoted, because expiry date contains comma itself
+	for _, field := range restoreHeaderFieldRegexp.FindAllStringSubmatch(header, -1) {
+		switch field[1] {
+		case "ongoing-request":
+			status.InProgress = field[2] == "true"
+		case "expiry-date":
+			status.RestoredUntil, err = time.Parse(http.TimeFormat, field[2])
+			if err != nil {
+				return storage.RestoreStatus{}, errors.Wrapf(err, "invalid restore expiry date '%s'", field[2])
+			}
+		}
+	}
+	return status, nil
+}
+
+// CopyObject copies the object on the server side, it is limited to objects up to 5 GiB.
+// The copy is stored with the storage class and encryption of the uploader
+func (folder *Folder) CopyObject(srcObjectRelativePath, dstObjectRelativePath string) error {
+	srcPath := folder.Path + srcObjectRelativePath
+	input := folder.uploader.createCopyObjectInput(*folder.Bucket, srcPath, folder.Path+dstObjectRelativePath)
+	_, err := folder.S3API.CopyObject(input)
+	if err != nil {
+		if isAwsNotExist(err) {
+			return storage.NewObjectNotFoundError(srcPath)
+		}
+		return errors.Wrapf(err, "failed to copy s3 object '%s' to '%s'", srcPath, aws.StringValue(input.Key))
+	}
+	return nil
+}
+
+// SignedURL presigns GetObject or PutObject request, S3 limits expiry to 7 days.
+// URLs are not signed with SSE-C, because the customer key would have to be sent by the holder of the URL
+func (folder *Folder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	if err := storage.CheckSignedURLMethod(method); err != nil {
+		return "", err
+	}
+	if folder.uploader.sseCustomerKey != "" {
+		return "", storage.NewUnsupportedOperationError("S3 with SSE-C", "signed URLs")
+	}
+	objectPath := folder.Path + objectRelativePath
+	var signedRequest *request.Request
+	if method == http.MethodGet {
+		signedRequest, _ = folder.S3API.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: folder.Bucket,
+			Key:    aws.String(objectPath),
+		})
+	} else {
+		signedRequest, _ = folder.S3API.PutObjectRequest(&s3.PutObjectInput{
+			Bucket: folder.Bucket,
+			Key:    aws.String(objectPath),
+		})
+	}
+	signedURL, err := signedRequest.Presign(expiry)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to presign %s request of '%s'", method, objectPath)
+	}
+	return signedURL, nil
+}
+
 func (folder *Folder) GetSubFolder(subFolderRelativePath string) storage.Folder {
-	return NewFolder(folder.uploader, folder.S3API, *folder.Bucket, storage.JoinPath(folder.Path, subFolderRelativePath)+"/")
+	return folder.subFolder(storage.JoinPath(folder.Path, subFolderRelativePath) + "/")
+}
+
+func (folder *Folder) subFolder(path string) *Folder {
+	subFolder := NewFolderWithOptions(folder.uploader, folder.S3API, *folder.Bucket, path,
+		FolderOptions{folder.parallelReadOptions, folder.listingOptions})
+	subFolder.bucketObjectLock = folder.bucketObjectLock
+	return subFolder
 }
 
 func (folder *Folder) GetPath() string {
@@ -151,46 +626,176 @@ func (folder *Folder) GetPath() string {
 }
 
 func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []storage.Folder, err error) {
-	s3Objects := &s3.ListObjectsV2Input{
-		Bucket:    folder.Bucket,
-		Prefix:    aws.String(folder.Path),
-		Delimiter: aws.String("/"),
-	}
-
-	err = folder.S3API.ListObjectsV2Pages(s3Objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
-		for _, prefix := range files.CommonPrefixes {
-			subFolders = append(subFolders, NewFolder(folder.uploader, folder.S3API, *folder.Bucket, *prefix.Prefix))
+	var pageErr error
+	addPage := func(prefixes []*s3.CommonPrefix, contents []*s3.Object) bool {
+		for _, prefix := range prefixes {
+			subFolderPath, err := folder.listingOptions.decodeKey(prefix.Prefix)
+			if err != nil {
+				pageErr = err
+				return false
+			}
+			if subFolderPath == folder.Path {
+				continue
+			}
+			subFolders = append(subFolders, folder.subFolder(subFolderPath))
 		}
-		for _, object := range files.Contents {
+		for _, object := range contents {
+			key, err := folder.listingOptions.decodeKey(object.Key)
+			if err != nil {
+				pageErr = err
+				return false
+			}
 			// Some storages return root tar_partitions folder as a Key.
 			// We do not want to fail restoration due to this fact.
 			// Keep in mind that skipping files is very dangerous and any decision here must be weighted.
-			if *object.Key == folder.Path {
+			if key == folder.Path {
 				continue
 			}
-			objectRelativePath := strings.TrimPrefix(*object.Key, folder.Path)
+			objectRelativePath := strings.TrimPrefix(key, folder.Path)
 			objects = append(objects, storage.NewLocalObject(objectRelativePath, *object.LastModified))
 		}
 		return true
-	})
+	}
+
+	if !folder.listingOptions.useListObjectsV1() {
+		err = folder.listObjectsV2(addPage)
+		if isAwsNotImplemented(err) && len(objects) == 0 && len(subFolders) == 0 {
+			tracelog.WarningLogger.Printf("S3 storage does not support ListObjectsV2, falling back to ListObjects\n")
+			atomic.StoreInt32(&folder.listingOptions.listObjectsV2NotImplemented, 1)
+			err = folder.listObjectsV1(addPage)
+		}
+	} else {
+		err = folder.listObjectsV1(addPage)
+	}
+	if err == nil {
+		err = pageErr
+	}
 	if err != nil {
 		return nil, nil, errors.Wrapf(err, "failed to list s3 folder: '%s'", folder.Path)
 	}
 	return objects, subFolders, nil
 }
 
+func (folder *Folder) listObjectsV2(addPage func([]*s3.CommonPrefix, []*s3.Object) bool) error {
+	s3Objects := &s3.ListObjectsV2Input{
+		Bucket:       folder.Bucket,
+		Prefix:       aws.String(folder.Path),
+		Delimiter:    aws.String("/"),
+		EncodingType: folder.listingOptions.encodingType(),
+	}
+	return folder.S3API.ListObjectsV2Pages(s3Objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
+		return addPage(files.CommonPrefixes, files.Contents)
+	})
+}
+
+// listObjectsV1 paginates manually, because markers must be decoded when keys are URL encoded
+func (folder *Folder) listObjectsV1(addPage func([]*s3.CommonPrefix, []*s3.Object) bool) error {
+	s3Objects := &s3.ListObjectsInput{
+		Bucket:       folder.Bucket,
+		Prefix:       aws.String(folder.Path),
+		Delimiter:    aws.String("/"),
+		EncodingType: folder.listingOptions.encodingType(),
+	}
+	for {
+		files, err := folder.S3API.ListObjects(s3Objects)
+		if err != nil {
+			return err
+		}
+		if !addPage(files.CommonPrefixes, files.Contents) || !aws.BoolValue(files.IsTruncated) {
+			return nil
+		}
+		marker, err := folder.nextMarkerV1(files)
+		if err != nil {
+			return err
+		}
+		s3Objects.Marker = aws.String(marker)
+	}
+}
+
+// nextMarkerV1 returns decoded marker of the next page. Some storages do not return NextMarker even with delimiter,
+// then the marker is the greatest of the last key and the last common prefix of the page
+func (folder *Folder) nextMarkerV1(files *s3.ListObjectsOutput) (string, error) {
+	if aws.StringValue(files.NextMarker) != "" {
+		return folder.listingOptions.decodeKey(files.NextMarker)
+	}
+	var marker string
+	if len(files.Contents) > 0 {
+		lastKey, err := folder.listingOptions.decodeKey(files.Contents[len(files.Contents)-1].Key)
+		if err != nil {
+			return "", err
+		}
+		marker = lastKey
+	}
+	if len(files.CommonPrefixes) > 0 {
+		lastPrefix, err := folder.listingOptions.decodeKey(files.CommonPrefixes[len(files.CommonPrefixes)-1].Prefix)
+		if err != nil {
+			return "", err
+		}
+		if lastPrefix > marker {
+			marker = lastPrefix
+		}
+	}
+	if marker == "" {
+		return "", errors.New("truncated listing has no marker")
+	}
+	return marker, nil
+}
+
 func (folder *Folder) DeleteObjects(objectRelativePaths []string) error {
-	parts := partitionStrings(objectRelativePaths, 1000)
-	for _, part := range parts {
+	var failures []storage.DeleteFailure
+	for _, part := range partitionStrings(objectRelativePaths, 1000) {
+		failures = append(failures, folder.deleteObjectsPart(folder.partitionToObjects(part))...)
+	}
+	if len(failures) > 0 {
+		return storage.NewDeleteObjectsError("S3", failures)
+	}
+	return nil
+}
+
+// deleteObjectsPart deletes up to 1000 keys or versions by one request. Batch request succeeds even if some keys
+// are not deleted, keys which failed with retryable errors are deleted again, other failures are returned.
+// If the request fails, all keys, which were not deleted yet, are returned as failed
+func (folder *Folder) deleteObjectsPart(objects []*s3.ObjectIdentifier) []storage.DeleteFailure {
+	var failures []storage.DeleteFailure
+	for attempt := 0; len(objects) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(DeleteRetryDelay << uint(attempt-1))
+		}
 		input := &s3.DeleteObjectsInput{Bucket: folder.Bucket, Delete: &s3.Delete{
-			Objects: folder.partitionToObjects(part),
+			Objects: objects,
 		}}
-		_, err := folder.S3API.DeleteObjects(input)
+		output, err := folder.S3API.DeleteObjects(input)
 		if err != nil {
-			return errors.Wrapf(err, "failed to delete s3 object: '%s'", part)
+			for _, object := range objects {
+				failures = append(failures, storage.DeleteFailure{
+					ObjectRelativePath: strings.TrimPrefix(aws.StringValue(object.Key), folder.Path),
+					Err:                err,
+				})
+			}
+			return failures
+		}
+		objects = nil
+		for _, deleteError := range output.Errors {
+			code := aws.StringValue(deleteError.Code)
+			if isRetryableDeleteErrorCode(code) && attempt < DeleteRetries {
+				objects = append(objects, &s3.ObjectIdentifier{Key: deleteError.Key, VersionId: deleteError.VersionId})
+				continue
+			}
+			failures = append(failures, storage.DeleteFailure{
+				ObjectRelativePath: strings.TrimPrefix(aws.StringValue(deleteError.Key), folder.Path),
+				Err:                awserr.New(code, aws.StringValue(deleteError.Message), nil),
+			})
 		}
 	}
-	return nil
+	return failures
+}
+
+func isRetryableDeleteErrorCode(code string) bool {
+	switch code {
+	case "InternalError", "ServiceUnavailable", "SlowDown", "RequestTimeout", "OperationAborted":
+		return true
+	}
+	return false
 }
 
 func (folder *Folder) partitionToObjects(keys []string) []*s3.ObjectIdentifier {
@@ -201,6 +806,14 @@ func (folder *Folder) partitionToObjects(keys []string) []*s3.ObjectIdentifier {
 	return objects
 }
 
+// optionalString returns nil for empty value, so the header is not sent at all
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
+
 func isAwsNotExist(err error) bool {
 	if awsErr, ok := err.(awserr.Error); ok {
 		if awsErr.Code() == NotFoundAWSErrorCode || awsErr.Code() == NoSuchKeyAWSErrorCode {
@@ -209,3 +822,29 @@ func isAwsNotExist(err error) bool {
 	}
 	return false
 }
+
+func isAwsArchived(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == InvalidObjectStateAWSErrorCode || awsErr.Code() == s3.ErrCodeObjectNotInActiveTierError
+	}
+	return false
+}
+
+// isAwsPreconditionFailed is true if the condition is not met or a concurrent conditional write won.
+// s3manager wraps errors of multipart uploads, so original errors are checked too
+func isAwsPreconditionFailed(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		if awsErr.Code() == PreconditionFailedAWSErrorCode || awsErr.Code() == ConditionalRequestConflictAWSErrorCode {
+			return true
+		}
+		return isAwsPreconditionFailed(awsErr.OrigErr())
+	}
+	return false
+}
+
+func isAwsNotImplemented(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == NotImplementedAWSErrorCode
+	}
+	return false
+}
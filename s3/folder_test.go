@@ -1,9 +1,24 @@
 package s3
 
 import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/tinsane/storages/storage"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestS3Folder(t *testing.T) {
@@ -19,3 +34,280 @@ func TestS3Folder(t *testing.T) {
 
 	storage.RunFolderTest(storageFolder, t)
 }
+
+// mockDeleteS3API fails deletion of keys with given error codes, retryable errors happen only once per key
+type mockDeleteS3API struct {
+	s3iface.S3API
+	errorCodes  map[string]string
+	deletedKeys []string
+	requests    int
+	// failedRequest fails with transport error, requests are counted from 1
+	failedRequest int
+}
+
+func (mock *mockDeleteS3API) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	mock.requests++
+	if mock.requests == mock.failedRequest {
+		return nil, errors.New("connection reset")
+	}
+	output := &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		key := aws.StringValue(object.Key)
+		code, ok := mock.errorCodes[key]
+		if !ok {
+			mock.deletedKeys = append(mock.deletedKeys, key)
+			continue
+		}
+		if isRetryableDeleteErrorCode(code) {
+			delete(mock.errorCodes, key)
+		}
+		output.Errors = append(output.Errors, &s3.Error{
+			Key:     object.Key,
+			Code:    aws.String(code),
+			Message: aws.String("mock " + code),
+		})
+	}
+	return output, nil
+}
+
+func TestS3FolderDeleteObjectsReportsFailedKeys(t *testing.T) {
+	defer func(delay time.Duration) { DeleteRetryDelay = delay }(DeleteRetryDelay)
+	DeleteRetryDelay = time.Millisecond
+	mock := &mockDeleteS3API{errorCodes: map[string]string{
+		"path/locked": "AccessDenied",
+		"path/slow":   "SlowDown",
+	}}
+	folder := NewFolder(Uploader{}, mock, "bucket", "path")
+
+	err := folder.DeleteObjects([]string{"ok", "locked", "slow"})
+	deleteErr, ok := err.(storage.DeleteObjectsError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(deleteErr.Failures))
+	assert.Equal(t, "locked", deleteErr.Failures[0].ObjectRelativePath)
+	assert.Equal(t, "AccessDenied", deleteErr.Failures[0].Err.(awserr.Error).Code())
+	assert.Equal(t, []string{"path/ok", "path/slow"}, mock.deletedKeys)
+	assert.Equal(t, 2, mock.requests)
+}
+
+func TestS3FolderDeleteObjectsKeepsFailuresOfEarlierBatches(t *testing.T) {
+	mock := &mockDeleteS3API{errorCodes: map[string]string{"path/locked": "AccessDenied"}, failedRequest: 2}
+	folder := NewFolder(Uploader{}, mock, "bucket", "path")
+	keys := []string{"locked"}
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, strconv.Itoa(i))
+	}
+
+	err := folder.DeleteObjects(keys)
+	deleteErr, ok := err.(storage.DeleteObjectsError)
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(deleteErr.Failures))
+	assert.Equal(t, "locked", deleteErr.Failures[0].ObjectRelativePath)
+	assert.Equal(t, "999", deleteErr.Failures[1].ObjectRelativePath)
+	assert.Equal(t, 999, len(mock.deletedKeys))
+}
+
+// mockListV1S3API lists URL encoded keys one per page and does not implement ListObjectsV2
+type mockListV1S3API struct {
+	s3iface.S3API
+	keys      []string
+	markers   []string
+	v2Queries int
+}
+
+func (mock *mockListV1S3API) ListObjectsV2Pages(input *s3.ListObjectsV2Input,
+	fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	mock.v2Queries++
+	return awserr.New(NotImplementedAWSErrorCode, "A header you provided implies functionality that is not implemented", nil)
+}
+
+func (mock *mockListV1S3API) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
+	mock.markers = append(mock.markers, aws.StringValue(input.Marker))
+	output := &s3.ListObjectsOutput{
+		CommonPrefixes: []*s3.CommonPrefix{{Prefix: aws.String("path/")}},
+		EncodingType:   input.EncodingType,
+	}
+	for i, key := range mock.keys {
+		if key > aws.StringValue(input.Marker) {
+			output.Contents = []*s3.Object{{
+				Key:          aws.String(url.QueryEscape(key)),
+				LastModified: aws.Time(time.Now()),
+			}}
+			output.IsTruncated = aws.Bool(i < len(mock.keys)-1)
+			break
+		}
+	}
+	return output, nil
+}
+
+func TestS3FolderListFolderFallsBackToListObjectsV1(t *testing.T) {
+	mock := &mockListV1S3API{keys: []string{"path/", "path/a b", "path/c+d"}}
+	folder := NewFolderWithOptions(Uploader{}, mock, "bucket", "path",
+		FolderOptions{Listing: &ListingOptions{URLEncodeKeys: true}})
+
+	for i := 0; i < 2; i++ {
+		objects, subFolders, err := folder.ListFolder()
+		assert.NoError(t, err)
+		assert.Empty(t, subFolders)
+		assert.Equal(t, 2, len(objects))
+		assert.Equal(t, "a b", objects[0].GetName())
+		assert.Equal(t, "c+d", objects[1].GetName())
+	}
+	assert.Equal(t, 1, mock.v2Queries)
+	assert.Equal(t, []string{"", "path/", "path/a b", "", "path/", "path/a b"}, mock.markers)
+}
+
+// mockPrefixPagesS3API lists one common prefix or key per page without NextMarker
+type mockPrefixPagesS3API struct {
+	s3iface.S3API
+	prefixes []string
+	keys     []string
+	markers  []string
+}
+
+func (mock *mockPrefixPagesS3API) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
+	mock.markers = append(mock.markers, aws.StringValue(input.Marker))
+	entries := append(append([]string{}, mock.prefixes...), mock.keys...)
+	sort.Strings(entries)
+	output := &s3.ListObjectsOutput{}
+	for i, entry := range entries {
+		if entry <= aws.StringValue(input.Marker) {
+			continue
+		}
+		if strings.HasSuffix(entry, "/") {
+			output.CommonPrefixes = []*s3.CommonPrefix{{Prefix: aws.String(entry)}}
+		} else {
+			output.Contents = []*s3.Object{{Key: aws.String(entry), LastModified: aws.Time(time.Now())}}
+		}
+		output.IsTruncated = aws.Bool(i < len(entries)-1)
+		break
+	}
+	return output, nil
+}
+
+func TestS3FolderListObjectsV1PagesWithOnlyPrefixes(t *testing.T) {
+	mock := &mockPrefixPagesS3API{prefixes: []string{"path/a/", "path/b/"}, keys: []string{"path/0", "path/c"}}
+	folder := NewFolderWithOptions(Uploader{}, mock, "bucket", "path",
+		FolderOptions{Listing: &ListingOptions{UseListObjectsV1: true}})
+
+	objects, subFolders, err := folder.ListFolder()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(objects))
+	assert.Equal(t, 2, len(subFolders))
+	assert.Equal(t, []string{"", "path/0", "path/a/", "path/b/"}, mock.markers)
+}
+
+func TestConfigureListingOptions(t *testing.T) {
+	options, err := configureListingOptions(map[string]string{
+		ListObjectsVersionSetting: "1",
+		ListURLEncodedKeysSetting: "true",
+	})
+	assert.NoError(t, err)
+	assert.True(t, options.UseListObjectsV1)
+	assert.True(t, options.URLEncodeKeys)
+
+	_, err = configureListingOptions(map[string]string{ListObjectsVersionSetting: "3"})
+	assert.Error(t, err)
+}
+
+// mockGlacierS3API stores every object in GLACIER, restore becomes available on the second status check
+type mockGlacierS3API struct {
+	s3iface.S3API
+	restoreRequests []*s3.RestoreObjectInput
+}
+
+func (mock *mockGlacierS3API) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return nil, awserr.New(InvalidObjectStateAWSErrorCode, "The operation is not valid for the object's storage class", nil)
+}
+
+func (mock *mockGlacierS3API) RestoreObject(input *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	mock.restoreRequests = append(mock.restoreRequests, input)
+	if len(mock.restoreRequests) > 1 {
+		return nil, awserr.New(RestoreAlreadyInProgressAWSErrorCode, "Object restore is already in progress", nil)
+	}
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func (mock *mockGlacierS3API) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	output := &s3.HeadObjectOutput{StorageClass: aws.String(s3.StorageClassGlacier)}
+	if len(mock.restoreRequests) > 0 {
+		output.Restore = aws.String(`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`)
+	}
+	return output, nil
+}
+
+func TestS3FolderRestoreArchivedObject(t *testing.T) {
+	mock := &mockGlacierS3API{}
+	folder := NewFolder(Uploader{}, mock, "bucket", "path")
+
+	_, err := folder.ReadObject("archived")
+	_, ok := err.(storage.ObjectArchivedError)
+	assert.True(t, ok)
+
+	status, err := folder.GetRestoreStatus("archived")
+	assert.NoError(t, err)
+	assert.True(t, status.Archived)
+	assert.False(t, status.IsReadable())
+
+	assert.NoError(t, folder.RestoreObject("archived", 7, s3.TierBulk))
+	assert.NoError(t, folder.RestoreObject("archived", 7, ""))
+	assert.Equal(t, 2, len(mock.restoreRequests))
+	assert.Equal(t, int64(7), aws.Int64Value(mock.restoreRequests[0].RestoreRequest.Days))
+	assert.Equal(t, s3.TierBulk, aws.StringValue(mock.restoreRequests[0].RestoreRequest.GlacierJobParameters.Tier))
+	assert.Nil(t, mock.restoreRequests[1].RestoreRequest.GlacierJobParameters)
+
+	status, err = folder.GetRestoreStatus("archived")
+	assert.NoError(t, err)
+	assert.True(t, status.IsReadable())
+	assert.Equal(t, time.Date(2012, 12, 21, 0, 0, 0, 0, time.UTC), status.RestoredUntil)
+}
+
+func TestParseRestoreHeader(t *testing.T) {
+	status, err := parseRestoreHeader(`ongoing-request="true"`)
+	assert.NoError(t, err)
+	assert.True(t, status.InProgress)
+	assert.True(t, status.RestoredUntil.IsZero())
+
+	status, err = parseRestoreHeader("")
+	assert.NoError(t, err)
+	assert.False(t, status.InProgress)
+
+	_, err = parseRestoreHeader(`ongoing-request="false", expiry-date="tomorrow"`)
+	assert.Error(t, err)
+}
+
+func TestS3FolderPutObjectWithConditionStreamsThroughUploader(t *testing.T) {
+	objects := make(map[string]bool)
+	var conditions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		conditions = append(conditions, r.Header.Get("If-None-Match")+r.Header.Get("If-Match"))
+		if r.Header.Get("If-None-Match") == "*" && objects[r.URL.Path] {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = w.Write([]byte("<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions " +
+				"you specified did not hold</Message></Error>"))
+			return
+		}
+		objects[r.URL.Path] = true
+		w.Header().Set("ETag", "\"etag\"")
+	}))
+	defer server.Close()
+	client := s3.New(session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	})))
+	folder := NewFolder(*NewUploader(CreateUploaderAPI(client, 5*1024*1024, 1), "", "", "STANDARD"), client, "bucket", "path")
+
+	condition := storage.PutCondition{IfNoneMatch: true}
+	version, err := storage.PutObjectWithCondition(folder, "lock", strings.NewReader("owner"), condition)
+	assert.NoError(t, err)
+	assert.Equal(t, "\"etag\"", version)
+	_, err = storage.PutObjectWithCondition(folder, "lock", strings.NewReader("owner"), condition)
+	assert.IsType(t, storage.PreconditionFailedError{}, err)
+	assert.NoError(t, folder.PutObjectWithOptions("lock", strings.NewReader("owner"), storage.PutOptions{
+		StorageClass: "STANDARD_IA",
+		Condition:    &storage.PutCondition{IfMatch: "\"etag\""},
+	}))
+	assert.Equal(t, []string{"*", "*", "\"etag\""}, conditions)
+}
@@ -0,0 +1,359 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/pkg/errors"
+	"github.com/tinsane/storages/storage"
+	"github.com/tinsane/tracelog"
+)
+
+const (
+	// Uploads are tagged by the last parts, which are not included into the completed object
+	ownerTagPartNumber  = s3manager.MaxUploadParts
+	paramsTagPartNumber = s3manager.MaxUploadParts - 1
+	maxDataParts        = s3manager.MaxUploadParts - 2
+)
+
+// multipartUploader uploads objects part by part. If a previous process of the same owner died in the middle of
+// uploading the same key with the same parameters, its multipart upload is continued: parts with the same size and MD5
+// are not uploaded again. S3 does not return parameters of unfinished uploads, so every upload has tag parts
+// with the owner and the hash of parameters of CreateMultipartUpload, which are compared by MD5 in their ETags.
+// Unfinished uploads of the owner with other parameters are aborted, uploads of other owners may be in progress,
+// so they are left to AbortStaleMultipartUploads.
+// Parts encrypted with aws:kms or SSE-C have ETags other than MD5, so such objects are never resumed.
+type multipartUploader struct {
+	s3API       s3iface.S3API
+	partSize    int64
+	concurrency int
+	// owner must differ between processes, which may upload the same key concurrently
+	owner string
+}
+
+func newMultipartUploader(s3API s3iface.S3API, partSize int64, concurrency int, owner string) *multipartUploader {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &multipartUploader{s3API, partSize, concurrency, owner}
+}
+
+// upload uses uploaderAPI for objects that fit into one part, when there is nothing to resume
+func (uploader *multipartUploader) upload(input *s3manager.UploadInput, uploaderAPI s3manageriface.UploaderAPI,
+	tracker *storage.ProgressTracker, requestOptions ...request.Option) error {
+	if input.SSECustomerKey != nil || aws.StringValue(input.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms {
+		_, err := uploaderAPI.Upload(input, uploadOptions(tracker, requestOptions)...)
+		return err
+	}
+	createInput := newCreateMultipartUploadInput(input)
+	paramsTag, err := newParamsTag(createInput)
+	if err != nil {
+		return err
+	}
+	uploadId, uploadedParts, err := uploader.findUnfinishedUpload(input.Bucket, input.Key, paramsTag)
+	if err != nil {
+		return err
+	}
+	firstPart, err := readPart(input.Body, uploader.partSize)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read content of '%s'", aws.StringValue(input.Key))
+	}
+	if uploadId == "" && int64(len(firstPart)) < uploader.partSize {
+		singlePartInput := *input
+		singlePartInput.Body = bytes.NewReader(firstPart)
+		_, err = uploaderAPI.Upload(&singlePartInput, uploadOptions(tracker, requestOptions)...)
+		return err
+	}
+
+	if uploadId == "" {
+		output, err := uploader.s3API.CreateMultipartUpload(createInput)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create multipart upload of '%s'", aws.StringValue(input.Key))
+		}
+		uploadId = aws.StringValue(output.UploadId)
+		err = uploader.tagUpload(input, uploadId, paramsTag)
+		if err != nil {
+			// Untagged upload can not be resumed
+			uploader.abort(input.Bucket, input.Key, uploadId)
+			return err
+		}
+	} else {
+		tracelog.InfoLogger.Printf("Resume multipart upload %s of '%s' with %d uploaded parts\n",
+			uploadId, aws.StringValue(input.Key), len(uploadedParts))
+	}
+
+	completedParts, err := uploader.uploadParts(input, uploadId, uploadedParts, firstPart, tracker)
+	if err != nil {
+		// Upload is not aborted, so the next attempt can continue it
+		return err
+	}
+	_, err = uploader.s3API.CompleteMultipartUploadWithContext(aws.BackgroundContext(), &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+	}, requestOptions...)
+	if isAwsPreconditionFailed(err) {
+		// Parts of the rejected object must not be resumed by the next upload of the key
+		uploader.abort(input.Bucket, input.Key, uploadId)
+	}
+	return errors.Wrapf(err, "failed to complete multipart upload of '%s'", aws.StringValue(input.Key))
+}
+
+func newCreateMultipartUploadInput(input *s3manager.UploadInput) *s3.CreateMultipartUploadInput {
+	createInput := &s3.CreateMultipartUploadInput{}
+	awsutil.Copy(createInput, input)
+	return createInput
+}
+
+// newParamsTag returns the hash of parameters, which are kept by S3 from the creation of the upload
+func newParamsTag(createInput *s3.CreateMultipartUploadInput) ([]byte, error) {
+	params, err := json.Marshal(createInput)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal parameters of multipart upload of '%s'",
+			aws.StringValue(createInput.Key))
+	}
+	hash := sha256.Sum256(params)
+	return []byte(hex.EncodeToString(hash[:])), nil
+}
+
+func (uploader *multipartUploader) tagUpload(input *s3manager.UploadInput, uploadId string, paramsTag []byte) error {
+	_, err := uploader.uploadPart(input, uploadId, ownerTagPartNumber, []byte(uploader.owner), nil)
+	if err != nil {
+		return err
+	}
+	_, err = uploader.uploadPart(input, uploadId, paramsTagPartNumber, paramsTag, nil)
+	return err
+}
+
+func (uploader *multipartUploader) abort(bucket, key *string, uploadId string) {
+	_, err := uploader.s3API.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket: bucket, Key: key, UploadId: aws.String(uploadId),
+	})
+	if err != nil {
+		tracelog.WarningLogger.Printf("failed to abort multipart upload %s of '%s': %v\n",
+			uploadId, aws.StringValue(key), err)
+	}
+}
+
+// findUnfinishedUpload returns the latest multipart upload of the key with the same owner and parameters,
+// its parts are returned by part numbers. Other uploads of the owner are aborted
+func (uploader *multipartUploader) findUnfinishedUpload(bucket, key *string, paramsTag []byte) (string, map[int64]*s3.Part, error) {
+	var uploads []*s3.MultipartUpload
+	listInput := &s3.ListMultipartUploadsInput{Bucket: bucket, Prefix: key}
+	err := uploader.s3API.ListMultipartUploadsPages(listInput, func(output *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range output.Uploads {
+			if aws.StringValue(upload.Key) == aws.StringValue(key) {
+				uploads = append(uploads, upload)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "failed to list multipart uploads of '%s'", aws.StringValue(key))
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return aws.TimeValue(uploads[i].Initiated).After(aws.TimeValue(uploads[j].Initiated))
+	})
+
+	var resumedUploadId string
+	var resumedParts map[int64]*s3.Part
+	for _, upload := range uploads {
+		parts, err := uploader.listParts(bucket, key, upload.UploadId)
+		if err != nil {
+			return "", nil, err
+		}
+		if !hasPart(parts, ownerTagPartNumber, []byte(uploader.owner)) {
+			continue
+		}
+		if resumedUploadId == "" && hasPart(parts, paramsTagPartNumber, paramsTag) {
+			resumedUploadId, resumedParts = aws.StringValue(upload.UploadId), parts
+			continue
+		}
+		tracelog.InfoLogger.Printf("Abort multipart upload %s of '%s' with other parameters\n",
+			aws.StringValue(upload.UploadId), aws.StringValue(key))
+		uploader.abort(bucket, key, aws.StringValue(upload.UploadId))
+	}
+	return resumedUploadId, resumedParts, nil
+}
+
+func (uploader *multipartUploader) listParts(bucket, key, uploadId *string) (map[int64]*s3.Part, error) {
+	parts := make(map[int64]*s3.Part)
+	partsInput := &s3.ListPartsInput{Bucket: bucket, Key: key, UploadId: uploadId}
+	err := uploader.s3API.ListPartsPages(partsInput, func(output *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range output.Parts {
+			parts[aws.Int64Value(part.PartNumber)] = part
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list parts of multipart upload of '%s'", aws.StringValue(key))
+	}
+	return parts, nil
+}
+
+// hasPart compares the size and MD5 of the uploaded part
+func hasPart(parts map[int64]*s3.Part, partNumber int64, content []byte) bool {
+	part := parts[partNumber]
+	return part != nil && aws.Int64Value(part.Size) == int64(len(content)) && aws.StringValue(part.ETag) == md5ETag(content)
+}
+
+func md5ETag(content []byte) string {
+	contentMD5 := md5.Sum(content)
+	return "\"" + hex.EncodeToString(contentMD5[:]) + "\""
+}
+
+// uploadParts adds parts to the tracker when they are uploaded, parts uploaded by the previous process are added too
+func (uploader *multipartUploader) uploadParts(input *s3manager.UploadInput, uploadId string,
+	uploadedParts map[int64]*s3.Part, firstPart []byte, tracker *storage.ProgressTracker) ([]*s3.CompletedPart, error) {
+	var completedParts []*s3.CompletedPart
+	var uploadErr error
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, uploader.concurrency)
+
+	part := firstPart
+	for partNumber := int64(1); ; partNumber++ {
+		if partNumber > maxDataParts {
+			uploadErr = errors.Errorf("'%s' does not fit into %d parts of %d bytes",
+				aws.StringValue(input.Key), maxDataParts, uploader.partSize)
+			break
+		}
+		if partNumber > 1 {
+			var err error
+			part, err = readPart(input.Body, uploader.partSize)
+			if err != nil {
+				uploadErr = errors.Wrapf(err, "failed to read content of '%s'", aws.StringValue(input.Key))
+				break
+			}
+			if len(part) == 0 {
+				break
+			}
+		}
+
+		semaphore <- struct{}{}
+		mutex.Lock()
+		failed := uploadErr != nil
+		mutex.Unlock()
+		if failed {
+			<-semaphore
+			break
+		}
+		wg.Add(1)
+		go func(partNumber int64, part []byte) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			etag, err := uploader.uploadPart(input, uploadId, partNumber, part, uploadedParts[partNumber])
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				if uploadErr == nil {
+					uploadErr = err
+				}
+				return
+			}
+			if tracker != nil {
+				tracker.Add(int64(len(part)))
+			}
+			completedParts = append(completedParts, &s3.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int64(partNumber)})
+		}(partNumber, part)
+
+		if int64(len(part)) < uploader.partSize {
+			break
+		}
+	}
+	wg.Wait()
+	if uploadErr != nil {
+		return nil, uploadErr
+	}
+	sort.Slice(completedParts, func(i, j int) bool {
+		return aws.Int64Value(completedParts[i].PartNumber) < aws.Int64Value(completedParts[j].PartNumber)
+	})
+	return completedParts, nil
+}
+
+func (uploader *multipartUploader) uploadPart(input *s3manager.UploadInput, uploadId string,
+	partNumber int64, part []byte, uploadedPart *s3.Part) (string, error) {
+	if uploadedPart != nil && aws.Int64Value(uploadedPart.Size) == int64(len(part)) && aws.StringValue(uploadedPart.ETag) == md5ETag(part) {
+		tracelog.DebugLogger.Printf("Part %d of '%s' is already uploaded\n", partNumber, aws.StringValue(input.Key))
+		return aws.StringValue(uploadedPart.ETag), nil
+	}
+	output, err := uploader.s3API.UploadPart(&s3.UploadPartInput{
+		Bucket:        input.Bucket,
+		Key:           input.Key,
+		UploadId:      aws.String(uploadId),
+		PartNumber:    aws.Int64(partNumber),
+		Body:          bytes.NewReader(part),
+		ContentLength: aws.Int64(int64(len(part))),
+		// Every part of SSE-C upload has to be sent with the same key
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to upload part %d of '%s'", partNumber, aws.StringValue(input.Key))
+	}
+	return aws.StringValue(output.ETag), nil
+}
+
+// readPart reads up to partSize bytes, returned part is shorter only at the end of content
+func readPart(content io.Reader, partSize int64) ([]byte, error) {
+	part := make([]byte, partSize)
+	n, err := io.ReadFull(content, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return part[:n], err
+}
+
+// AbortStaleMultipartUploads aborts multipart uploads in the folder initiated more than olderThan ago.
+// Parts of unfinished uploads are billed until the upload is aborted
+func (folder *Folder) AbortStaleMultipartUploads(olderThan time.Duration) error {
+	deadline := time.Now().Add(-olderThan)
+	var staleUploads []*s3.MultipartUpload
+	listInput := &s3.ListMultipartUploadsInput{Bucket: folder.Bucket, Prefix: aws.String(folder.Path)}
+	err := folder.S3API.ListMultipartUploadsPages(listInput, func(output *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range output.Uploads {
+			if aws.TimeValue(upload.Initiated).Before(deadline) {
+				staleUploads = append(staleUploads, upload)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list multipart uploads in s3 folder: '%s'", folder.Path)
+	}
+
+	for _, upload := range staleUploads {
+		tracelog.InfoLogger.Printf("Abort multipart upload of '%s' initiated at %v\n",
+			aws.StringValue(upload.Key), aws.TimeValue(upload.Initiated))
+		_, err = folder.S3API.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   folder.Bucket,
+			Key:      upload.Key,
+			UploadId: upload.UploadId,
+		})
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchUpload {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to abort multipart upload of '%s'", aws.StringValue(upload.Key))
+		}
+	}
+	return nil
+}
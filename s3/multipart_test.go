@@ -0,0 +1,217 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/storage"
+)
+
+type mockMultipartUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int64][]byte
+}
+
+// mockMultipartS3API keeps multipart uploads in memory
+type mockMultipartS3API struct {
+	s3iface.S3API
+	mutex         sync.Mutex
+	uploads       map[string]*mockMultipartUpload
+	objects       map[string][]byte
+	uploadedParts int
+	// lastUploadId is incremented, so ids of aborted uploads are not reused
+	lastUploadId int
+}
+
+func newMockMultipartS3API() *mockMultipartS3API {
+	return &mockMultipartS3API{uploads: make(map[string]*mockMultipartUpload), objects: make(map[string][]byte)}
+}
+
+func (mock *mockMultipartS3API) addUpload(key string, initiated time.Time, parts ...[]byte) string {
+	mock.lastUploadId++
+	uploadId := strconv.Itoa(mock.lastUploadId)
+	upload := &mockMultipartUpload{key, initiated, make(map[int64][]byte)}
+	for i, part := range parts {
+		upload.parts[int64(i+1)] = part
+	}
+	mock.uploads[uploadId] = upload
+	return uploadId
+}
+
+func partETag(part []byte) string {
+	partMD5 := md5.Sum(part)
+	return "\"" + hex.EncodeToString(partMD5[:]) + "\""
+}
+
+func (mock *mockMultipartS3API) ListMultipartUploadsPages(input *s3.ListMultipartUploadsInput,
+	fn func(*s3.ListMultipartUploadsOutput, bool) bool) error {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	output := &s3.ListMultipartUploadsOutput{}
+	for uploadId, upload := range mock.uploads {
+		if strings.HasPrefix(upload.key, aws.StringValue(input.Prefix)) {
+			output.Uploads = append(output.Uploads, &s3.MultipartUpload{
+				Key:       aws.String(upload.key),
+				UploadId:  aws.String(uploadId),
+				Initiated: aws.Time(upload.initiated),
+			})
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+func (mock *mockMultipartS3API) ListPartsPages(input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool) error {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	output := &s3.ListPartsOutput{}
+	for partNumber, part := range mock.uploads[aws.StringValue(input.UploadId)].parts {
+		output.Parts = append(output.Parts, &s3.Part{
+			PartNumber: aws.Int64(partNumber),
+			ETag:       aws.String(partETag(part)),
+			Size:       aws.Int64(int64(len(part))),
+		})
+	}
+	fn(output, true)
+	return nil
+}
+
+func (mock *mockMultipartS3API) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	uploadId := mock.addUpload(aws.StringValue(input.Key), time.Now())
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadId)}, nil
+}
+
+func (mock *mockMultipartS3API) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	part, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.uploads[aws.StringValue(input.UploadId)].parts[aws.Int64Value(input.PartNumber)] = part
+	mock.uploadedParts++
+	return &s3.UploadPartOutput{ETag: aws.String(partETag(part))}, nil
+}
+
+func (mock *mockMultipartS3API) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput,
+	options ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	upload := mock.uploads[aws.StringValue(input.UploadId)]
+	var object []byte
+	for _, completedPart := range input.MultipartUpload.Parts {
+		object = append(object, upload.parts[aws.Int64Value(completedPart.PartNumber)]...)
+	}
+	mock.objects[upload.key] = object
+	delete(mock.uploads, aws.StringValue(input.UploadId))
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (mock *mockMultipartS3API) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	delete(mock.uploads, aws.StringValue(input.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// tagUpload adds tag parts, which multipartUploader uploads with the given owner and input
+func (mock *mockMultipartS3API) tagUpload(uploadId, owner string, input *s3manager.UploadInput) {
+	paramsTag, err := newParamsTag(newCreateMultipartUploadInput(input))
+	if err != nil {
+		panic(err)
+	}
+	mock.uploads[uploadId].parts[ownerTagPartNumber] = []byte(owner)
+	mock.uploads[uploadId].parts[paramsTagPartNumber] = paramsTag
+}
+
+func TestMultipartUploaderResumesUnfinishedUpload(t *testing.T) {
+	partSize := int64(1024)
+	content := make([]byte, 3*partSize-10)
+	rand.Read(content)
+	input := &s3manager.UploadInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("path/backup"),
+		Body:   bytes.NewReader(content),
+	}
+	mock := newMockMultipartS3API()
+	uploadId := mock.addUpload("path/backup", time.Now(), content[:partSize], bytes.Repeat([]byte{1}, int(partSize)))
+	mock.tagUpload(uploadId, "owner", input)
+	foreignUploadId := mock.addUpload("path/backup", time.Now(), content[:partSize])
+	mock.tagUpload(foreignUploadId, "other owner", input)
+	otherUploadId := mock.addUpload("path/backup_other", time.Now(), content[:partSize])
+
+	uploader := newMultipartUploader(mock, partSize, 2, "owner")
+	tracker := storage.NewProgressTracker(int64(len(content)), storage.ProgressOptions{})
+	err := uploader.upload(input, nil, tracker)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), tracker.Progress().Transferred)
+
+	// The first part is reused, the corrupted second and missing third parts are uploaded
+	assert.Equal(t, 2, mock.uploadedParts)
+	assert.Equal(t, content, mock.objects["path/backup"])
+	assert.Equal(t, 2, len(mock.uploads))
+	assert.NotNil(t, mock.uploads[foreignUploadId])
+	assert.NotNil(t, mock.uploads[otherUploadId])
+}
+
+func TestMultipartUploaderAbortsUploadWithOtherParameters(t *testing.T) {
+	partSize := int64(1024)
+	content := make([]byte, 2*partSize)
+	rand.Read(content)
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String("bucket"),
+		Key:         aws.String("path/backup"),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("application/octet-stream"),
+	}
+	mock := newMockMultipartS3API()
+	staleUploadId := mock.addUpload("path/backup", time.Now(), content[:partSize])
+	mock.tagUpload(staleUploadId, "owner", &s3manager.UploadInput{Bucket: input.Bucket, Key: input.Key})
+	untaggedUploadId := mock.addUpload("path/backup", time.Now(), content[:partSize])
+
+	err := newMultipartUploader(mock, partSize, 2, "owner").upload(input, nil, nil)
+	assert.NoError(t, err)
+
+	// Both parts and both tags of the new upload are uploaded, tags are not included into the object
+	assert.Equal(t, 4, mock.uploadedParts)
+	assert.Equal(t, content, mock.objects["path/backup"])
+	assert.Nil(t, mock.uploads[staleUploadId])
+	assert.NotNil(t, mock.uploads[untaggedUploadId])
+}
+
+func TestAbortStaleMultipartUploads(t *testing.T) {
+	mock := newMockMultipartS3API()
+	staleUploadId := mock.addUpload("path/stale", time.Now().Add(-48*time.Hour))
+	freshUploadId := mock.addUpload("path/fresh", time.Now())
+	otherFolderUploadId := mock.addUpload("other/stale", time.Now().Add(-48*time.Hour))
+	folder := NewFolder(Uploader{}, mock, "bucket", "path")
+
+	err := folder.AbortStaleMultipartUploads(24 * time.Hour)
+	assert.NoError(t, err)
+
+	var uploadIds []string
+	for uploadId := range mock.uploads {
+		uploadIds = append(uploadIds, uploadId)
+	}
+	sort.Strings(uploadIds)
+	assert.NotContains(t, uploadIds, staleUploadId)
+	assert.Equal(t, []string{freshUploadId, otherFolderUploadId}, uploadIds)
+}
@@ -1,15 +1,20 @@
 package s3
 
 import (
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"github.com/pkg/errors"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // TODO : unit tests
@@ -54,31 +59,105 @@ func getAWSRegion(s3Bucket string, config *aws.Config, settings map[string]strin
 	}
 }
 
-func getDefaultConfig(settings map[string]string) *aws.Config {
+func getDefaultConfig(settings map[string]string) (*aws.Config, error) {
 	config := defaults.Get().Config.
 		WithRegion(settings[RegionSetting])
 
+	baseCredentials, err := getBaseCredentials(config, settings)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := settings[RoleArnSetting]; !ok {
+		if _, ok := settings[WebIdentityTokenFileSetting]; ok {
+			return nil, NewConfiguringError(RoleArnSetting)
+		}
+		return config.WithCredentials(baseCredentials), nil
+	}
+	stsClient, err := createSTSClient(config, baseCredentials)
+	if err != nil {
+		return nil, err
+	}
+	return config.WithCredentials(getRoleCredentials(settings, stsClient)), nil
+}
+
+// getBaseCredentials returns credentials from settings, falling back to the profile if it is set
+// or to the default SDK providers: environment, shared credentials file and EC2/ECS roles
+func getBaseCredentials(config *aws.Config, settings map[string]string) (*credentials.Credentials, error) {
 	provider := &credentials.StaticProvider{Value: credentials.Value{
 		AccessKeyID:     getFirstSettingOf(settings, []string{AccessKeyIdSetting, AccessKeySetting}),
 		SecretAccessKey: getFirstSettingOf(settings, []string{SecretAccessKeySetting, SecretKeySetting}),
 		SessionToken:    settings[SessionTokenSetting],
 	}}
+	if profile, ok := settings[ProfileSetting]; ok && provider.AccessKeyID == "" {
+		// Session resolves everything the shared config allows for a profile:
+		// credential_process, role_arn with source_profile and web_identity_token_file
+		profileConfig := config.Copy()
+		profileConfig.Credentials = nil
+		profileSession, err := session.NewSessionWithOptions(session.Options{
+			Config:            *profileConfig,
+			Profile:           profile,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load AWS profile '%s'", profile)
+		}
+		return profileSession.Config.Credentials, nil
+	}
 	providers := make([]credentials.Provider, 0)
 	providers = append(providers, provider)
 	providers = append(providers, defaults.CredProviders(config, defaults.Handlers())...)
-	newCredentials := credentials.NewCredentials(&credentials.ChainProvider{
+	return credentials.NewCredentials(&credentials.ChainProvider{
 		VerboseErrors: aws.BoolValue(config.CredentialsChainVerboseErrors),
 		Providers:     providers,
+	}), nil
+}
+
+// createSTSClient returns client authorized by base credentials, which are used to assume the role
+func createSTSClient(config *aws.Config, baseCredentials *credentials.Credentials) (stsiface.STSAPI, error) {
+	stsConfig := config.Copy().
+		WithCredentials(baseCredentials).
+		WithMaxRetries(MaxRetries)
+	if aws.StringValue(stsConfig.Region) == "" {
+		// Global STS endpoint is used, bucket region is not known yet
+		stsConfig = stsConfig.WithRegion("us-east-1")
+	}
+	stsSession, err := session.NewSession(stsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create STS session")
+	}
+	return sts.New(stsSession), nil
+}
+
+// getRoleCredentials assumes the role with web identity token if token file is set,
+// or with credentials of stsClient otherwise. Credentials are refreshed by SDK before they expire
+func getRoleCredentials(settings map[string]string, stsClient stsiface.STSAPI) *credentials.Credentials {
+	roleArn := settings[RoleArnSetting]
+	roleSessionName := settings[RoleSessionNameSetting]
+	if roleSessionName == "" {
+		roleSessionName = fmt.Sprintf("storages-%d", time.Now().UnixNano())
+	}
+	if tokenFile, ok := settings[WebIdentityTokenFileSetting]; ok {
+		// Token file is read on every refresh, so rotated tokens are picked up
+		return credentials.NewCredentials(stscreds.NewWebIdentityRoleProvider(stsClient, roleArn, roleSessionName, tokenFile))
+	}
+	return credentials.NewCredentials(&stscreds.AssumeRoleProvider{
+		Client:          stsClient,
+		RoleARN:         roleArn,
+		RoleSessionName: roleSessionName,
+		Duration:        stscreds.DefaultDuration,
 	})
-	return config.WithCredentials(newCredentials)
 }
 
 // TODO : unit tests
 func createSession(bucket string, settings map[string]string) (*session.Session, error) {
-	config := getDefaultConfig(settings)
+	config, err := getDefaultConfig(settings)
+	if err != nil {
+		return nil, err
+	}
 	config.MaxRetries = &MaxRetries
 	if _, err := config.Credentials.Get(); err != nil {
-		return nil, errors.Wrapf(err, "failed to get AWS credentials; please specify %s and %s", AccessKeyIdSetting, SecretAccessKeySetting)
+		return nil, errors.Wrapf(err, "failed to get AWS credentials; please specify %s and %s, %s or %s",
+			AccessKeyIdSetting, SecretAccessKeySetting, ProfileSetting, RoleArnSetting)
 	}
 
 	if endpoint, ok := settings[EndpointSetting]; ok {
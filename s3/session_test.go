@@ -0,0 +1,90 @@
+package s3
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockSTSAPI records role requests and returns fixed temporary credentials
+type mockSTSAPI struct {
+	stsiface.STSAPI
+	assumeRoleInputs            []*sts.AssumeRoleInput
+	assumeRoleWithWebIdentities []*sts.AssumeRoleWithWebIdentityInput
+}
+
+var mockRoleCredentials = &sts.Credentials{
+	AccessKeyId:     aws.String("role-access-key"),
+	SecretAccessKey: aws.String("role-secret-key"),
+	SessionToken:    aws.String("role-session-token"),
+	Expiration:      aws.Time(time.Now().Add(time.Hour)),
+}
+
+func (mock *mockSTSAPI) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	mock.assumeRoleInputs = append(mock.assumeRoleInputs, input)
+	return &sts.AssumeRoleOutput{Credentials: mockRoleCredentials}, nil
+}
+
+// AssumeRoleWithWebIdentityRequest returns the request without handlers, so it is completed without network
+func (mock *mockSTSAPI) AssumeRoleWithWebIdentityRequest(input *sts.AssumeRoleWithWebIdentityInput) (*request.Request, *sts.AssumeRoleWithWebIdentityOutput) {
+	mock.assumeRoleWithWebIdentities = append(mock.assumeRoleWithWebIdentities, input)
+	output := &sts.AssumeRoleWithWebIdentityOutput{Credentials: mockRoleCredentials}
+	operation := &request.Operation{Name: "AssumeRoleWithWebIdentity"}
+	return request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, operation, input, output), output
+}
+
+func TestRoleCredentials(t *testing.T) {
+	mock := &mockSTSAPI{}
+	roleCredentials := getRoleCredentials(map[string]string{
+		RoleArnSetting:         "arn:aws:iam::123456789012:role/backup",
+		RoleSessionNameSetting: "backup-session",
+	}, mock)
+
+	value, err := roleCredentials.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "role-access-key", value.AccessKeyID)
+	assert.Equal(t, "role-session-token", value.SessionToken)
+	assert.Equal(t, 1, len(mock.assumeRoleInputs))
+	assert.Equal(t, "arn:aws:iam::123456789012:role/backup", aws.StringValue(mock.assumeRoleInputs[0].RoleArn))
+	assert.Equal(t, "backup-session", aws.StringValue(mock.assumeRoleInputs[0].RoleSessionName))
+	assert.Equal(t, 0, len(mock.assumeRoleWithWebIdentities))
+}
+
+func TestWebIdentityRoleCredentials(t *testing.T) {
+	tokenFile, err := ioutil.TempFile("", "web_identity_token")
+	assert.NoError(t, err)
+	defer os.Remove(tokenFile.Name())
+	_, err = tokenFile.WriteString("web-identity-token")
+	assert.NoError(t, err)
+	assert.NoError(t, tokenFile.Close())
+
+	mock := &mockSTSAPI{}
+	roleCredentials := getRoleCredentials(map[string]string{
+		RoleArnSetting:              "arn:aws:iam::123456789012:role/backup",
+		WebIdentityTokenFileSetting: tokenFile.Name(),
+	}, mock)
+
+	value, err := roleCredentials.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "role-access-key", value.AccessKeyID)
+	assert.Equal(t, 0, len(mock.assumeRoleInputs))
+	assert.Equal(t, 1, len(mock.assumeRoleWithWebIdentities))
+	input := mock.assumeRoleWithWebIdentities[0]
+	assert.Equal(t, "web-identity-token", aws.StringValue(input.WebIdentityToken))
+	assert.NotEmpty(t, aws.StringValue(input.RoleSessionName))
+}
+
+func TestWebIdentityTokenFileRequiresRole(t *testing.T) {
+	_, err := getDefaultConfig(map[string]string{
+		WebIdentityTokenFileSetting: "/var/run/secrets/token",
+	})
+	assert.Error(t, err)
+}
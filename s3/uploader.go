@@ -1,20 +1,32 @@
 package s3
 
 import (
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 	"github.com/pkg/errors"
+	"github.com/tinsane/storages/storage"
 	"github.com/tinsane/tracelog"
 	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	DefaultMaxPartSize = 20 << 20
+	// The only algorithm S3 supports for customer-provided keys
+	DefaultSseCustomerAlgorithm = "AES256"
+	sseCustomerKeyLength        = 32
 )
 
 type SseKmsIdNotSetError struct {
@@ -34,10 +46,41 @@ type Uploader struct {
 	serverSideEncryption string
 	SSEKMSKeyId          string
 	StorageClass         string
+	// Set if unfinished multipart uploads should be resumed
+	multipartUploader *multipartUploader
+	// Customer-provided key is not stored by S3, so it is sent with every request to the object
+	sseCustomerAlgorithm string
+	sseCustomerKey       string
+	// Retention of uploaded objects starts at the moment of upload
+	objectLockMode      string
+	objectLockRetention time.Duration
+	objectLockLegalHold bool
 }
 
 func NewUploader(uploaderAPI s3manageriface.UploaderAPI, serverSideEncryption, sseKmsKeyId, storageClass string) *Uploader {
-	return &Uploader{uploaderAPI, serverSideEncryption, sseKmsKeyId, storageClass}
+	return &Uploader{uploaderAPI, serverSideEncryption, sseKmsKeyId, storageClass, nil, "", "", "", 0, false}
+}
+
+// objectLockParams returns Object Lock parameters of a new object, which are nil if objects are not locked.
+// S3 requires Content-MD5 of locked objects, SDK computes it for seekable bodies of PutObject and UploadPart
+func (uploader *Uploader) objectLockParams() (mode *string, retainUntilDate *time.Time, legalHoldStatus *string) {
+	if uploader.objectLockMode != "" {
+		mode = aws.String(uploader.objectLockMode)
+		retainUntilDate = aws.Time(time.Now().Add(uploader.objectLockRetention))
+	}
+	if uploader.objectLockLegalHold {
+		legalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+	return
+}
+
+// sseCustomerKeyParams returns SSE-C request parameters, which are nil if SSE-C is not used.
+// SDK computes the MD5 of the key itself
+func (uploader *Uploader) sseCustomerKeyParams() (algorithm, key *string) {
+	if uploader.sseCustomerKey == "" {
+		return nil, nil
+	}
+	return aws.String(uploader.sseCustomerAlgorithm), aws.String(uploader.sseCustomerKey)
 }
 
 // TODO : unit tests
@@ -57,14 +100,74 @@ func (uploader *Uploader) createUploadInput(bucket, path string, content io.Read
 			uploadInput.SSEKMSKeyId = aws.String(uploader.SSEKMSKeyId)
 		}
 	}
+	uploadInput.SSECustomerAlgorithm, uploadInput.SSECustomerKey = uploader.sseCustomerKeyParams()
+	uploadInput.ObjectLockMode, uploadInput.ObjectLockRetainUntilDate, uploadInput.ObjectLockLegalHoldStatus =
+		uploader.objectLockParams()
 
 	return uploadInput
 }
 
-func (uploader *Uploader) upload(bucket, path string, content io.Reader) error {
-	input := uploader.createUploadInput(bucket, path, content)
-	_, err := uploader.uploaderAPI.Upload(input)
-	return errors.Wrapf(err, "failed to upload '%s' to bucket '%s'", path, bucket)
+// createCopyObjectInput encrypts the copy the same way as uploaded objects.
+// Source is expected to be uploaded by this uploader, so it is decrypted with the same customer-provided key
+func (uploader *Uploader) createCopyObjectInput(bucket, sourcePath, destinationPath string) *s3.CopyObjectInput {
+	copySource := url.URL{Path: bucket + "/" + sourcePath}
+	copyInput := &s3.CopyObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(destinationPath),
+		CopySource:   aws.String(copySource.EscapedPath()),
+		StorageClass: aws.String(uploader.StorageClass),
+	}
+
+	if uploader.serverSideEncryption != "" {
+		copyInput.ServerSideEncryption = aws.String(uploader.serverSideEncryption)
+
+		if uploader.SSEKMSKeyId != "" {
+			copyInput.SSEKMSKeyId = aws.String(uploader.SSEKMSKeyId)
+		}
+	}
+	copyInput.SSECustomerAlgorithm, copyInput.SSECustomerKey = uploader.sseCustomerKeyParams()
+	copyInput.CopySourceSSECustomerAlgorithm, copyInput.CopySourceSSECustomerKey = uploader.sseCustomerKeyParams()
+	copyInput.ObjectLockMode, copyInput.ObjectLockRetainUntilDate, copyInput.ObjectLockLegalHoldStatus =
+		uploader.objectLockParams()
+
+	return copyInput
+}
+
+// upload adds bytes of uploaded parts to the tracker, tracker may be nil.
+// Request options are applied to every request of the upload
+func (uploader *Uploader) upload(input *s3manager.UploadInput, tracker *storage.ProgressTracker,
+	requestOptions ...request.Option) error {
+	var err error
+	if uploader.multipartUploader != nil {
+		err = uploader.multipartUploader.upload(input, uploader.uploaderAPI, tracker, requestOptions...)
+	} else {
+		_, err = uploader.uploaderAPI.Upload(input, uploadOptions(tracker, requestOptions)...)
+	}
+	return errors.Wrapf(err, "failed to upload '%s' to bucket '%s'", aws.StringValue(input.Key), aws.StringValue(input.Bucket))
+}
+
+// uploadOptions count bytes of PutObject and UploadPart requests sent by s3manager, which sends parts concurrently.
+// Complete handlers are run once after retries, so failed attempts are not counted
+func uploadOptions(tracker *storage.ProgressTracker, requestOptions []request.Option) []func(*s3manager.Uploader) {
+	if tracker == nil && len(requestOptions) == 0 {
+		return nil
+	}
+	if tracker == nil {
+		return []func(*s3manager.Uploader){s3manager.WithUploaderRequestOptions(requestOptions...)}
+	}
+	countUploadedBytes := func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.Error != nil || r.HTTPRequest == nil {
+				return
+			}
+			switch r.Params.(type) {
+			case *s3.PutObjectInput, *s3.UploadPartInput:
+				tracker.Add(r.HTTPRequest.ContentLength)
+			}
+		})
+	}
+	requestOptions = append(requestOptions, countUploadedBytes)
+	return []func(*s3manager.Uploader){s3manager.WithUploaderRequestOptions(requestOptions...)}
 }
 
 // CreateUploaderAPI returns an uploader with customizable concurrency
@@ -89,6 +192,70 @@ func configureServerSideEncryption(settings map[string]string) (serverSideEncryp
 	return
 }
 
+// configureSSECustomerKey reads base64 encoded key from settings or raw key from the key file
+func configureSSECustomerKey(settings map[string]string) (algorithm string, key string, err error) {
+	if encodedKey, ok := settings[SseCustomerKeySetting]; ok {
+		decodedKey, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "failed to decode %s, base64 encoded key is expected", SseCustomerKeySetting)
+		}
+		key = string(decodedKey)
+	} else if keyFile, ok := settings[SseCustomerKeyFileSetting]; ok {
+		rawKey, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "failed to read %s", SseCustomerKeyFileSetting)
+		}
+		key = string(rawKey)
+	} else {
+		return "", "", nil
+	}
+
+	if len(key) != sseCustomerKeyLength {
+		return "", "", errors.Errorf("SSE-C key must be %d bytes long, got %d bytes", sseCustomerKeyLength, len(key))
+	}
+	if settings[SseSetting] != "" {
+		return "", "", errors.Errorf("%s can not be used together with customer-provided key", SseSetting)
+	}
+	algorithm = DefaultSseCustomerAlgorithm
+	if customAlgorithm, ok := settings[SseCustomerAlgorithmSetting]; ok {
+		algorithm = customAlgorithm
+	}
+	keyMD5 := md5.Sum([]byte(key))
+	tracelog.InfoLogger.Printf("Using SSE-C key with MD5 %s\n", base64.StdEncoding.EncodeToString(keyMD5[:]))
+	return algorithm, key, nil
+}
+
+func configureObjectLock(settings map[string]string) (mode string, retention time.Duration, legalHold bool, err error) {
+	if strLegalHold, ok := settings[ObjectLockLegalHoldSetting]; ok {
+		legalHold, err = strconv.ParseBool(strLegalHold)
+		if err != nil {
+			return "", 0, false, errors.Wrapf(err, "failed to parse %s", ObjectLockLegalHoldSetting)
+		}
+	}
+	mode, hasMode := settings[ObjectLockModeSetting]
+	strRetention, hasRetention := settings[ObjectLockRetentionSetting]
+	if !hasMode && !hasRetention {
+		return "", 0, legalHold, nil
+	}
+	if !hasMode {
+		return "", 0, false, NewConfiguringError(ObjectLockModeSetting)
+	}
+	if !hasRetention {
+		return "", 0, false, NewConfiguringError(ObjectLockRetentionSetting)
+	}
+	mode = strings.ToUpper(mode)
+	if mode != s3.ObjectLockModeGovernance && mode != s3.ObjectLockModeCompliance {
+		return "", 0, false, errors.Errorf("%s must be either %s or %s",
+			ObjectLockModeSetting, s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance)
+	}
+	retention, err = time.ParseDuration(strRetention)
+	if err != nil || retention <= 0 {
+		return "", 0, false, errors.Errorf("%s must be a positive duration like 720h, got '%s'",
+			ObjectLockRetentionSetting, strRetention)
+	}
+	return mode, retention, legalHold, nil
+}
+
 // TODO : unit tests
 func partitionStrings(strings []string, blockSize int) [][]string {
 	// I've unsuccessfully tried this with interface{} but there was too much of casting
@@ -138,5 +305,31 @@ func configureUploader(s3Client *s3.S3, settings map[string]string) (*Uploader,
 	if storageClass, ok = settings[StorageClassSetting]; !ok {
 		storageClass = "STANDARD"
 	}
-	return NewUploader(uploaderApi, serverSideEncryption, sseKmsKeyId, storageClass), nil
+	uploader := NewUploader(uploaderApi, serverSideEncryption, sseKmsKeyId, storageClass)
+	uploader.sseCustomerAlgorithm, uploader.sseCustomerKey, err = configureSSECustomerKey(settings)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure server side encryption with customer-provided key")
+	}
+	uploader.objectLockMode, uploader.objectLockRetention, uploader.objectLockLegalHold, err = configureObjectLock(settings)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure object lock")
+	}
+
+	if strResumeMultipartUploads, ok := settings[ResumeMultipartUploadsSetting]; ok {
+		resumeMultipartUploads, err := strconv.ParseBool(strResumeMultipartUploads)
+		if err != nil {
+			return nil, NewFolderError(err, "Invalid s3 resume multipart uploads setting")
+		}
+		if resumeMultipartUploads {
+			owner, ok := settings[MultipartUploadOwnerSetting]
+			if !ok {
+				owner, err = os.Hostname()
+				if err != nil {
+					return nil, NewFolderError(err, "Unable to get hostname for owner of multipart uploads")
+				}
+			}
+			uploader.multipartUploader = newMultipartUploader(s3Client, int64(maxPartSize), concurrency, owner)
+		}
+	}
+	return uploader, nil
 }
@@ -0,0 +1,210 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/storage"
+)
+
+// mockSSECustomerS3API checks that every request carries the customer-provided key
+type mockSSECustomerS3API struct {
+	s3iface.S3API
+	t   *testing.T
+	key string
+}
+
+func (mock *mockSSECustomerS3API) assertKey(algorithm, key *string) {
+	assert.Equal(mock.t, DefaultSseCustomerAlgorithm, aws.StringValue(algorithm))
+	assert.Equal(mock.t, mock.key, aws.StringValue(key))
+}
+
+func (mock *mockSSECustomerS3API) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	mock.assertKey(input.SSECustomerAlgorithm, input.SSECustomerKey)
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(4), ETag: aws.String("\"etag\"")}, nil
+}
+
+func (mock *mockSSECustomerS3API) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	mock.assertKey(input.SSECustomerAlgorithm, input.SSECustomerKey)
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader([]byte("data")))}, nil
+}
+
+func (mock *mockSSECustomerS3API) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	mock.assertKey(input.SSECustomerAlgorithm, input.SSECustomerKey)
+	mock.assertKey(input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey)
+	assert.Equal(mock.t, "bucket/path/source%20file", aws.StringValue(input.CopySource))
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func TestConfigureSSECustomerKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, sseCustomerKeyLength)
+	algorithm, configuredKey, err := configureSSECustomerKey(map[string]string{
+		SseCustomerKeySetting: base64.StdEncoding.EncodeToString(key),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultSseCustomerAlgorithm, algorithm)
+	assert.Equal(t, string(key), configuredKey)
+
+	_, _, err = configureSSECustomerKey(map[string]string{
+		SseCustomerKeySetting: base64.StdEncoding.EncodeToString(key[1:]),
+	})
+	assert.Error(t, err)
+
+	_, _, err = configureSSECustomerKey(map[string]string{
+		SseCustomerKeySetting: base64.StdEncoding.EncodeToString(key),
+		SseSetting:            "AES256",
+	})
+	assert.Error(t, err)
+
+	algorithm, configuredKey, err = configureSSECustomerKey(map[string]string{})
+	assert.NoError(t, err)
+	assert.Empty(t, algorithm)
+	assert.Empty(t, configuredKey)
+}
+
+func TestSSECustomerKeyIsSentWithEveryRequest(t *testing.T) {
+	key := string(bytes.Repeat([]byte{7}, sseCustomerKeyLength))
+	uploader := NewUploader(nil, "", "", "STANDARD")
+	uploader.sseCustomerAlgorithm, uploader.sseCustomerKey = DefaultSseCustomerAlgorithm, key
+	mock := &mockSSECustomerS3API{t: t, key: key}
+
+	uploadInput := uploader.createUploadInput("bucket", "path/file", bytes.NewReader(nil))
+	assert.Equal(t, key, aws.StringValue(uploadInput.SSECustomerKey))
+
+	for _, parallelReadOptions := range []storage.ParallelReadOptions{{}, {ChunkSize: 2, Concurrency: 2, MemoryLimit: 4}} {
+		folder := NewFolderWithOptions(*uploader, mock, "bucket", "path", FolderOptions{ParallelRead: parallelReadOptions})
+		exists, err := folder.Exists("file")
+		assert.NoError(t, err)
+		assert.True(t, exists)
+		reader, err := folder.ReadObject("file")
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.NoError(t, reader.Close())
+		assert.NoError(t, folder.CopyObject("source file", "destination"))
+	}
+	_, err := NewFolder(*uploader, mock, "bucket", "path").SignedURL("file", http.MethodGet, time.Hour)
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+}
+
+func TestObjectLockIsSetOnUpload(t *testing.T) {
+	uploader := NewUploader(nil, "", "", "STANDARD")
+	var err error
+	uploader.objectLockMode, uploader.objectLockRetention, uploader.objectLockLegalHold, err = configureObjectLock(map[string]string{
+		ObjectLockModeSetting:      "compliance",
+		ObjectLockRetentionSetting: "720h",
+		ObjectLockLegalHoldSetting: "true",
+	})
+	assert.NoError(t, err)
+
+	uploadInput := uploader.createUploadInput("bucket", "path/file", bytes.NewReader(nil))
+	assert.Equal(t, s3.ObjectLockModeCompliance, aws.StringValue(uploadInput.ObjectLockMode))
+	assert.WithinDuration(t, time.Now().Add(720*time.Hour), aws.TimeValue(uploadInput.ObjectLockRetainUntilDate), time.Minute)
+	assert.Equal(t, s3.ObjectLockLegalHoldStatusOn, aws.StringValue(uploadInput.ObjectLockLegalHoldStatus))
+	assert.True(t, NewFolder(*uploader, nil, "bucket", "path").ObjectLockEnabled())
+
+	_, _, _, err = configureObjectLock(map[string]string{ObjectLockModeSetting: "GOVERNANCE"})
+	assert.Error(t, err)
+	_, _, _, err = configureObjectLock(map[string]string{ObjectLockModeSetting: "WEAK", ObjectLockRetentionSetting: "1h"})
+	assert.Error(t, err)
+
+	uploadInput = NewUploader(nil, "", "", "STANDARD").createUploadInput("bucket", "path/file", bytes.NewReader(nil))
+	assert.Nil(t, uploadInput.ObjectLockMode)
+	assert.Nil(t, uploadInput.ObjectLockRetainUntilDate)
+	assert.Nil(t, uploadInput.ObjectLockLegalHoldStatus)
+}
+
+// mockObjectLockS3API counts requests of the bucket Object Lock configuration
+type mockObjectLockS3API struct {
+	s3iface.S3API
+	enabled  bool
+	requests int
+}
+
+func (mock *mockObjectLockS3API) GetObjectLockConfiguration(
+	input *s3.GetObjectLockConfigurationInput) (*s3.GetObjectLockConfigurationOutput, error) {
+	mock.requests++
+	if !mock.enabled {
+		return nil, awserr.New(ObjectLockConfigurationNotFoundAWSErrorCode, "no configuration", nil)
+	}
+	return &s3.GetObjectLockConfigurationOutput{ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+		ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+	}}, nil
+}
+
+func TestObjectLockEnabledOnBucket(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		mock := &mockObjectLockS3API{enabled: enabled}
+		folder := NewFolder(*NewUploader(nil, "", "", "STANDARD"), mock, "bucket", "path")
+		assert.Equal(t, enabled, folder.ObjectLockEnabled())
+		assert.Equal(t, enabled, folder.GetSubFolder("sub").(*Folder).ObjectLockEnabled())
+		assert.Equal(t, 1, mock.requests)
+	}
+}
+
+// mockUploaderAPI records upload inputs without reading the content
+type mockUploaderAPI struct {
+	s3manageriface.UploaderAPI
+	inputs []*s3manager.UploadInput
+}
+
+func (mock *mockUploaderAPI) Upload(input *s3manager.UploadInput,
+	options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	mock.inputs = append(mock.inputs, input)
+	return &s3manager.UploadOutput{}, nil
+}
+
+// mockCopyS3API records copy inputs
+type mockCopyS3API struct {
+	s3iface.S3API
+	inputs []*s3.CopyObjectInput
+}
+
+func (mock *mockCopyS3API) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	mock.inputs = append(mock.inputs, input)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func TestStorageClassOfObject(t *testing.T) {
+	uploaderAPI := &mockUploaderAPI{}
+	s3API := &mockCopyS3API{}
+	folder := NewFolder(*NewUploader(uploaderAPI, "", "", "STANDARD"), s3API, "bucket", "path")
+
+	assert.NoError(t, folder.PutObject("default", bytes.NewReader(nil)))
+	assert.NoError(t, storage.PutObjectWithStorageClass(folder, "cold", bytes.NewReader(nil), "STANDARD_IA"))
+	assert.Equal(t, 2, len(uploaderAPI.inputs))
+	assert.Equal(t, "STANDARD", aws.StringValue(uploaderAPI.inputs[0].StorageClass))
+	assert.Equal(t, "STANDARD_IA", aws.StringValue(uploaderAPI.inputs[1].StorageClass))
+
+	assert.NoError(t, storage.SetStorageClass(folder, "old backup", s3.StorageClassGlacier))
+	assert.Equal(t, 1, len(s3API.inputs))
+	assert.Equal(t, "bucket/path/old%20backup", aws.StringValue(s3API.inputs[0].CopySource))
+	assert.Equal(t, "path/old backup", aws.StringValue(s3API.inputs[0].Key))
+	assert.Equal(t, s3.StorageClassGlacier, aws.StringValue(s3API.inputs[0].StorageClass))
+}
+
+func TestPutObjectWithOptions(t *testing.T) {
+	uploaderAPI := &mockUploaderAPI{}
+	folder := NewFolder(*NewUploader(uploaderAPI, "", "", "STANDARD"), nil, "bucket", "path")
+
+	err := folder.PutObjectWithOptions("sentinel.json", bytes.NewReader(nil), storage.PutOptions{
+		ContentType: "application/json",
+		Metadata:    map[string]string{"backup-name": "base_123"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(uploaderAPI.inputs))
+	assert.Equal(t, "application/json", aws.StringValue(uploaderAPI.inputs[0].ContentType))
+	assert.Nil(t, uploaderAPI.inputs[0].CacheControl)
+	assert.Equal(t, "base_123", aws.StringValue(uploaderAPI.inputs[0].Metadata["backup-name"]))
+}
@@ -0,0 +1,105 @@
+package s3
+
+import (
+	"io"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/tinsane/storages/storage"
+)
+
+const (
+	// Reading a version fails with these codes if there is no such version or it is a delete marker
+	NoSuchVersionAWSErrorCode    = "NoSuchVersion"
+	MethodNotAllowedAWSErrorCode = "MethodNotAllowed"
+)
+
+// ListObjectVersions lists versions and delete markers of the key, the bucket must have versioning enabled
+func (folder *Folder) ListObjectVersions(objectRelativePath string) ([]storage.ObjectVersion, error) {
+	objectPath := folder.Path + objectRelativePath
+	input := &s3.ListObjectVersionsInput{
+		Bucket: folder.Bucket,
+		Prefix: aws.String(objectPath),
+	}
+	var versions []storage.ObjectVersion
+	err := folder.S3API.ListObjectVersionsPages(input, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		morePages := true
+		for _, version := range page.Versions {
+			if aws.StringValue(version.Key) != objectPath {
+				// Listed keys start with the key and are sorted, so versions of the key can not follow longer ones
+				morePages = false
+				continue
+			}
+			versions = append(versions, storage.ObjectVersion{
+				ObjectRelativePath: objectRelativePath,
+				VersionID:          aws.StringValue(version.VersionId),
+				IsLatest:           aws.BoolValue(version.IsLatest),
+				LastModified:       aws.TimeValue(version.LastModified),
+				Size:               aws.Int64Value(version.Size),
+			})
+		}
+		for _, marker := range page.DeleteMarkers {
+			if aws.StringValue(marker.Key) != objectPath {
+				morePages = false
+				continue
+			}
+			versions = append(versions, storage.ObjectVersion{
+				ObjectRelativePath: objectRelativePath,
+				VersionID:          aws.StringValue(marker.VersionId),
+				IsLatest:           aws.BoolValue(marker.IsLatest),
+				IsDeleteMarker:     true,
+				LastModified:       aws.TimeValue(marker.LastModified),
+			})
+		}
+		return morePages
+	})
+	if err != nil {
+		return nil, NewFolderError(err, "Unable to list versions of %v", objectPath)
+	}
+	// Versions and delete markers are listed separately
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].IsLatest != versions[j].IsLatest {
+			return versions[i].IsLatest
+		}
+		return versions[i].LastModified.After(versions[j].LastModified)
+	})
+	return versions, nil
+}
+
+func (folder *Folder) ReadObjectVersion(objectRelativePath, versionID string) (io.ReadCloser, error) {
+	objectPath := folder.Path + objectRelativePath
+	input := folder.createGetObjectInput(objectPath)
+	input.VersionId = aws.String(versionID)
+	reader, err := folder.getObject(input)
+	if awsErr, ok := errors.Cause(err).(awserr.Error); ok &&
+		(awsErr.Code() == NoSuchVersionAWSErrorCode || awsErr.Code() == MethodNotAllowedAWSErrorCode) {
+		return nil, storage.NewObjectNotFoundError(objectPath + "?versionId=" + versionID)
+	}
+	return reader, err
+}
+
+// DeleteObjectVersions deletes versions permanently, deletion of a delete marker makes the object visible again
+func (folder *Folder) DeleteObjectVersions(versions []storage.ObjectVersion) error {
+	var failures []storage.DeleteFailure
+	for start := 0; start < len(versions); start += 1000 {
+		end := start + 1000
+		if end > len(versions) {
+			end = len(versions)
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, version := range versions[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{
+				Key:       aws.String(folder.Path + version.ObjectRelativePath),
+				VersionId: aws.String(version.VersionID),
+			})
+		}
+		failures = append(failures, folder.deleteObjectsPart(objects)...)
+	}
+	if len(failures) > 0 {
+		return storage.NewDeleteObjectsError("S3", failures)
+	}
+	return nil
+}
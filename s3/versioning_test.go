@@ -0,0 +1,72 @@
+package s3
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/storage"
+)
+
+type mockVersionsS3API struct {
+	s3iface.S3API
+	deleteInputs []*s3.DeleteObjectsInput
+}
+
+func (mock *mockVersionsS3API) ListObjectVersionsPages(input *s3.ListObjectVersionsInput,
+	fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fn(&s3.ListObjectVersionsOutput{
+		Versions: []*s3.ObjectVersion{
+			{Key: aws.String("path/a"), VersionId: aws.String("v2"), IsLatest: aws.Bool(false),
+				LastModified: aws.Time(created.Add(time.Hour)), Size: aws.Int64(2)},
+			{Key: aws.String("path/a"), VersionId: aws.String("v1"), IsLatest: aws.Bool(false),
+				LastModified: aws.Time(created), Size: aws.Int64(1)},
+			{Key: aws.String("path/ab"), VersionId: aws.String("v3"), IsLatest: aws.Bool(true),
+				LastModified: aws.Time(created), Size: aws.Int64(3)},
+		},
+		DeleteMarkers: []*s3.DeleteMarkerEntry{
+			{Key: aws.String("path/a"), VersionId: aws.String("m1"), IsLatest: aws.Bool(true),
+				LastModified: aws.Time(created.Add(2 * time.Hour))},
+		},
+	}, true)
+	return nil
+}
+
+func (mock *mockVersionsS3API) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return nil, awserr.New(MethodNotAllowedAWSErrorCode, "The specified method is not allowed against this resource", nil)
+}
+
+func (mock *mockVersionsS3API) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	mock.deleteInputs = append(mock.deleteInputs, input)
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func TestS3FolderObjectVersions(t *testing.T) {
+	mock := &mockVersionsS3API{}
+	folder := NewFolder(Uploader{}, mock, "bucket", "path/")
+
+	versions, err := folder.ListObjectVersions("a")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(versions))
+	assert.Equal(t, "m1", versions[0].VersionID)
+	assert.True(t, versions[0].IsLatest)
+	assert.True(t, versions[0].IsDeleteMarker)
+	assert.Equal(t, "v2", versions[1].VersionID)
+	assert.Equal(t, "v1", versions[2].VersionID)
+	assert.Equal(t, int64(1), versions[2].Size)
+
+	_, err = folder.ReadObjectVersion("a", "m1")
+	assert.IsType(t, storage.ObjectNotFoundError{}, err)
+
+	assert.NoError(t, folder.DeleteObjectVersions(versions[:1]))
+	assert.Equal(t, 1, len(mock.deleteInputs))
+	deleted := mock.deleteInputs[0].Delete.Objects
+	assert.Equal(t, 1, len(deleted))
+	assert.Equal(t, "path/a", aws.StringValue(deleted[0].Key))
+	assert.Equal(t, "m1", aws.StringValue(deleted[0].VersionId))
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/tinsane/tracelog"
+)
+
+// PutCondition protects the object from being overwritten by concurrent writers, only one of conditions is expected
+type PutCondition struct {
+	// IfNoneMatch creates the object only if it does not exist yet
+	IfNoneMatch bool
+	// IfMatch overwrites the object only if its version is still the one returned by StatObject
+	IfMatch string
+}
+
+// ConditionalPutter is implemented by folders which can check the object version and write it atomically
+type ConditionalPutter interface {
+	// PutObjectWithCondition returns the version of the written object, which is the one returned by StatObject.
+	// It should return PreconditionFailedError if the condition is not met
+	PutObjectWithCondition(name string, content io.Reader, condition PutCondition) (version string, err error)
+}
+
+// PreconditionFailedError is returned by conditional writes if the object was created or changed concurrently
+type PreconditionFailedError struct {
+	error
+}
+
+func NewPreconditionFailedError(path string) PreconditionFailedError {
+	return PreconditionFailedError{errors.Errorf("precondition failed for object '%s', it was changed concurrently", path)}
+}
+
+func (err PreconditionFailedError) Error() string {
+	return fmt.Sprintf(tracelog.GetErrorFormatter(), err.error)
+}
+
+// PutObjectWithCondition returns UnsupportedOperationError if the folder can not write objects conditionally
+func PutObjectWithCondition(folder Folder, name string, content io.Reader, condition PutCondition) (string, error) {
+	putter, ok := folder.(ConditionalPutter)
+	if !ok {
+		return "", NewUnsupportedOperationError("this", "conditional writes")
+	}
+	return putter.PutObjectWithCondition(name, content, condition)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/tinsane/tracelog"
+	"strings"
 )
 
 type ObjectNotFoundError struct {
@@ -29,3 +30,51 @@ func NewError(err error, storageName, format string, args ...interface{}) Error
 func (err Error) Error() string {
 	return fmt.Sprintf(tracelog.GetErrorFormatter(), err.error)
 }
+
+// UnsupportedOperationError is returned by optional operations which the storage can not perform
+type UnsupportedOperationError struct {
+	error
+}
+
+func NewUnsupportedOperationError(storageName, operation string) UnsupportedOperationError {
+	return UnsupportedOperationError{errors.Errorf("%s storage does not support %s", storageName, operation)}
+}
+
+func (err UnsupportedOperationError) Error() string {
+	return fmt.Sprintf(tracelog.GetErrorFormatter(), err.error)
+}
+
+// maxReportedDeleteFailures limits the length of DeleteObjectsError message
+const maxReportedDeleteFailures = 10
+
+// DeleteFailure describes why an object was not deleted
+type DeleteFailure struct {
+	ObjectRelativePath string
+	Err                error
+}
+
+// DeleteObjectsError is returned when some of objects were not deleted, other objects are deleted anyway
+type DeleteObjectsError struct {
+	error
+	Failures []DeleteFailure
+}
+
+// NewDeleteObjectsError lists only the first failures in the message, all of them are kept in Failures
+func NewDeleteObjectsError(storageName string, failures []DeleteFailure) DeleteObjectsError {
+	reasons := make([]string, 0, maxReportedDeleteFailures+1)
+	for i, failure := range failures {
+		if i == maxReportedDeleteFailures {
+			reasons = append(reasons, fmt.Sprintf("and %d more", len(failures)-i))
+			break
+		}
+		reasons = append(reasons, fmt.Sprintf("'%s': %v", failure.ObjectRelativePath, failure.Err))
+	}
+	return DeleteObjectsError{
+		errors.Errorf("%s error : failed to delete %d objects: %s", storageName, len(failures), strings.Join(reasons, "; ")),
+		failures,
+	}
+}
+
+func (err DeleteObjectsError) Error() string {
+	return fmt.Sprintf(tracelog.GetErrorFormatter(), err.error)
+}
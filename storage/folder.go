@@ -46,10 +46,28 @@ func DeleteObjectsWhere(folder Folder, confirm bool, filter func(object1 Object)
 	if len(filteredRelativePaths) == 0 {
 		return nil
 	}
+	filteredRelativePaths, lockedRelativePaths, err := filterLockedObjects(folder, filteredRelativePaths)
+	if err != nil {
+		return err
+	}
 	if confirm {
-		return folder.DeleteObjects(filteredRelativePaths)
+		if len(filteredRelativePaths) > 0 {
+			err = folder.DeleteObjects(filteredRelativePaths)
+			if err != nil {
+				return err
+			}
+		}
 	} else {
 		tracelog.InfoLogger.Println("Dry run, nothing were deleted")
+		// Dry run does not fail on locked objects, they are reported as objects which would be kept
+		for _, lockedRelativePath := range lockedRelativePaths {
+			tracelog.InfoLogger.Println("\twill be kept as locked: " + lockedRelativePath)
+		}
+		return nil
+	}
+	// Locked objects are reported after others are deleted, so callers may treat it as a warning
+	if len(lockedRelativePaths) > 0 {
+		return NewObjectLockedError(lockedRelativePaths)
 	}
 	return nil
 }
@@ -6,7 +6,10 @@ import (
 	"github.com/tinsane/storages/memory"
 	"github.com/tinsane/storages/storage"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestListFolderRecursively(t *testing.T) {
@@ -63,3 +66,121 @@ func TestDeleteOldObjects(t *testing.T) {
 	assert.Equal(t, 1, len(savedObjects))
 	assert.Equal(t, expectedOnlyOneSavedObjectName, savedObjects[0].GetName())
 }
+
+// lockingFolder reports objects with given names as locked
+type lockingFolder struct {
+	storage.Folder
+	locks map[string]storage.ObjectLock
+}
+
+func (folder *lockingFolder) ObjectLockEnabled() bool {
+	return true
+}
+
+func (folder *lockingFolder) GetObjectLock(objectRelativePath string) (storage.ObjectLock, error) {
+	return folder.locks[objectRelativePath], nil
+}
+
+func TestDeleteObjectsWhereSkipsLockedObjects(t *testing.T) {
+	folder := &lockingFolder{CreateMockStorageFolder(), map[string]storage.ObjectLock{
+		"basebackups_005/base_123312":                        {Mode: "COMPLIANCE", RetainUntil: time.Now().Add(time.Hour)},
+		"basebackups_005/base_321/nop":                       {LegalHold: true},
+		"basebackups_005/base_456/tar_partitions/1":          {Mode: "GOVERNANCE", RetainUntil: time.Now().Add(-time.Hour)},
+		"basebackups_005/base_000_backup_stop_sentinel.json": {},
+	}}
+	err := storage.DeleteObjectsWhere(folder, true, func(object storage.Object) bool {
+		return true
+	})
+	lockedErr, ok := err.(storage.ObjectLockedError)
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []string{"basebackups_005/base_123312", "basebackups_005/base_321/nop"}, lockedErr.LockedObjects)
+
+	savedObjects, err := storage.ListFolderRecursively(folder)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(savedObjects))
+
+	// Dry run reports locked objects without failing
+	err = storage.DeleteObjectsWhere(folder, false, func(object storage.Object) bool {
+		return true
+	})
+	assert.NoError(t, err)
+}
+
+// archivingFolder keeps objects archived until restore was requested and status was checked pollsToRestore times
+type archivingFolder struct {
+	storage.Folder
+	pollsToRestore int
+	restores       map[string]int
+}
+
+func (folder *archivingFolder) RestoreObject(objectRelativePath string, days int64, tier string) error {
+	folder.restores[objectRelativePath] = folder.pollsToRestore
+	return nil
+}
+
+func (folder *archivingFolder) GetRestoreStatus(objectRelativePath string) (storage.RestoreStatus, error) {
+	polls, ok := folder.restores[objectRelativePath]
+	if !ok {
+		return storage.RestoreStatus{Archived: true}, nil
+	}
+	if polls > 0 {
+		folder.restores[objectRelativePath] = polls - 1
+		return storage.RestoreStatus{Archived: true, InProgress: true}, nil
+	}
+	return storage.RestoreStatus{Archived: true, RestoredUntil: time.Now().Add(time.Hour)}, nil
+}
+
+func TestRestoreFolder(t *testing.T) {
+	folder := &archivingFolder{CreateMockStorageFolder(), 2, make(map[string]int)}
+	err := storage.RestoreFolder(folder, 1, "", time.Millisecond)
+	assert.NoError(t, err)
+	objects, err := storage.ListFolderRecursively(folder)
+	assert.NoError(t, err)
+	assert.Equal(t, len(objects), len(folder.restores))
+	for _, object := range objects {
+		status, err := folder.GetRestoreStatus(object.GetName())
+		assert.NoError(t, err)
+		assert.True(t, status.IsReadable())
+	}
+
+	err = storage.RestoreFolder(CreateMockStorageFolder(), 1, "", time.Millisecond)
+	_, ok := err.(storage.UnsupportedOperationError)
+	assert.True(t, ok)
+}
+
+func TestPutObjectWithCondition(t *testing.T) {
+	folder := memory.NewFolder("in_memory/", memory.NewStorage())
+
+	var created int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := storage.PutObjectWithCondition(folder, "sentinel", strings.NewReader("{}"),
+				storage.PutCondition{IfNoneMatch: true})
+			if err == nil {
+				atomic.AddInt32(&created, 1)
+			} else {
+				assert.IsType(t, storage.PreconditionFailedError{}, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), created)
+
+	attributes, err := storage.StatObject(folder, "sentinel")
+	assert.NoError(t, err)
+	version, err := folder.PutObjectWithCondition("sentinel", strings.NewReader("{\"v\": 2}"),
+		storage.PutCondition{IfMatch: attributes.Version})
+	assert.NoError(t, err)
+	written, err := storage.StatObject(folder, "sentinel")
+	assert.NoError(t, err)
+	assert.Equal(t, written.Version, version)
+	_, err = folder.PutObjectWithCondition("sentinel", strings.NewReader("{\"v\": 3}"),
+		storage.PutCondition{IfMatch: attributes.Version})
+	assert.IsType(t, storage.PreconditionFailedError{}, err)
+	_, err = folder.PutObjectWithCondition("missing", strings.NewReader("{}"),
+		storage.PutCondition{IfMatch: attributes.Version})
+	assert.IsType(t, storage.PreconditionFailedError{}, err)
+}
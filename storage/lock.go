@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tinsane/tracelog"
+)
+
+// Lock guards a prefix from concurrent runners. It is held until TTL passes, unless it is renewed or released.
+// Expiry is computed by the clock of the holder, so TTL must be much bigger than the clock skew between runners
+type Lock interface {
+	// Acquire takes the free or expired lock, LockHeldError is returned if it is held by another owner
+	Acquire() error
+	// Renew extends the lock for TTL from now, LockLostError is returned if it has expired and was taken by another owner
+	Renew() error
+	Release() error
+}
+
+// NativeLocker is implemented by folders which have native locks, they are used instead of lock objects
+type NativeLocker interface {
+	NewLock(name, owner string, ttl time.Duration) (Lock, error)
+}
+
+// LockHeldError is returned on acquire of the lock held by another owner
+type LockHeldError struct {
+	error
+	Owner string
+	// ExpiresAt is zero if the storage does not tell when the lock expires
+	ExpiresAt time.Time
+}
+
+func NewLockHeldError(name, owner string, expiresAt time.Time) LockHeldError {
+	return LockHeldError{errors.Errorf("lock '%s' is held by '%s'", name, owner), owner, expiresAt}
+}
+
+func (err LockHeldError) Error() string {
+	return fmt.Sprintf(tracelog.GetErrorFormatter(), err.error)
+}
+
+// LockLostError is returned if the lock has expired and was taken by another owner meanwhile
+type LockLostError struct {
+	error
+}
+
+func NewLockLostError(name string) LockLostError {
+	return LockLostError{errors.Errorf("lock '%s' is lost, it has expired and was taken by another owner", name)}
+}
+
+func (err LockLostError) Error() string {
+	return fmt.Sprintf(tracelog.GetErrorFormatter(), err.error)
+}
+
+// NewLock returns native lock of the folder if it has one, otherwise the lock is the object with given name,
+// which is replaced by conditional writes. Owner must be unique for every runner
+func NewLock(folder Folder, name, owner string, ttl time.Duration) (Lock, error) {
+	if locker, ok := folder.(NativeLocker); ok {
+		lock, err := locker.NewLock(name, owner, ttl)
+		// Wrapping folders are lockers even if the wrapped folder has no native locks
+		if _, unsupported := err.(UnsupportedOperationError); !unsupported {
+			return lock, err
+		}
+	}
+	putter, ok := folder.(ConditionalPutter)
+	if !ok {
+		return nil, NewUnsupportedOperationError("this", "locks")
+	}
+	keeper, ok := folder.(ObjectAttributesKeeper)
+	if !ok {
+		return nil, NewUnsupportedOperationError("this", "locks")
+	}
+	return &conditionalLock{folder, putter, keeper, name, owner, ttl, ""}, nil
+}
+
+// NewNativeLock returns UnsupportedOperationError if the folder has no native locks
+func NewNativeLock(folder Folder, name, owner string, ttl time.Duration) (Lock, error) {
+	locker, ok := folder.(NativeLocker)
+	if !ok {
+		return nil, NewUnsupportedOperationError("this", "native locks")
+	}
+	return locker.NewLock(name, owner, ttl)
+}
+
+// lockRecord is the content of the lock object
+type lockRecord struct {
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type conditionalLock struct {
+	folder Folder
+	putter ConditionalPutter
+	keeper ObjectAttributesKeeper
+	name   string
+	owner  string
+	ttl    time.Duration
+	// version of the lock object written by this owner, empty if the lock is not held
+	version string
+}
+
+func (lock *conditionalLock) Acquire() error {
+	record, version, err := lock.readRecord()
+	if _, ok := err.(ObjectNotFoundError); ok {
+		return lock.write(PutCondition{IfNoneMatch: true})
+	}
+	if err != nil {
+		return err
+	}
+	if record.Owner != lock.owner && record.ExpiresAt.After(time.Now()) {
+		return NewLockHeldError(lock.name, record.Owner, record.ExpiresAt)
+	}
+	// Released lock has zero expiry
+	if record.Owner != lock.owner && !record.ExpiresAt.IsZero() {
+		tracelog.InfoLogger.Printf("Lock %s of %s expired at %v, taking it\n", lock.name, record.Owner, record.ExpiresAt)
+	}
+	return lock.write(PutCondition{IfMatch: version})
+}
+
+func (lock *conditionalLock) Renew() error {
+	if lock.version == "" {
+		return NewLockLostError(lock.name)
+	}
+	return lock.write(PutCondition{IfMatch: lock.version})
+}
+
+// Release expires the lock instead of deleting it, because deletion can not be conditional
+func (lock *conditionalLock) Release() error {
+	if lock.version == "" {
+		return nil
+	}
+	_, err := lock.putRecord(lockRecord{Owner: lock.owner}, PutCondition{IfMatch: lock.version})
+	lock.version = ""
+	if _, ok := err.(PreconditionFailedError); ok {
+		return NewLockLostError(lock.name)
+	}
+	return err
+}
+
+// readRecord reads version before content, so content may only be newer and writes with this version fail then
+func (lock *conditionalLock) readRecord() (record lockRecord, version string, err error) {
+	attributes, err := lock.keeper.StatObject(lock.name)
+	if err != nil {
+		return lockRecord{}, "", err
+	}
+	reader, err := lock.folder.ReadObject(lock.name)
+	if err != nil {
+		return lockRecord{}, "", err
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return lockRecord{}, "", errors.Wrapf(err, "failed to read lock '%s'", lock.name)
+	}
+	err = json.Unmarshal(content, &record)
+	if err != nil {
+		return lockRecord{}, "", errors.Wrapf(err, "failed to parse lock '%s'", lock.name)
+	}
+	return record, attributes.Version, nil
+}
+
+func (lock *conditionalLock) write(condition PutCondition) error {
+	renewing := lock.version != "" && condition.IfMatch == lock.version
+	record := lockRecord{Owner: lock.owner, ExpiresAt: time.Now().Add(lock.ttl)}
+	version, err := lock.putRecord(record, condition)
+	if _, ok := err.(PreconditionFailedError); ok {
+		lock.version = ""
+		if renewing {
+			return NewLockLostError(lock.name)
+		}
+		// Another owner has taken the lock between read and write
+		record, _, err := lock.readRecord()
+		if err != nil {
+			return err
+		}
+		return NewLockHeldError(lock.name, record.Owner, record.ExpiresAt)
+	}
+	if err != nil {
+		return err
+	}
+	lock.version = version
+	return nil
+}
+
+func (lock *conditionalLock) putRecord(record lockRecord, condition PutCondition) (version string, err error) {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to marshal lock '%s'", lock.name)
+	}
+	return lock.putter.PutObjectWithCondition(lock.name, bytes.NewReader(content), condition)
+}
@@ -0,0 +1,65 @@
+package storage_test
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/memory"
+	"github.com/tinsane/storages/storage"
+)
+
+func TestLockIsHeldByOneOwner(t *testing.T) {
+	folder := memory.NewFolder("in_memory/", memory.NewStorage())
+
+	var holders, acquisitions int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		lock, err := storage.NewLock(folder, "lock", fmt.Sprintf("runner%d", i), time.Minute)
+		assert.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for attempt := 0; attempt < 50; attempt++ {
+				err := lock.Acquire()
+				if _, ok := err.(storage.LockHeldError); ok {
+					continue
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, int32(1), atomic.AddInt32(&holders, 1))
+				atomic.AddInt32(&acquisitions, 1)
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+				assert.NoError(t, lock.Release())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.True(t, acquisitions > 0)
+}
+
+func TestLockIsStolenAfterExpiry(t *testing.T) {
+	folder := memory.NewFolder("in_memory/", memory.NewStorage())
+	first, err := storage.NewLock(folder, "lock", "first", 10*time.Millisecond)
+	assert.NoError(t, err)
+	second, err := storage.NewLock(folder, "lock", "second", time.Minute)
+	assert.NoError(t, err)
+
+	assert.NoError(t, first.Acquire())
+	assert.NoError(t, first.Renew())
+	err = second.Acquire()
+	assert.IsType(t, storage.LockHeldError{}, err)
+	assert.Equal(t, "first", err.(storage.LockHeldError).Owner)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, second.Acquire())
+	assert.IsType(t, storage.LockLostError{}, first.Renew())
+	assert.IsType(t, storage.LockHeldError{}, first.Acquire())
+	assert.NoError(t, second.Renew())
+
+	assert.NoError(t, second.Release())
+	assert.NoError(t, first.Acquire())
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"io"
+	"time"
+)
+
+// PutOptions are stored with the object and returned by the storage on download
+type PutOptions struct {
+	ContentType     string
+	ContentEncoding string
+	CacheControl    string
+	// Metadata keys are case insensitive, storages may return them in a different case
+	Metadata map[string]string
+
+	// Options below apply to the upload only, they are not stored with the object
+
+	// StorageClass overrides the storage class configured for the folder, it is ignored by folders without classes
+	StorageClass string `json:"-"`
+	// Condition is checked atomically with the write, folders which can not check it return UnsupportedOperationError
+	Condition *PutCondition `json:"-"`
+	// Progress counts bytes sent to the storage, the caller finishes it after the upload
+	Progress *ProgressTracker `json:"-"`
+}
+
+// ObjectAttributes are returned by stat of the object
+type ObjectAttributes struct {
+	PutOptions
+	Size         int64
+	LastModified time.Time
+	// Version changes on every write, it is ETag or generation of the object depending on the storage
+	Version string
+}
+
+// ObjectAttributesKeeper is implemented by folders which can store content type, cache control and user metadata of objects
+type ObjectAttributesKeeper interface {
+	PutObjectWithOptions(name string, content io.Reader, options PutOptions) error
+	// StatObject should return ObjectNotFoundError in case, there is no such object
+	StatObject(objectRelativePath string) (ObjectAttributes, error)
+}
+
+// PutObjectWithOptions returns UnsupportedOperationError if the folder can not store object attributes
+func PutObjectWithOptions(folder Folder, name string, content io.Reader, options PutOptions) error {
+	keeper, ok := folder.(ObjectAttributesKeeper)
+	if !ok {
+		return NewUnsupportedOperationError("this", "object attributes")
+	}
+	return keeper.PutObjectWithOptions(name, content, options)
+}
+
+// StatObject returns UnsupportedOperationError if the folder can not store object attributes
+func StatObject(folder Folder, objectRelativePath string) (ObjectAttributes, error) {
+	keeper, ok := folder.(ObjectAttributesKeeper)
+	if !ok {
+		return ObjectAttributes{}, NewUnsupportedOperationError("this", "object attributes")
+	}
+	return keeper.StatObject(objectRelativePath)
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tinsane/tracelog"
+)
+
+// lockCheckConcurrency limits the number of concurrent requests for locks of objects
+const lockCheckConcurrency = 16
+
+// ObjectLock describes protection of an object from deletion
+type ObjectLock struct {
+	// Mode is storage specific, e.g. GOVERNANCE or COMPLIANCE for S3. Empty if there is no retention
+	Mode        string
+	RetainUntil time.Time
+	LegalHold   bool
+}
+
+func (lock ObjectLock) IsLocked(now time.Time) bool {
+	return lock.LegalHold || lock.RetainUntil.After(now)
+}
+
+func (lock ObjectLock) String() string {
+	if lock.LegalHold {
+		return "under legal hold"
+	}
+	return "locked in " + lock.Mode + " mode until " + lock.RetainUntil.Format(time.RFC3339)
+}
+
+// ObjectLockGetter is implemented by folders which can protect objects from deletion
+type ObjectLockGetter interface {
+	// ObjectLockEnabled is false if objects of the folder are not expected to be locked, so locks are not checked
+	ObjectLockEnabled() bool
+	GetObjectLock(objectRelativePath string) (ObjectLock, error)
+}
+
+// ObjectLockEnabled is false if the folder can not protect objects from deletion
+func ObjectLockEnabled(folder Folder) bool {
+	lockGetter, ok := folder.(ObjectLockGetter)
+	return ok && lockGetter.ObjectLockEnabled()
+}
+
+// GetObjectLock returns UnsupportedOperationError if the folder can not protect objects from deletion
+func GetObjectLock(folder Folder, objectRelativePath string) (ObjectLock, error) {
+	lockGetter, ok := folder.(ObjectLockGetter)
+	if !ok {
+		return ObjectLock{}, NewUnsupportedOperationError("this", "object locks")
+	}
+	return lockGetter.GetObjectLock(objectRelativePath)
+}
+
+// ObjectLockedError lists objects which were not deleted because they are locked
+type ObjectLockedError struct {
+	error
+	LockedObjects []string
+}
+
+func NewObjectLockedError(lockedObjects []string) ObjectLockedError {
+	return ObjectLockedError{
+		errors.Errorf("objects are locked and can not be deleted: %s", strings.Join(lockedObjects, ", ")),
+		lockedObjects,
+	}
+}
+
+func (err ObjectLockedError) Error() string {
+	return fmt.Sprintf(tracelog.GetErrorFormatter(), err.error)
+}
+
+// filterLockedObjects splits objects of the folder into locked and deletable ones, locks are requested concurrently
+func filterLockedObjects(folder Folder, objectRelativePaths []string) (deletable, locked []string, err error) {
+	if !ObjectLockEnabled(folder) {
+		return objectRelativePaths, nil, nil
+	}
+	lockGetter := folder.(ObjectLockGetter)
+	locks := make([]ObjectLock, len(objectRelativePaths))
+	lockErrors := make([]error, len(objectRelativePaths))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < lockCheckConcurrency && worker < len(objectRelativePaths); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				locks[i], lockErrors[i] = lockGetter.GetObjectLock(objectRelativePaths[i])
+			}
+		}()
+	}
+	for i := range objectRelativePaths {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	now := time.Now()
+	for i, objectRelativePath := range objectRelativePaths {
+		if lockErrors[i] != nil {
+			return nil, nil, lockErrors[i]
+		}
+		if locks[i].IsLocked(now) {
+			tracelog.InfoLogger.Printf("\t%s: %s\n", locks[i], objectRelativePath)
+			locked = append(locked, objectRelativePath)
+		} else {
+			deletable = append(deletable, objectRelativePath)
+		}
+	}
+	return deletable, locked, nil
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultDownloadChunkSize = 8 << 20
+)
+
+// RangeReader opens byte range [offset, offset + length) of an object
+type RangeReader func(offset, length int64) (io.ReadCloser, error)
+
+// ParallelReadOptions control downloading of an object by concurrent range requests.
+// Chunks which are downloaded but not read yet are kept in memory, MemoryLimit bounds their total size
+type ParallelReadOptions struct {
+	ChunkSize   int64
+	Concurrency int
+	MemoryLimit int64
+}
+
+// Enabled tells whether objects should be downloaded in parallel at all
+func (options ParallelReadOptions) Enabled() bool {
+	return options.Concurrency > 1
+}
+
+// ConfigureParallelReadOptions parses download settings, parallel reads are disabled unless concurrency is set
+func ConfigureParallelReadOptions(settings map[string]string,
+	concurrencySetting, chunkSizeSetting, memoryLimitSetting string) (ParallelReadOptions, error) {
+	options := ParallelReadOptions{ChunkSize: DefaultDownloadChunkSize, Concurrency: 1}
+	var err error
+	if strConcurrency, ok := settings[concurrencySetting]; ok {
+		options.Concurrency, err = strconv.Atoi(strConcurrency)
+		if err != nil || options.Concurrency < 1 {
+			return ParallelReadOptions{}, errors.Errorf("invalid %s setting: '%s'", concurrencySetting, strConcurrency)
+		}
+	}
+	if strChunkSize, ok := settings[chunkSizeSetting]; ok {
+		options.ChunkSize, err = strconv.ParseInt(strChunkSize, 10, 64)
+		if err != nil || options.ChunkSize < 1 {
+			return ParallelReadOptions{}, errors.Errorf("invalid %s setting: '%s'", chunkSizeSetting, strChunkSize)
+		}
+	}
+	// By default every downloading chunk may have one more chunk waiting to be read
+	options.MemoryLimit = 2 * int64(options.Concurrency) * options.ChunkSize
+	if strMemoryLimit, ok := settings[memoryLimitSetting]; ok {
+		options.MemoryLimit, err = strconv.ParseInt(strMemoryLimit, 10, 64)
+		if err != nil || options.MemoryLimit < options.ChunkSize {
+			return ParallelReadOptions{}, errors.Errorf("invalid %s setting: '%s', it should be at least chunk size",
+				memoryLimitSetting, strMemoryLimit)
+		}
+	}
+	return options, nil
+}
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// parallelReader downloads chunks of an object concurrently and returns them in order
+type parallelReader struct {
+	chunks chan chan chunkResult
+	// Every chunk takes a slot from downloading start until it is read completely
+	memorySlots chan struct{}
+	done        chan struct{}
+	once        sync.Once
+	current     []byte
+	holdsSlot   bool
+	err         error
+}
+
+// NewParallelReader reads object of given size by chunks, fetching up to options.Concurrency chunks at a time
+func NewParallelReader(size int64, readRange RangeReader, options ParallelReadOptions) io.ReadCloser {
+	window := int(options.MemoryLimit / options.ChunkSize)
+	if window < 1 {
+		window = 1
+	}
+	concurrency := options.Concurrency
+	if concurrency > window {
+		concurrency = window
+	}
+	reader := &parallelReader{
+		chunks:      make(chan chan chunkResult, window),
+		memorySlots: make(chan struct{}, window),
+		done:        make(chan struct{}),
+	}
+	go reader.dispatch(size, readRange, options.ChunkSize, concurrency)
+	return reader
+}
+
+func (reader *parallelReader) dispatch(size int64, readRange RangeReader, chunkSize int64, concurrency int) {
+	defer close(reader.chunks)
+	downloadSlots := make(chan struct{}, concurrency)
+	for offset := int64(0); offset < size; offset += chunkSize {
+		length := chunkSize
+		if offset+length > size {
+			length = size - offset
+		}
+		// Blocks while the memory limit is reached by chunks waiting to be read
+		select {
+		case reader.memorySlots <- struct{}{}:
+		case <-reader.done:
+			return
+		}
+		select {
+		case downloadSlots <- struct{}{}:
+		case <-reader.done:
+			return
+		}
+		result := make(chan chunkResult, 1)
+		go func(offset, length int64) {
+			defer func() { <-downloadSlots }()
+			data, err := readChunk(readRange, offset, length)
+			result <- chunkResult{data, err}
+		}(offset, length)
+		// Never blocks, there are no more chunks than memory slots
+		reader.chunks <- result
+	}
+}
+
+func readChunk(readRange RangeReader, offset, length int64) ([]byte, error) {
+	rangeReader, err := readRange(offset, length)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open range [%d, %d)", offset, offset+length)
+	}
+	defer rangeReader.Close()
+	data := make([]byte, length)
+	_, err = io.ReadFull(rangeReader, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read range [%d, %d)", offset, offset+length)
+	}
+	return data, nil
+}
+
+func (reader *parallelReader) Read(p []byte) (int, error) {
+	for len(reader.current) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		if reader.holdsSlot {
+			<-reader.memorySlots
+			reader.holdsSlot = false
+		}
+		result, ok := <-reader.chunks
+		if !ok {
+			reader.err = io.EOF
+			continue
+		}
+		chunk := <-result
+		reader.current, reader.err, reader.holdsSlot = chunk.data, chunk.err, true
+	}
+	n := copy(p, reader.current)
+	reader.current = reader.current[n:]
+	return n, nil
+}
+
+// Close stops scheduling new chunks, chunks being downloaded are dropped when finished
+func (reader *parallelReader) Close() error {
+	reader.once.Do(func() {
+		close(reader.done)
+	})
+	return nil
+}
@@ -0,0 +1,74 @@
+package storage_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/storage"
+)
+
+func TestParallelReaderReadsChunksInOrder(t *testing.T) {
+	content := make([]byte, 100*1024+17)
+	rand.Read(content)
+	options := storage.ParallelReadOptions{ChunkSize: 1024, Concurrency: 4, MemoryLimit: 8 * 1024}
+
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	readRange := func(offset, length int64) (io.ReadCloser, error) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		}()
+		return ioutil.NopCloser(bytes.NewReader(content[offset : offset+length])), nil
+	}
+
+	reader := storage.NewParallelReader(int64(len(content)), readRange, options)
+	all, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, content, all)
+	assert.True(t, maxRunning <= options.Concurrency)
+}
+
+func TestParallelReaderReturnsRangeError(t *testing.T) {
+	rangeErr := errors.New("range failed")
+	readRange := func(offset, length int64) (io.ReadCloser, error) {
+		if offset >= 2048 {
+			return nil, rangeErr
+		}
+		return ioutil.NopCloser(bytes.NewReader(make([]byte, length))), nil
+	}
+
+	reader := storage.NewParallelReader(10*1024, readRange, storage.ParallelReadOptions{ChunkSize: 1024, Concurrency: 2, MemoryLimit: 2048})
+	all, err := ioutil.ReadAll(reader)
+	assert.Error(t, err)
+	assert.Equal(t, 2048, len(all))
+	assert.NoError(t, reader.Close())
+}
+
+func TestConfigureParallelReadOptions(t *testing.T) {
+	options, err := storage.ConfigureParallelReadOptions(map[string]string{}, "CONCURRENCY", "CHUNK", "MEMORY")
+	assert.NoError(t, err)
+	assert.False(t, options.Enabled())
+
+	options, err = storage.ConfigureParallelReadOptions(map[string]string{"CONCURRENCY": "4", "CHUNK": "1024"}, "CONCURRENCY", "CHUNK", "MEMORY")
+	assert.NoError(t, err)
+	assert.True(t, options.Enabled())
+	assert.Equal(t, storage.ParallelReadOptions{ChunkSize: 1024, Concurrency: 4, MemoryLimit: 8 * 1024}, options)
+
+	_, err = storage.ConfigureParallelReadOptions(map[string]string{"CHUNK": "1024", "MEMORY": "1000"}, "CONCURRENCY", "CHUNK", "MEMORY")
+	assert.Error(t, err)
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tinsane/tracelog"
+)
+
+// Progress of the transfer, Total is zero if the size is not known in advance
+type Progress struct {
+	Transferred int64
+	Total       int64
+	// Rate is the average number of bytes transferred per second since the start
+	Rate float64
+	// Done is true in the last report of the finished transfer
+	Done bool
+}
+
+type ProgressCallback func(progress Progress)
+
+// ProgressOptions are used by PutObjectWithProgress and ReadObjectWithProgress
+type ProgressOptions struct {
+	Callback ProgressCallback
+	// Interval is the minimal time between reports, every change is reported if it is zero
+	Interval time.Duration
+}
+
+// ProgressTracker counts transferred bytes and reports progress at most once in interval and at the end.
+// It is safe for concurrent use, so parts uploaded concurrently can be added to the same tracker
+type ProgressTracker struct {
+	options     ProgressOptions
+	mutex       sync.Mutex
+	total       int64
+	transferred int64
+	start       time.Time
+	lastReport  time.Time
+	done        bool
+}
+
+func NewProgressTracker(total int64, options ProgressOptions) *ProgressTracker {
+	now := time.Now()
+	return &ProgressTracker{options: options, total: total, start: now, lastReport: now}
+}
+
+func (tracker *ProgressTracker) Add(bytes int64) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.transferred += bytes
+	if time.Since(tracker.lastReport) >= tracker.options.Interval {
+		tracker.report()
+	}
+}
+
+// Finish reports the final progress once, further calls do nothing
+func (tracker *ProgressTracker) Finish() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if tracker.done {
+		return
+	}
+	tracker.done = true
+	tracker.report()
+}
+
+func (tracker *ProgressTracker) Progress() Progress {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.progress()
+}
+
+func (tracker *ProgressTracker) progress() Progress {
+	progress := Progress{Transferred: tracker.transferred, Total: tracker.total, Done: tracker.done}
+	if elapsed := time.Since(tracker.start).Seconds(); elapsed > 0 {
+		progress.Rate = float64(tracker.transferred) / elapsed
+	}
+	return progress
+}
+
+// report is called under the mutex, so reports are delivered in order
+func (tracker *ProgressTracker) report() {
+	tracker.lastReport = time.Now()
+	if tracker.options.Callback != nil {
+		tracker.options.Callback(tracker.progress())
+	}
+}
+
+// ProgressReader adds bytes read from the underlying reader to the tracker and finishes it at the end of content
+type ProgressReader struct {
+	reader  io.Reader
+	tracker *ProgressTracker
+}
+
+func NewProgressReader(reader io.Reader, tracker *ProgressTracker) *ProgressReader {
+	return &ProgressReader{reader, tracker}
+}
+
+func (reader *ProgressReader) Read(p []byte) (n int, err error) {
+	n, err = reader.reader.Read(p)
+	reader.tracker.Add(int64(n))
+	if err == io.EOF {
+		reader.tracker.Finish()
+	}
+	return
+}
+
+// Close closes the underlying reader if it is a closer
+func (reader *ProgressReader) Close() error {
+	if closer, ok := reader.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// TrackProgress wraps the reader if the tracker is set. Folders wrap content right where it is sent,
+// so bytes buffered before the upload are not counted
+func TrackProgress(reader io.Reader, tracker *ProgressTracker) io.Reader {
+	if tracker == nil {
+		return reader
+	}
+	return NewProgressReader(reader, tracker)
+}
+
+// ProgressPutter is implemented by folders which count bytes sent to the storage.
+// Other folders count bytes read from content, which are ahead of sent bytes by the size of upload buffers
+type ProgressPutter interface {
+	PutObjectWithProgress(name string, content io.Reader, tracker *ProgressTracker) error
+}
+
+// PutObjectWithProgress reports progress of the upload, size is zero if it is not known in advance
+func PutObjectWithProgress(folder Folder, name string, content io.Reader, size int64, options ProgressOptions) error {
+	tracker := NewProgressTracker(size, options)
+	err := PutObjectWithTracker(folder, name, content, tracker)
+	if err != nil {
+		return err
+	}
+	tracker.Finish()
+	return nil
+}
+
+// PutObjectWithTracker adds uploaded bytes to the tracker, bytes read from content are counted
+// if the folder is not a ProgressPutter
+func PutObjectWithTracker(folder Folder, name string, content io.Reader, tracker *ProgressTracker) error {
+	if putter, ok := folder.(ProgressPutter); ok {
+		return putter.PutObjectWithProgress(name, content, tracker)
+	}
+	return folder.PutObject(name, NewProgressReader(content, tracker))
+}
+
+// ReadObjectWithProgress reports progress of reading the object,
+// the total size is known only if the folder implements ObjectAttributesKeeper
+func ReadObjectWithProgress(folder Folder, objectRelativePath string, options ProgressOptions) (io.ReadCloser, error) {
+	attributes, err := StatObject(folder, objectRelativePath)
+	if _, unsupported := err.(UnsupportedOperationError); err != nil && !unsupported {
+		return nil, err
+	}
+	reader, err := folder.ReadObject(objectRelativePath)
+	if err != nil {
+		return nil, err
+	}
+	return NewProgressReader(reader, NewProgressTracker(attributes.Size, options)), nil
+}
+
+// LogProgress returns the callback which logs progress of the transfer of the object through tracelog
+func LogProgress(name string) ProgressCallback {
+	return func(progress Progress) {
+		state := "in progress"
+		if progress.Done {
+			state = "done"
+		}
+		if progress.Total > 0 {
+			tracelog.InfoLogger.Printf("%s %s: %s of %s (%.1f%%), %s/s\n", name, state,
+				formatBytes(float64(progress.Transferred)), formatBytes(float64(progress.Total)),
+				float64(progress.Transferred)*100/float64(progress.Total), formatBytes(progress.Rate))
+			return
+		}
+		tracelog.InfoLogger.Printf("%s %s: %s, %s/s\n", name, state,
+			formatBytes(float64(progress.Transferred)), formatBytes(progress.Rate))
+	}
+}
+
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
@@ -0,0 +1,58 @@
+package storage_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/memory"
+	"github.com/tinsane/storages/storage"
+)
+
+func TestPutAndReadObjectWithProgress(t *testing.T) {
+	folder := memory.NewFolder("in_memory/", memory.NewStorage())
+	content := bytes.Repeat([]byte{1}, 100000)
+
+	var reports []storage.Progress
+	options := storage.ProgressOptions{Callback: func(progress storage.Progress) {
+		reports = append(reports, progress)
+	}}
+	err := storage.PutObjectWithProgress(folder, "object", bytes.NewReader(content), int64(len(content)), options)
+	assert.NoError(t, err)
+	assert.True(t, len(reports) > 1)
+	last := reports[len(reports)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, int64(len(content)), last.Transferred)
+	assert.Equal(t, int64(len(content)), last.Total)
+
+	reports = nil
+	reader, err := storage.ReadObjectWithProgress(folder, "object", options)
+	assert.NoError(t, err)
+	readContent, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, content, readContent)
+	last = reports[len(reports)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, int64(len(content)), last.Total)
+	for i := 1; i < len(reports); i++ {
+		assert.True(t, reports[i-1].Transferred <= reports[i].Transferred)
+	}
+}
+
+func TestProgressTrackerReportsAtInterval(t *testing.T) {
+	var reports int
+	tracker := storage.NewProgressTracker(0, storage.ProgressOptions{
+		Callback: func(progress storage.Progress) { reports++ },
+		Interval: time.Hour,
+	})
+	for i := 0; i < 10; i++ {
+		tracker.Add(10)
+	}
+	tracker.Finish()
+	tracker.Finish()
+	assert.Equal(t, 1, reports)
+	assert.Equal(t, int64(100), tracker.Progress().Transferred)
+}
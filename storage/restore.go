@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tinsane/tracelog"
+)
+
+// ObjectArchivedError is returned on reading an object which must be restored from archive storage class first
+type ObjectArchivedError struct {
+	error
+}
+
+func NewObjectArchivedError(path string) ObjectArchivedError {
+	return ObjectArchivedError{errors.Errorf("object '%s' is archived and must be restored before reading", path)}
+}
+
+func (err ObjectArchivedError) Error() string {
+	return fmt.Sprintf(tracelog.GetErrorFormatter(), err.error)
+}
+
+// RestoreStatus describes whether an archived object can be read
+type RestoreStatus struct {
+	// StorageClass is storage specific, e.g. GLACIER or DEEP_ARCHIVE for S3
+	StorageClass string
+	Archived     bool
+	InProgress   bool
+	// RestoredUntil is zero unless a temporary copy of the archived object is available
+	RestoredUntil time.Time
+}
+
+func (status RestoreStatus) IsReadable() bool {
+	return !status.Archived || (!status.InProgress && !status.RestoredUntil.IsZero())
+}
+
+// ObjectRestorer is implemented by folders which can store objects in archive storage classes
+type ObjectRestorer interface {
+	// RestoreObject requests a temporary copy of the archived object available for days.
+	// Tier is storage specific, e.g. Expedited, Standard or Bulk for S3, empty tier means the storage default
+	RestoreObject(objectRelativePath string, days int64, tier string) error
+	GetRestoreStatus(objectRelativePath string) (RestoreStatus, error)
+}
+
+// RestoreObject returns UnsupportedOperationError if the folder has no archive storage classes
+func RestoreObject(folder Folder, objectRelativePath string, days int64, tier string) error {
+	restorer, ok := folder.(ObjectRestorer)
+	if !ok {
+		return NewUnsupportedOperationError("this", "restore of archived objects")
+	}
+	return restorer.RestoreObject(objectRelativePath, days, tier)
+}
+
+// GetRestoreStatus returns UnsupportedOperationError if the folder has no archive storage classes
+func GetRestoreStatus(folder Folder, objectRelativePath string) (RestoreStatus, error) {
+	restorer, ok := folder.(ObjectRestorer)
+	if !ok {
+		return RestoreStatus{}, NewUnsupportedOperationError("this", "restore of archived objects")
+	}
+	return restorer.GetRestoreStatus(objectRelativePath)
+}
+
+// RestoreFolder requests restore of all archived objects in the folder and its subfolders,
+// then polls their status until every object can be read
+func RestoreFolder(folder Folder, days int64, tier string, pollInterval time.Duration) error {
+	restorer, ok := folder.(ObjectRestorer)
+	if !ok {
+		return NewUnsupportedOperationError("this", "restore of archived objects")
+	}
+	objects, err := ListFolderRecursively(folder)
+	if err != nil {
+		return err
+	}
+	pending := make([]string, 0)
+	for _, object := range objects {
+		status, err := restorer.GetRestoreStatus(object.GetName())
+		if err != nil {
+			return err
+		}
+		if status.IsReadable() {
+			continue
+		}
+		if !status.InProgress {
+			tracelog.InfoLogger.Printf("Restoring %s object %s\n", status.StorageClass, object.GetName())
+			err = restorer.RestoreObject(object.GetName(), days, tier)
+			if err != nil {
+				return err
+			}
+		}
+		pending = append(pending, object.GetName())
+	}
+	for len(pending) > 0 {
+		tracelog.InfoLogger.Printf("Waiting for restore of %d objects\n", len(pending))
+		time.Sleep(pollInterval)
+		stillPending := pending[:0]
+		for _, objectRelativePath := range pending {
+			status, err := restorer.GetRestoreStatus(objectRelativePath)
+			if err != nil {
+				return err
+			}
+			if status.IsReadable() {
+				continue
+			}
+			if !status.InProgress {
+				// Restore was not started or the restored copy has already expired
+				err = restorer.RestoreObject(objectRelativePath, days, tier)
+				if err != nil {
+					return err
+				}
+			}
+			stillPending = append(stillPending, objectRelativePath)
+		}
+		pending = stillPending
+	}
+	return nil
+}
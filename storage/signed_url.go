@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// URLSigner is implemented by folders which can share objects by temporary links
+type URLSigner interface {
+	// SignedURL returns a link which allows to download (http.MethodGet) or upload (http.MethodPut)
+	// the object without credentials until expiry passes
+	SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error)
+}
+
+// SignedURL returns UnsupportedOperationError if the folder can not sign URLs
+func SignedURL(folder Folder, objectRelativePath, method string, expiry time.Duration) (string, error) {
+	signer, ok := folder.(URLSigner)
+	if !ok {
+		return "", NewUnsupportedOperationError("this", "signed URLs")
+	}
+	return signer.SignedURL(objectRelativePath, method, expiry)
+}
+
+// CheckSignedURLMethod is used by signers to reject methods other than GET and PUT
+func CheckSignedURLMethod(method string) error {
+	if method != http.MethodGet && method != http.MethodPut {
+		return errors.Errorf("signed URLs support only %s and %s methods, got '%s'", http.MethodGet, http.MethodPut, method)
+	}
+	return nil
+}
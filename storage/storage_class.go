@@ -0,0 +1,30 @@
+package storage
+
+import "io"
+
+// StorageClassSetter is implemented by folders which can keep objects in different storage classes or access tiers.
+// Storage class names are storage specific, e.g. STANDARD_IA or GLACIER for S3, NEARLINE for GCS, Cool for Azure
+type StorageClassSetter interface {
+	// PutObjectWithStorageClass overrides the storage class configured for the folder
+	PutObjectWithStorageClass(name string, content io.Reader, storageClass string) error
+	// SetStorageClass moves the existing object to another storage class
+	SetStorageClass(objectRelativePath, storageClass string) error
+}
+
+// PutObjectWithStorageClass returns UnsupportedOperationError if the folder has no storage classes
+func PutObjectWithStorageClass(folder Folder, name string, content io.Reader, storageClass string) error {
+	setter, ok := folder.(StorageClassSetter)
+	if !ok {
+		return NewUnsupportedOperationError("this", "storage classes")
+	}
+	return setter.PutObjectWithStorageClass(name, content, storageClass)
+}
+
+// SetStorageClass returns UnsupportedOperationError if the folder has no storage classes
+func SetStorageClass(folder Folder, objectRelativePath, storageClass string) error {
+	setter, ok := folder.(StorageClassSetter)
+	if !ok {
+		return NewUnsupportedOperationError("this", "storage classes")
+	}
+	return setter.SetStorageClass(objectRelativePath, storageClass)
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"io"
+	"time"
+)
+
+// ObjectVersion is one of versions kept by the storage with versioning enabled
+type ObjectVersion struct {
+	ObjectRelativePath string
+	// VersionID is storage specific, e.g. version id for S3, generation for GCS, snapshot time for Azure, which is empty for the base blob
+	VersionID string
+	IsLatest  bool
+	// IsDeleteMarker is true for versions left by deletion of the object, they have no content
+	IsDeleteMarker bool
+	LastModified   time.Time
+	Size           int64
+}
+
+// VersionedFolder is implemented by folders which can keep previous versions of overwritten and deleted objects
+type VersionedFolder interface {
+	// ListObjectVersions returns versions of the object, the latest first
+	ListObjectVersions(objectRelativePath string) ([]ObjectVersion, error)
+	// ReadObjectVersion should return ObjectNotFoundError in case, there is no such version
+	ReadObjectVersion(objectRelativePath, versionID string) (io.ReadCloser, error)
+	// DeleteObjectVersions deletes versions permanently, whether the previous version becomes the latest one is storage specific
+	DeleteObjectVersions(versions []ObjectVersion) error
+}
+
+// ListObjectVersions returns UnsupportedOperationError if the folder does not keep versions
+func ListObjectVersions(folder Folder, objectRelativePath string) ([]ObjectVersion, error) {
+	versionedFolder, ok := folder.(VersionedFolder)
+	if !ok {
+		return nil, NewUnsupportedOperationError("this", "object versions")
+	}
+	return versionedFolder.ListObjectVersions(objectRelativePath)
+}
+
+// ReadObjectVersion returns UnsupportedOperationError if the folder does not keep versions
+func ReadObjectVersion(folder Folder, objectRelativePath, versionID string) (io.ReadCloser, error) {
+	versionedFolder, ok := folder.(VersionedFolder)
+	if !ok {
+		return nil, NewUnsupportedOperationError("this", "object versions")
+	}
+	return versionedFolder.ReadObjectVersion(objectRelativePath, versionID)
+}
+
+// DeleteObjectVersions returns UnsupportedOperationError if the folder does not keep versions
+func DeleteObjectVersions(folder Folder, versions []ObjectVersion) error {
+	versionedFolder, ok := folder.(VersionedFolder)
+	if !ok {
+		return NewUnsupportedOperationError("this", "object versions")
+	}
+	return versionedFolder.DeleteObjectVersions(versions)
+}
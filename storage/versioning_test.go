@@ -0,0 +1,55 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/memory"
+	"github.com/tinsane/storages/storage"
+)
+
+func readVersion(t *testing.T, folder storage.Folder, name, versionID string) string {
+	reader, err := storage.ReadObjectVersion(folder, name, versionID)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func TestObjectVersions(t *testing.T) {
+	folder := memory.NewFolder("in_memory/", memory.NewVersionedStorage())
+	assert.NoError(t, folder.PutObject("object", strings.NewReader("first")))
+	assert.NoError(t, folder.PutObject("object", strings.NewReader("second")))
+	assert.NoError(t, folder.DeleteObjects([]string{"object"}))
+
+	exists, err := folder.Exists("object")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	versions, err := storage.ListObjectVersions(folder, "object")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(versions))
+	assert.True(t, versions[0].IsLatest)
+	assert.True(t, versions[0].IsDeleteMarker)
+	assert.False(t, versions[1].IsDeleteMarker)
+	assert.Equal(t, int64(len("second")), versions[1].Size)
+	assert.Equal(t, "second", readVersion(t, folder, "object", versions[1].VersionID))
+	assert.Equal(t, "first", readVersion(t, folder, "object", versions[2].VersionID))
+	_, err = storage.ReadObjectVersion(folder, "object", versions[0].VersionID)
+	assert.IsType(t, storage.ObjectNotFoundError{}, err)
+
+	// Deletion of the delete marker brings the object back
+	assert.NoError(t, storage.DeleteObjectVersions(folder, versions[:1]))
+	reader, err := folder.ReadObject("object")
+	assert.NoError(t, err)
+	content, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, "second", string(content))
+
+	assert.NoError(t, storage.DeleteObjectVersions(folder, versions[1:2]))
+	versions, err = storage.ListObjectVersions(folder, "object")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(versions))
+	assert.True(t, versions[0].IsLatest)
+	assert.Equal(t, "first", readVersion(t, folder, "object", versions[0].VersionID))
+}
@@ -0,0 +1,242 @@
+package swift
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncw/swift"
+	"github.com/pkg/errors"
+)
+
+const (
+	UserNameSetting                    = "OS_USERNAME"
+	UserIdSetting                      = "OS_USER_ID"
+	PasswordSetting                    = "OS_PASSWORD"
+	AuthUrlSetting                     = "OS_AUTH_URL"
+	TenantNameSetting                  = "OS_TENANT_NAME"
+	TenantIdSetting                    = "OS_TENANT_ID"
+	ProjectNameSetting                 = "OS_PROJECT_NAME"
+	ProjectIdSetting                   = "OS_PROJECT_ID"
+	RegionSetting                      = "OS_REGION_NAME"
+	UserDomainNameSetting              = "OS_USER_DOMAIN_NAME"
+	UserDomainIdSetting                = "OS_USER_DOMAIN_ID"
+	ProjectDomainNameSetting           = "OS_PROJECT_DOMAIN_NAME"
+	ProjectDomainIdSetting             = "OS_PROJECT_DOMAIN_ID"
+	TrustIdSetting                     = "OS_TRUST_ID"
+	ApplicationCredentialIdSetting     = "OS_APPLICATION_CREDENTIAL_ID"
+	ApplicationCredentialNameSetting   = "OS_APPLICATION_CREDENTIAL_NAME"
+	ApplicationCredentialSecretSetting = "OS_APPLICATION_CREDENTIAL_SECRET"
+	IdentityApiVersionSetting          = "OS_IDENTITY_API_VERSION"
+	AuthVersionSetting                 = "ST_AUTH_VERSION"
+	EndpointTypeSetting                = "OS_ENDPOINT_TYPE"
+	StorageUrlSetting                  = "OS_STORAGE_URL"
+	AuthTokenSetting                   = "OS_AUTH_TOKEN"
+	RetriesSetting                     = "GOSWIFT_RETRIES"
+	UserAgentSetting                   = "GOSWIFT_USER_AGENT"
+	ConnectTimeoutSetting              = "GOSWIFT_CONNECT_TIMEOUT"
+	TimeoutSetting                     = "GOSWIFT_TIMEOUT"
+	InternalSetting                    = "GOSWIFT_INTERNAL"
+	// v1 auth alternatives
+	KeySetting  = "ST_KEY"
+	UserSetting = "ST_USER"
+	AuthSetting = "ST_AUTH"
+)
+
+const (
+	// Connections are dropped from the cache when they are not requested for this time,
+	// folders which use them keep working, because the connection renews its token itself
+	connectionIdleTimeout = time.Hour
+	maxCachedConnections  = 64
+)
+
+var (
+	// Authenticated connections are shared between folders with the same credentials,
+	// so auth token is requested only once and renewed by the connection itself
+	connections      = make(map[string]*cachedConnection)
+	connectionsMutex sync.Mutex
+)
+
+// cachedConnection is authenticated by the first request, others wait until ready is closed
+type cachedConnection struct {
+	ready      chan struct{}
+	connection *swift.Connection
+	err        error
+	// lastUsed is guarded by connectionsMutex
+	lastUsed time.Time
+}
+
+// getSetting falls back to the environment variable with the same name.
+// Environment is never modified, so different accounts can be configured concurrently
+func getSetting(settings map[string]string, name string) string {
+	if value, ok := settings[name]; ok {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+func getFirstSettingOf(settings map[string]string, names ...string) string {
+	for _, name := range names {
+		if value := getSetting(settings, name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func configureConnection(settings map[string]string) (*swift.Connection, error) {
+	connection := &swift.Connection{
+		Domain:                      getSetting(settings, UserDomainNameSetting),
+		DomainId:                    getSetting(settings, UserDomainIdSetting),
+		UserName:                    getFirstSettingOf(settings, UserNameSetting, UserSetting),
+		UserId:                      getSetting(settings, UserIdSetting),
+		ApiKey:                      getFirstSettingOf(settings, PasswordSetting, KeySetting),
+		ApplicationCredentialId:     getSetting(settings, ApplicationCredentialIdSetting),
+		ApplicationCredentialName:   getSetting(settings, ApplicationCredentialNameSetting),
+		ApplicationCredentialSecret: getSetting(settings, ApplicationCredentialSecretSetting),
+		AuthUrl:                     getFirstSettingOf(settings, AuthUrlSetting, AuthSetting),
+		UserAgent:                   getSetting(settings, UserAgentSetting),
+		Region:                      getSetting(settings, RegionSetting),
+		Tenant:                      getFirstSettingOf(settings, ProjectNameSetting, TenantNameSetting),
+		TenantId:                    getFirstSettingOf(settings, ProjectIdSetting, TenantIdSetting),
+		EndpointType:                swift.EndpointType(getSetting(settings, EndpointTypeSetting)),
+		TenantDomain:                getSetting(settings, ProjectDomainNameSetting),
+		TenantDomainId:              getSetting(settings, ProjectDomainIdSetting),
+		TrustId:                     getSetting(settings, TrustIdSetting),
+		StorageUrl:                  getSetting(settings, StorageUrlSetting),
+		AuthToken:                   getSetting(settings, AuthTokenSetting),
+	}
+
+	var err error
+	if authVersion := getFirstSettingOf(settings, IdentityApiVersionSetting, AuthVersionSetting); authVersion != "" {
+		// OpenStack clients accept versions like "3" as well as "3.0"
+		connection.AuthVersion, err = strconv.Atoi(strings.SplitN(authVersion, ".", 2)[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse auth version %v", authVersion)
+		}
+	}
+	if retries := getSetting(settings, RetriesSetting); retries != "" {
+		connection.Retries, err = strconv.Atoi(retries)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", RetriesSetting)
+		}
+	}
+	if connectTimeout := getSetting(settings, ConnectTimeoutSetting); connectTimeout != "" {
+		connection.ConnectTimeout, err = time.ParseDuration(connectTimeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", ConnectTimeoutSetting)
+		}
+	}
+	if timeout := getSetting(settings, TimeoutSetting); timeout != "" {
+		connection.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", TimeoutSetting)
+		}
+	}
+	if internal := getSetting(settings, InternalSetting); internal != "" {
+		connection.Internal, err = strconv.ParseBool(internal)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", InternalSetting)
+		}
+	}
+	return connection, nil
+}
+
+// getConnection returns authenticated connection, reusing the one created earlier for the same settings.
+// If storage url and auth token are provided, connection is used as pre-authenticated.
+// Authentication is done without the lock, so only requests with the same settings wait for it
+func getConnection(settings map[string]string) (*swift.Connection, error) {
+	connection, err := configureConnection(settings)
+	if err != nil {
+		return nil, err
+	}
+	key := getConnectionKey(connection)
+
+	connectionsMutex.Lock()
+	cached, ok := connections[key]
+	if ok {
+		cached.lastUsed = time.Now()
+		connectionsMutex.Unlock()
+		<-cached.ready
+		return cached.connection, cached.err
+	}
+	evictConnections()
+	cached = &cachedConnection{ready: make(chan struct{}), lastUsed: time.Now()}
+	connections[key] = cached
+	connectionsMutex.Unlock()
+
+	if !connection.Authenticated() {
+		err = connection.Authenticate()
+	}
+	if err != nil {
+		cached.err = errors.Wrap(err, "failed to authenticate connection")
+		// Failed authentication is not cached, the next request tries again
+		connectionsMutex.Lock()
+		if connections[key] == cached {
+			delete(connections, key)
+		}
+		connectionsMutex.Unlock()
+	} else {
+		cached.connection = connection
+	}
+	close(cached.ready)
+	return cached.connection, cached.err
+}
+
+// evictConnections removes idle connections and the least recently used one if the cache is full.
+// It is called under connectionsMutex
+func evictConnections() {
+	var oldestKey string
+	var oldest *cachedConnection
+	for key, cached := range connections {
+		if time.Since(cached.lastUsed) > connectionIdleTimeout {
+			delete(connections, key)
+			continue
+		}
+		if oldest == nil || cached.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = key, cached
+		}
+	}
+	if len(connections) >= maxCachedConnections {
+		delete(connections, oldestKey)
+	}
+}
+
+func getConnectionKey(connection *swift.Connection) string {
+	hash := sha256.New()
+	for _, value := range []interface{}{
+		connection.Domain,
+		connection.DomainId,
+		connection.UserName,
+		connection.UserId,
+		connection.ApiKey,
+		connection.ApplicationCredentialId,
+		connection.ApplicationCredentialName,
+		connection.ApplicationCredentialSecret,
+		connection.AuthUrl,
+		connection.Retries,
+		connection.UserAgent,
+		connection.ConnectTimeout,
+		connection.Timeout,
+		connection.Region,
+		connection.AuthVersion,
+		connection.Internal,
+		connection.Tenant,
+		connection.TenantId,
+		connection.EndpointType,
+		connection.TenantDomain,
+		connection.TenantDomainId,
+		connection.TrustId,
+		connection.StorageUrl,
+		connection.AuthToken,
+	} {
+		// Separator prevents collisions of adjacent values
+		fmt.Fprintf(hash, "%v\x00", value)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
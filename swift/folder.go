@@ -2,46 +2,121 @@ package swift
 
 import (
 	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
 	"github.com/tinsane/storages/storage"
 	"github.com/tinsane/tracelog"
 	"io"
-	"io/ioutil"
-	"os"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ncw/swift"
 )
 
+const (
+	SegmentSizeSetting      = "SWIFT_SEGMENT_SIZE"
+	SegmentContainerSetting = "SWIFT_SEGMENT_CONTAINER"
+	LargeObjectTypeSetting  = "SWIFT_LARGE_OBJECT_TYPE"
+	// Large objects are downloaded by concurrent range requests if concurrency is greater than 1
+	DownloadConcurrencySetting = "SWIFT_DOWNLOAD_CONCURRENCY"
+	DownloadChunkSizeSetting   = "SWIFT_DOWNLOAD_CHUNK_SIZE"
+	DownloadMemoryLimitSetting = "SWIFT_DOWNLOAD_MEMORY_LIMIT"
+
+	StaticLargeObject  = "slo"
+	DynamicLargeObject = "dlo"
+
+	defaultSegmentSize = 64 << 20
+	// Swift refuses to store single objects bigger than 5 GiB
+	maxSegmentSize = 5 << 30
+)
+
+// maxBufferedObjectSize limits the buffer, which is used to find out if the object fits into one segment
+var maxBufferedObjectSize int64 = defaultSegmentSize
+
 var SettingList = []string{
-	"OS_USERNAME",
-	"OS_PASSWORD",
-	"OS_AUTH_URL",
-	"OS_TENANT_NAME",
-	"OS_REGION_NAME",
+	UserNameSetting,
+	UserIdSetting,
+	PasswordSetting,
+	AuthUrlSetting,
+	TenantNameSetting,
+	TenantIdSetting,
+	ProjectNameSetting,
+	ProjectIdSetting,
+	RegionSetting,
+	UserDomainNameSetting,
+	UserDomainIdSetting,
+	ProjectDomainNameSetting,
+	ProjectDomainIdSetting,
+	TrustIdSetting,
+	ApplicationCredentialIdSetting,
+	ApplicationCredentialNameSetting,
+	ApplicationCredentialSecretSetting,
+	IdentityApiVersionSetting,
+	AuthVersionSetting,
+	EndpointTypeSetting,
+	StorageUrlSetting,
+	AuthTokenSetting,
+	RetriesSetting,
+	UserAgentSetting,
+	ConnectTimeoutSetting,
+	TimeoutSetting,
+	InternalSetting,
+	KeySetting,
+	UserSetting,
+	AuthSetting,
+	SegmentSizeSetting,
+	SegmentContainerSetting,
+	LargeObjectTypeSetting,
+	DownloadConcurrencySetting,
+	DownloadChunkSizeSetting,
+	DownloadMemoryLimitSetting,
+}
+
+// LargeObjectConfig describes how objects bigger than one segment are uploaded
+type LargeObjectConfig struct {
+	SegmentSize int64
+	// Segments are stored in <container>_segments if not set
+	SegmentContainer string
+	// StaticLargeObject or DynamicLargeObject
+	Type string
 }
 
 func NewError(err error, format string, args ...interface{}) storage.Error {
 	return storage.NewError(err, "Swift", format, args...)
 }
 
+// FolderOptions are optional settings of the folder, zero value uses defaults
+type FolderOptions struct {
+	// Zero segment size means the default one, empty type means StaticLargeObject
+	LargeObjects LargeObjectConfig
+	ParallelRead storage.ParallelReadOptions
+}
+
 func NewFolder(connection *swift.Connection, container swift.Container, path string) *Folder {
-	return &Folder{connection, container, path}
+	return NewFolderWithOptions(connection, container, path, FolderOptions{})
 }
 
-func ConfigureFolder(prefix string, settings map[string]string) (storage.Folder, error) {
-	connection := new(swift.Connection)
-	//Set settings as env variables
-	for prop, value := range settings {
-		os.Setenv(prop, value)
+func NewFolderWithOptions(connection *swift.Connection, container swift.Container, path string, options FolderOptions) *Folder {
+	if options.LargeObjects.SegmentSize == 0 {
+		options.LargeObjects.SegmentSize = defaultSegmentSize
 	}
-	//users must set conventional openStack environment variables: username, key, auth-url, tenantName, region etc
-	err := connection.ApplyEnvironment()
-	if err != nil {
-		return nil, NewError(err, "Unable to apply env variables")
+	if options.LargeObjects.Type == "" {
+		options.LargeObjects.Type = StaticLargeObject
+	}
+	if options.LargeObjects.SegmentContainer == "" {
+		options.LargeObjects.SegmentContainer = container.Name + "_segments"
 	}
-	err = connection.Authenticate()
+	return &Folder{connection, container, path, options, &segmentContainer{}}
+}
+
+func ConfigureFolder(prefix string, settings map[string]string) (storage.Folder, error) {
+	//settings missing from the map are taken from conventional openStack environment variables
+	connection, err := getConnection(settings)
 	if err != nil {
-		return nil, NewError(err, "Unable to authenticate connection")
+		return nil, NewError(err, "Unable to configure connection")
 	}
 	containerName, path, err := storage.GetPathFromPrefix(prefix)
 	if err != nil {
@@ -54,13 +129,79 @@ func ConfigureFolder(prefix string, settings map[string]string) (storage.Folder,
 		return nil, NewError(err, "Unable to fetch container from name %v", containerName)
 	}
 
-	return NewFolder(connection, container, path), nil
+	largeObjectConfig, err := configureLargeObjects(settings)
+	if err != nil {
+		return nil, NewError(err, "Unable to configure large objects")
+	}
+
+	parallelReadOptions, err := storage.ConfigureParallelReadOptions(settings,
+		DownloadConcurrencySetting, DownloadChunkSizeSetting, DownloadMemoryLimitSetting)
+	if err != nil {
+		return nil, NewError(err, "Invalid download settings")
+	}
+
+	return NewFolderWithOptions(connection, container, path, FolderOptions{largeObjectConfig, parallelReadOptions}), nil
+}
+
+func configureLargeObjects(settings map[string]string) (LargeObjectConfig, error) {
+	config := LargeObjectConfig{
+		SegmentSize:      defaultSegmentSize,
+		SegmentContainer: settings[SegmentContainerSetting],
+		Type:             StaticLargeObject,
+	}
+	if segmentSizeStr, ok := settings[SegmentSizeSetting]; ok {
+		segmentSize, err := strconv.ParseInt(segmentSizeStr, 10, 64)
+		if err != nil {
+			return LargeObjectConfig{}, errors.Wrapf(err, "failed to parse %s", SegmentSizeSetting)
+		}
+		if segmentSize <= 0 || segmentSize > maxSegmentSize {
+			return LargeObjectConfig{}, errors.Errorf("%s must be in range (0, %d]", SegmentSizeSetting, maxSegmentSize)
+		}
+		config.SegmentSize = segmentSize
+	}
+	if largeObjectType, ok := settings[LargeObjectTypeSetting]; ok {
+		largeObjectType = strings.ToLower(largeObjectType)
+		if largeObjectType != StaticLargeObject && largeObjectType != DynamicLargeObject {
+			return LargeObjectConfig{}, errors.Errorf("%s must be either %s or %s",
+				LargeObjectTypeSetting, StaticLargeObject, DynamicLargeObject)
+		}
+		config.Type = largeObjectType
+	}
+	return config, nil
 }
 
 type Folder struct {
 	connection *swift.Connection
 	container  swift.Container
 	path       string
+	options    FolderOptions
+	// segmentContainer is shared by subfolders, so it is created once for all of them
+	segmentContainer *segmentContainer
+}
+
+// segmentContainer is created by the first large object upload, failed creation is retried by the next one
+type segmentContainer struct {
+	mutex   sync.Mutex
+	created bool
+}
+
+func (folder *Folder) ensureSegmentContainer() error {
+	folder.segmentContainer.mutex.Lock()
+	defer folder.segmentContainer.mutex.Unlock()
+	if folder.segmentContainer.created {
+		return nil
+	}
+	name := folder.options.LargeObjects.SegmentContainer
+	err := folder.connection.ContainerCreate(name, nil)
+	if err != nil {
+		return NewError(err, "Unable to create segment container %v", name)
+	}
+	folder.segmentContainer.created = true
+	return nil
+}
+
+func (folder *Folder) subFolder(path string) *Folder {
+	return &Folder{folder.connection, folder.container, path, folder.options, folder.segmentContainer}
 }
 
 func (folder *Folder) GetPath() string {
@@ -80,32 +221,28 @@ func (folder *Folder) Exists(objectRelativePath string) (bool, error) {
 }
 
 func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []storage.Folder, err error) {
-	//Iterate
-	err = folder.connection.ObjectsWalk(folder.container.Name, &swift.ObjectsOpts{Delimiter: int32('/'), Prefix: folder.path}, func(opts *swift.ObjectsOpts) (interface{}, error) {
-
-		objectNames, err := folder.connection.ObjectNames(folder.container.Name, opts)
+	//Iterate listing pages, they already contain everything we need about objects
+	err = folder.connection.ObjectsWalk(folder.container.Name, &swift.ObjectsOpts{Delimiter: '/', Prefix: folder.path}, func(opts *swift.ObjectsOpts) (interface{}, error) {
+		pageObjects, err := folder.connection.Objects(folder.container.Name, opts)
 		if err != nil {
 			return nil, err
-		} else {
-			// Retrieved object names successfully.
 		}
-		for _, objectName := range objectNames {
-			if strings.HasSuffix(objectName, "/") {
+		for _, object := range pageObjects {
+			if object.PseudoDirectory {
 				//It is a subFolder name
-				subFolders = append(subFolders, NewFolder(folder.connection, folder.container, objectName))
-			} else {
-				//It is a storage object name
-				obj, _, err := folder.connection.Object(folder.container.Name, objectName)
-				if err != nil {
-					return nil, err
-				}
-				//trim prefix to get object's standalone name
-				objName := strings.TrimPrefix(obj.Name, folder.path)
-				objects = append(objects, storage.NewLocalObject(objName, obj.LastModified))
+				subFolders = append(subFolders, folder.subFolder(object.Name))
+				continue
 			}
+			//trim prefix to get object's standalone name
+			objName := strings.TrimPrefix(object.Name, folder.path)
+			if objName == "" {
+				// Some clients create folder marker objects, they are not a part of folder content
+				continue
+			}
+			objects = append(objects, storage.NewLocalObject(objName, object.LastModified))
 		}
-		//return objectNames if a further iteration is required.
-		return objectNames, err
+		//return page objects, so walk could continue from the last one
+		return pageObjects, nil
 	})
 	if err != nil {
 		return nil, nil, NewError(err, "Unable to iterate %v", folder.path)
@@ -114,49 +251,217 @@ func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []stora
 }
 
 func (folder *Folder) GetSubFolder(subFolderRelativePath string) storage.Folder {
-	return NewFolder(folder.connection, folder.container, storage.AddDelimiterToPath(storage.JoinPath(folder.path, subFolderRelativePath)))
+	return folder.subFolder(storage.AddDelimiterToPath(storage.JoinPath(folder.path, subFolderRelativePath)))
 }
 
 func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, error) {
 	path := storage.JoinPath(folder.path, objectRelativePath)
-	//get the object from the cloud using full path
-	cBytes, err := folder.connection.ObjectGetBytes(folder.container.Name, path)
+	if folder.options.ParallelRead.Enabled() {
+		return folder.readObjectInParallel(path)
+	}
+	//open the object stream from the cloud using full path
+	file, _, err := folder.connection.ObjectOpen(folder.container.Name, path, true, nil)
 	if err == swift.ObjectNotFound {
 		return nil, storage.NewObjectNotFoundError(path)
 	}
 	if err != nil {
 		return nil, NewError(err, "Unable to OPEN Object %v", path)
-	} else {
-		//retrieved object from  the cloud
 	}
-	readContents := bytes.NewReader(cBytes)
-	return ioutil.NopCloser(readContents), nil
+	return file, nil
+}
+
+// readObjectInParallel downloads objects bigger than one chunk by concurrent range requests.
+// Ranges are requested with the ETag of the object, so a concurrent overwrite fails the read instead of mixing versions
+func (folder *Folder) readObjectInParallel(path string) (io.ReadCloser, error) {
+	info, _, err := folder.connection.Object(folder.container.Name, path)
+	if err == swift.ObjectNotFound {
+		return nil, storage.NewObjectNotFoundError(path)
+	}
+	if err != nil {
+		return nil, NewError(err, "Unable to stat object %v", path)
+	}
+	openObject := func(headers swift.Headers) (io.ReadCloser, error) {
+		headers["If-Match"] = info.Hash
+		// MD5 of the whole object can not be checked for ranges
+		file, _, err := folder.connection.ObjectOpen(folder.container.Name, path, headers["Range"] == "", headers)
+		if err == swift.ObjectNotFound {
+			return nil, storage.NewObjectNotFoundError(path)
+		}
+		if swiftErr, ok := err.(*swift.Error); ok && swiftErr.StatusCode == http.StatusPreconditionFailed {
+			return nil, NewError(err, "Object %v was changed during read", path)
+		}
+		if err != nil {
+			return nil, NewError(err, "Unable to OPEN Object %v", path)
+		}
+		return file, nil
+	}
+	if info.Bytes <= folder.options.ParallelRead.ChunkSize {
+		return openObject(swift.Headers{})
+	}
+	readRange := func(offset, length int64) (io.ReadCloser, error) {
+		return openObject(swift.Headers{"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)})
+	}
+	return storage.NewParallelReader(info.Bytes, readRange, folder.options.ParallelRead), nil
+}
+
+// SignedURL returns TempURL signed by the temp url key of the container, or of the account if the container has none
+func (folder *Folder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	if err := storage.CheckSignedURLMethod(method); err != nil {
+		return "", err
+	}
+	key, err := folder.getTempURLKey()
+	if err != nil {
+		return "", err
+	}
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	return folder.connection.ObjectTempUrl(folder.container.Name, path, key, method, time.Now().Add(expiry)), nil
+}
+
+func (folder *Folder) getTempURLKey() (string, error) {
+	_, headers, err := folder.connection.Container(folder.container.Name)
+	if err != nil {
+		return "", NewError(err, "Unable to fetch metadata of container %v", folder.container.Name)
+	}
+	if key := headers["X-Container-Meta-Temp-Url-Key"]; key != "" {
+		return key, nil
+	}
+	_, headers, err = folder.connection.Account()
+	if err != nil {
+		return "", NewError(err, "Unable to fetch account metadata")
+	}
+	if key := headers["X-Account-Meta-Temp-Url-Key"]; key != "" {
+		return key, nil
+	}
+	return "", NewError(errors.New("temp url key is not set"), "Unable to sign url for container %v", folder.container.Name)
 }
 
+// PutObject uploads objects that fit into one segment with a single request, bigger ones are split into segments
+// of a static or dynamic large object. Objects bigger than maxBufferedObjectSize are uploaded as large objects
+// even if they fit into one segment, so segments of up to 5 GiB are not buffered in memory
 func (folder *Folder) PutObject(name string, content io.Reader) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{})
+}
+
+// PutObjectWithOptions sends options as object headers, they are stored in the manifest of large objects.
+// Storage class is ignored and conditional writes are not supported
+func (folder *Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	if options.Condition != nil {
+		return storage.NewUnsupportedOperationError("Swift", "conditional writes")
+	}
 	tracelog.DebugLogger.Printf("Put %v into %v\n", name, folder.path)
 	path := storage.JoinPath(folder.path, name)
-	//put the object in the cloud using full path
-	_, err := folder.connection.ObjectPut(folder.container.Name, path, content, false, "", "", nil)
+	headers := swift.Metadata(options.Metadata).ObjectHeaders()
+	if options.ContentEncoding != "" {
+		headers["Content-Encoding"] = options.ContentEncoding
+	}
+	if options.CacheControl != "" {
+		headers["Cache-Control"] = options.CacheControl
+	}
+	bufferedSize := folder.options.LargeObjects.SegmentSize
+	if bufferedSize > maxBufferedObjectSize {
+		bufferedSize = maxBufferedObjectSize
+	}
+	var firstSegment bytes.Buffer
+	_, err := io.CopyN(&firstSegment, content, bufferedSize)
+	if err == io.EOF {
+		//put the object in the cloud using full path
+		_, err = folder.connection.ObjectPut(folder.container.Name, path, storage.TrackProgress(&firstSegment, options.Progress),
+			false, "", options.ContentType, headers)
+		if err != nil {
+			return NewError(err, "Unable to write content.")
+		}
+		return nil
+	}
+	if err != nil {
+		return NewError(err, "Unable to read content of %v", path)
+	}
+	content = storage.TrackProgress(io.MultiReader(&firstSegment, content), options.Progress)
+	return folder.putLargeObject(path, content, options.ContentType, headers)
+}
+
+// PutObjectWithProgress counts bytes passed to uploads of the object and its segments,
+// so buffered first segment is not counted before it is sent
+func (folder *Folder) PutObjectWithProgress(name string, content io.Reader, tracker *storage.ProgressTracker) error {
+	return folder.PutObjectWithOptions(name, content, storage.PutOptions{Progress: tracker})
+}
+
+func (folder *Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	path := storage.JoinPath(folder.path, objectRelativePath)
+	info, headers, err := folder.connection.Object(folder.container.Name, path)
+	if err == swift.ObjectNotFound {
+		return storage.ObjectAttributes{}, storage.NewObjectNotFoundError(path)
+	}
 	if err != nil {
-		return NewError(err, "Unable to write content.")
+		return storage.ObjectAttributes{}, NewError(err, "Unable to stat object %v", path)
+	}
+	return storage.ObjectAttributes{
+		PutOptions: storage.PutOptions{
+			ContentType:     info.ContentType,
+			ContentEncoding: headers["Content-Encoding"],
+			CacheControl:    headers["Cache-Control"],
+			Metadata:        headers.ObjectMetadata(),
+		},
+		Size:         info.Bytes,
+		LastModified: info.LastModified,
+		Version:      info.Hash,
+	}, nil
+}
+
+func (folder *Folder) putLargeObject(path string, content io.Reader, contentType string, headers swift.Headers) error {
+	// Segments are uploaded into the separate container which may not exist yet
+	err := folder.ensureSegmentContainer()
+	if err != nil {
+		return err
+	}
+	opts := &swift.LargeObjectOpts{
+		Container:        folder.container.Name,
+		ObjectName:       path,
+		ContentType:      contentType,
+		Headers:          headers,
+		ChunkSize:        folder.options.LargeObjects.SegmentSize,
+		SegmentContainer: folder.options.LargeObjects.SegmentContainer,
+	}
+	var file swift.LargeObjectFile
+	if folder.options.LargeObjects.Type == DynamicLargeObject {
+		file, err = folder.connection.DynamicLargeObjectCreate(opts)
 	} else {
-		//Object stored successfully
+		file, err = folder.connection.StaticLargeObjectCreate(opts)
+	}
+	if err != nil {
+		return NewError(err, "Unable to create large object %v", path)
+	}
+	tracelog.DebugLogger.Printf("Upload %v as %s large object\n", path, folder.options.LargeObjects.Type)
+	_, err = io.Copy(file, content)
+	if err != nil {
+		_ = file.Close()
+		return NewError(err, "Unable to write segments of %v", path)
+	}
+	// Manifest is uploaded on close
+	err = file.Close()
+	if err != nil {
+		return NewError(err, "Unable to write manifest of %v", path)
 	}
 	return nil
 }
 
+// DeleteObjects tries to delete every object, failures are reported together by storage.DeleteObjectsError
 func (folder *Folder) DeleteObjects(objectRelativePaths []string) error {
+	var failures []storage.DeleteFailure
 	for _, objectRelativePath := range objectRelativePaths {
 		path := storage.JoinPath(folder.path, objectRelativePath)
 		tracelog.DebugLogger.Printf("Delete object %v\n", path)
-		err := folder.connection.ObjectDelete(folder.container.Name, path)
+		// Deletes segments as well if object is a large object manifest
+		err := folder.connection.LargeObjectDelete(folder.container.Name, path)
 		if err == swift.ObjectNotFound {
 			continue
 		}
 		if err != nil {
-			return NewError(err, "Unable to delete object %v", path)
+			tracelog.WarningLogger.Printf("Unable to delete object %v: %v\n", path, err)
+			failures = append(failures, storage.DeleteFailure{ObjectRelativePath: objectRelativePath, Err: err})
 		}
 	}
+	if len(failures) > 0 {
+		return storage.NewDeleteObjectsError("Swift", failures)
+	}
 	return nil
 }
@@ -1,10 +1,23 @@
 package swift
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ncw/swift"
+	"github.com/ncw/swift/swifttest"
 	"github.com/stretchr/testify/assert"
 	"github.com/tinsane/storages/storage"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var settings = map[string]string{
@@ -34,3 +47,385 @@ func TestSwiftFolderUsingEnvVariables(t *testing.T) {
 	assert.NoError(t, err)
 	storage.RunFolderTest(storageFolderUsingEnvVars, t)
 }
+
+func TestConfigureConnectionFromSettings(t *testing.T) {
+	connection, err := configureConnection(map[string]string{
+		UserNameSetting:                    "user",
+		PasswordSetting:                    "password",
+		AuthUrlSetting:                     "https://keystone/v3",
+		ProjectNameSetting:                 "project",
+		UserDomainNameSetting:              "user-domain",
+		ProjectDomainIdSetting:             "project-domain-id",
+		ApplicationCredentialIdSetting:     "app-id",
+		ApplicationCredentialSecretSetting: "app-secret",
+		IdentityApiVersionSetting:          "3.0",
+		TimeoutSetting:                     "30s",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "user", connection.UserName)
+	assert.Equal(t, "password", connection.ApiKey)
+	assert.Equal(t, "https://keystone/v3", connection.AuthUrl)
+	assert.Equal(t, "project", connection.Tenant)
+	assert.Equal(t, "user-domain", connection.Domain)
+	assert.Equal(t, "project-domain-id", connection.TenantDomainId)
+	assert.Equal(t, "app-id", connection.ApplicationCredentialId)
+	assert.Equal(t, "app-secret", connection.ApplicationCredentialSecret)
+	assert.Equal(t, 3, connection.AuthVersion)
+	assert.Equal(t, 30*time.Second, connection.Timeout)
+	_, isSet := os.LookupEnv(UserNameSetting)
+	assert.False(t, isSet)
+
+	_, err = configureConnection(map[string]string{IdentityApiVersionSetting: "v3"})
+	assert.Error(t, err)
+}
+
+func TestConfigureFolderReusesConnection(t *testing.T) {
+	server, err := swifttest.NewSwiftServer("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	settings := map[string]string{
+		UserNameSetting: swifttest.TEST_ACCOUNT,
+		PasswordSetting: swifttest.TEST_ACCOUNT,
+		AuthUrlSetting:  server.AuthURL,
+	}
+	connection, err := getConnection(settings)
+	assert.NoError(t, err)
+	err = connection.ContainerCreate("test-container", nil)
+	assert.NoError(t, err)
+
+	folder1, err := ConfigureFolder("swift://test-container/folder1", settings)
+	assert.NoError(t, err)
+	folder2, err := ConfigureFolder("swift://test-container/folder2", settings)
+	assert.NoError(t, err)
+	assert.True(t, connection == folder1.(*Folder).connection)
+	assert.True(t, connection == folder2.(*Folder).connection)
+
+	preAuthenticatedFolder, err := ConfigureFolder("swift://test-container/folder1", map[string]string{
+		StorageUrlSetting: connection.StorageUrl,
+		AuthTokenSetting:  connection.AuthToken,
+	})
+	assert.NoError(t, err)
+	assert.True(t, connection != preAuthenticatedFolder.(*Folder).connection)
+	storage.RunFolderTest(preAuthenticatedFolder, t)
+}
+
+func TestConnectionCacheEvictsIdleConnections(t *testing.T) {
+	server, err := swifttest.NewSwiftServer("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	settings := map[string]string{
+		UserNameSetting: swifttest.TEST_ACCOUNT,
+		PasswordSetting: swifttest.TEST_ACCOUNT,
+		AuthUrlSetting:  server.AuthURL,
+	}
+	idle, err := getConnection(settings)
+	assert.NoError(t, err)
+	connectionsMutex.Lock()
+	for _, cached := range connections {
+		cached.lastUsed = time.Now().Add(-2 * connectionIdleTimeout)
+	}
+	connectionsMutex.Unlock()
+
+	settings[RegionSetting] = "other"
+	_, err = getConnection(settings)
+	assert.NoError(t, err)
+	delete(settings, RegionSetting)
+	connection, err := getConnection(settings)
+	assert.NoError(t, err)
+	assert.True(t, idle != connection)
+	connectionsMutex.Lock()
+	assert.True(t, len(connections) <= maxCachedConnections)
+	connectionsMutex.Unlock()
+}
+
+func TestSwiftFolderUsingTestServer(t *testing.T) {
+	folder, closeServer := setupTestServerFolder(t, LargeObjectConfig{SegmentSize: defaultSegmentSize, Type: StaticLargeObject}, storage.ParallelReadOptions{}, nil)
+	defer closeServer()
+
+	storage.RunFolderTest(folder, t)
+}
+
+func TestSwiftFolderParallelReads(t *testing.T) {
+	parallelReadOptions := storage.ParallelReadOptions{ChunkSize: 64 * 1024, Concurrency: 4, MemoryLimit: 512 * 1024}
+	// Test server does not support ranges of segmented objects, so objects are uploaded as a whole
+	folder, closeServer := setupTestServerFolder(t, LargeObjectConfig{SegmentSize: defaultSegmentSize, Type: StaticLargeObject}, parallelReadOptions, nil)
+	defer closeServer()
+
+	storage.RunFolderTest(folder, t)
+}
+
+func TestSwiftFolderLargeObjects(t *testing.T) {
+	for _, largeObjectType := range []string{StaticLargeObject, DynamicLargeObject} {
+		folder, closeServer := setupTestServerFolder(t, LargeObjectConfig{SegmentSize: 1024, Type: largeObjectType}, storage.ParallelReadOptions{}, nil)
+
+		token := make([]byte, 5*1024+10)
+		rand.Read(token)
+		err := folder.PutObject("large", bytes.NewReader(token))
+		assert.NoError(t, err)
+
+		segments, err := folder.connection.ObjectNamesAll(folder.container.Name+"_segments", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 6, len(segments))
+
+		readCloser, err := folder.ReadObject("large")
+		assert.NoError(t, err)
+		all, err := ioutil.ReadAll(readCloser)
+		assert.NoError(t, err)
+		assert.Equal(t, token, all)
+		assert.NoError(t, readCloser.Close())
+
+		err = folder.DeleteObjects([]string{"large"})
+		assert.NoError(t, err)
+		exists, err := folder.Exists("large")
+		assert.NoError(t, err)
+		assert.False(t, exists)
+		segments, err = folder.connection.ObjectNamesAll(folder.container.Name+"_segments", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(segments))
+
+		closeServer()
+	}
+}
+
+func TestSwiftFolderPutObjectWithProgress(t *testing.T) {
+	folder, closeServer := setupTestServerFolder(t, LargeObjectConfig{SegmentSize: 1024, Type: StaticLargeObject}, storage.ParallelReadOptions{}, nil)
+	defer closeServer()
+
+	token := make([]byte, 3*1024+10)
+	rand.Read(token)
+	var last storage.Progress
+	err := storage.PutObjectWithProgress(folder, "large", bytes.NewReader(token), int64(len(token)),
+		storage.ProgressOptions{Callback: func(progress storage.Progress) { last = progress }})
+	assert.NoError(t, err)
+	assert.True(t, last.Done)
+	assert.Equal(t, int64(len(token)), last.Transferred)
+}
+
+func TestSwiftFolderUploadsObjectsBiggerThanBufferAsLargeObjects(t *testing.T) {
+	defer func(size int64) { maxBufferedObjectSize = size }(maxBufferedObjectSize)
+	maxBufferedObjectSize = 1024
+	folder, closeServer := setupTestServerFolder(t, LargeObjectConfig{SegmentSize: 4096, Type: StaticLargeObject}, storage.ParallelReadOptions{}, nil)
+	defer closeServer()
+
+	token := make([]byte, 2048)
+	rand.Read(token)
+	assert.NoError(t, folder.PutObject("small", bytes.NewReader(token[:1000])))
+	assert.NoError(t, folder.PutObject("large", bytes.NewReader(token)))
+
+	segments, err := folder.connection.ObjectNamesAll(folder.container.Name+"_segments", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(segments))
+	readCloser, err := folder.ReadObject("large")
+	assert.NoError(t, err)
+	all, err := ioutil.ReadAll(readCloser)
+	assert.NoError(t, err)
+	assert.Equal(t, token, all)
+	assert.NoError(t, readCloser.Close())
+}
+
+// ifMatchTransport records If-Match headers of reads and answers them as if the object was changed or deleted
+type ifMatchTransport struct {
+	mutex    sync.Mutex
+	ifMatch  []string
+	response int
+}
+
+func (transport *ifMatchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && req.Header.Get("If-Match") != "" {
+		transport.mutex.Lock()
+		transport.ifMatch = append(transport.ifMatch, req.Header.Get("If-Match"))
+		response := transport.response
+		transport.mutex.Unlock()
+		if response != 0 {
+			return &http.Response{StatusCode: response, Status: http.StatusText(response), Header: http.Header{},
+				Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+		}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestSwiftFolderParallelReadsCheckETag(t *testing.T) {
+	transport := &ifMatchTransport{}
+	parallelReadOptions := storage.ParallelReadOptions{ChunkSize: 1024, Concurrency: 2, MemoryLimit: 4096}
+	folder, closeServer := setupTestServerFolder(t, LargeObjectConfig{SegmentSize: defaultSegmentSize, Type: StaticLargeObject}, parallelReadOptions, transport)
+	defer closeServer()
+
+	token := make([]byte, 3000)
+	rand.Read(token)
+	assert.NoError(t, folder.PutObject("small", bytes.NewReader(token[:10])))
+	assert.NoError(t, folder.PutObject("large", bytes.NewReader(token)))
+	for _, name := range []string{"small", "large"} {
+		attributes, err := folder.StatObject(name)
+		assert.NoError(t, err)
+		transport.ifMatch = nil
+		readCloser, err := folder.ReadObject(name)
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(readCloser)
+		assert.NoError(t, err)
+		assert.NoError(t, readCloser.Close())
+		assert.NotEmpty(t, transport.ifMatch)
+		for _, ifMatch := range transport.ifMatch {
+			assert.Equal(t, attributes.Version, ifMatch)
+		}
+	}
+
+	transport.response = http.StatusPreconditionFailed
+	readCloser, err := folder.ReadObject("large")
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(readCloser)
+	assert.Error(t, err)
+	_, err = folder.ReadObject("small")
+	assert.Error(t, err)
+	transport.response = http.StatusNotFound
+	_, err = folder.ReadObject("small")
+	assert.IsType(t, storage.ObjectNotFoundError{}, err)
+}
+
+// pagingTransport counts requests and truncates listings to the requested limit,
+// which the test server ignores
+type pagingTransport struct {
+	headRequests            int32
+	listingRequests         int32
+	segmentContainerCreates int32
+}
+
+func (transport *pagingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodHead {
+		atomic.AddInt32(&transport.headRequests, 1)
+	}
+	if req.Method == http.MethodPut && strings.HasSuffix(req.URL.Path, "_segments") {
+		atomic.AddInt32(&transport.segmentContainerCreates, 1)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	limit := req.URL.Query().Get("limit")
+	if err != nil || req.Method != http.MethodGet || limit == "" || req.URL.Query().Get("format") != "json" {
+		return resp, err
+	}
+	atomic.AddInt32(&transport.listingRequests, 1)
+	var page []json.RawMessage
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	pageSize, err := strconv.Atoi(limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(page) > pageSize {
+		page = page[:pageSize]
+	}
+	body, err := json.Marshal(page)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return resp, nil
+}
+
+func TestSwiftFolderListFolderPages(t *testing.T) {
+	transport := &pagingTransport{}
+	folder, closeServer := setupTestServerFolder(t, LargeObjectConfig{SegmentSize: defaultSegmentSize, Type: StaticLargeObject}, storage.ParallelReadOptions{}, transport)
+	defer closeServer()
+
+	objectCount := 2500
+	for i := 0; i < objectCount; i++ {
+		err := folder.PutObject(fmt.Sprintf("wal_%05d", i), strings.NewReader("wal"))
+		assert.NoError(t, err)
+	}
+	err := folder.PutObject("sub/wal", strings.NewReader("wal"))
+	assert.NoError(t, err)
+	atomic.StoreInt32(&transport.listingRequests, 0)
+	atomic.StoreInt32(&transport.headRequests, 0)
+
+	objects, subFolders, err := folder.ListFolder()
+	assert.NoError(t, err)
+	assert.Equal(t, objectCount, len(objects))
+	assert.Equal(t, "wal_00000", objects[0].GetName())
+	assert.False(t, objects[0].GetLastModified().IsZero())
+	assert.Equal(t, 1, len(subFolders))
+	assert.Equal(t, "test-folder/sub/", subFolders[0].GetPath())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&transport.listingRequests))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&transport.headRequests))
+}
+
+func TestSwiftFolderCreatesSegmentContainerOnce(t *testing.T) {
+	transport := &pagingTransport{}
+	folder, closeServer := setupTestServerFolder(t, LargeObjectConfig{SegmentSize: 4}, storage.ParallelReadOptions{}, transport)
+	defer closeServer()
+
+	assert.NoError(t, folder.PutObject("large_0", strings.NewReader("large object")))
+	assert.NoError(t, folder.GetSubFolder("sub").PutObject("large_1", strings.NewReader("large object")))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&transport.segmentContainerCreates))
+}
+
+func TestSwiftFolderSignedURL(t *testing.T) {
+	folder, closeServer := setupTestServerFolder(t, LargeObjectConfig{SegmentSize: defaultSegmentSize, Type: StaticLargeObject}, storage.ParallelReadOptions{}, nil)
+	defer closeServer()
+
+	err := folder.PutObject("file", strings.NewReader("data"))
+	assert.NoError(t, err)
+	_, err = folder.SignedURL("file", http.MethodGet, time.Hour)
+	assert.Error(t, err)
+
+	err = folder.connection.AccountUpdate(swift.Headers{"X-Account-Meta-Temp-Url-Key": "secret"})
+	assert.NoError(t, err)
+	_, err = folder.SignedURL("file", http.MethodDelete, time.Hour)
+	assert.Error(t, err)
+	signedURL, err := storage.SignedURL(folder, "file", http.MethodGet, time.Hour)
+	assert.NoError(t, err)
+
+	response, err := http.Get(signedURL)
+	assert.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	data, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestSwiftFolderPutObjectWithOptions(t *testing.T) {
+	folder, closeServer := setupTestServerFolder(t, LargeObjectConfig{SegmentSize: 4, Type: StaticLargeObject}, storage.ParallelReadOptions{}, nil)
+	defer closeServer()
+
+	options := storage.PutOptions{ContentType: "application/json", Metadata: map[string]string{"backup-name": "base_123"}}
+	for _, content := range []string{"{}", "{\"large\": true}"} {
+		err := storage.PutObjectWithOptions(folder, "sentinel.json", strings.NewReader(content), options)
+		assert.NoError(t, err)
+		attributes, err := storage.StatObject(folder, "sentinel.json")
+		assert.NoError(t, err)
+		assert.Equal(t, "application/json", attributes.ContentType)
+		assert.Equal(t, "base_123", attributes.Metadata["backup-name"])
+	}
+
+	_, err := folder.StatObject("missing")
+	assert.IsType(t, storage.ObjectNotFoundError{}, err)
+}
+
+func setupTestServerFolder(t *testing.T, largeObjectConfig LargeObjectConfig,
+	parallelReadOptions storage.ParallelReadOptions, transport http.RoundTripper) (*Folder, func()) {
+	server, err := swifttest.NewSwiftServer("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection := &swift.Connection{
+		UserName:  swifttest.TEST_ACCOUNT,
+		ApiKey:    swifttest.TEST_ACCOUNT,
+		AuthUrl:   server.AuthURL,
+		Transport: transport,
+	}
+	err = connection.Authenticate()
+	assert.NoError(t, err)
+	err = connection.ContainerCreate("test-container", nil)
+	assert.NoError(t, err)
+	container, _, err := connection.Container("test-container")
+	assert.NoError(t, err)
+	options := FolderOptions{LargeObjects: largeObjectConfig, ParallelRead: parallelReadOptions}
+	return NewFolderWithOptions(connection, container, "test-folder/", options), server.Close
+}
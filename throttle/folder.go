@@ -0,0 +1,169 @@
+package throttle
+
+import (
+	"io"
+	"time"
+
+	"github.com/tinsane/storages/storage"
+)
+
+// readChunkSize keeps reads small, so the rate is smooth instead of bursts of big buffers
+const readChunkSize = 32 * 1024
+
+// Folder limits bandwidth and operations of the underlying folder. Subfolders share the limiter of the folder
+type Folder struct {
+	underlying storage.Folder
+	limiter    *Limiter
+}
+
+func NewFolder(underlying storage.Folder, limiter *Limiter) *Folder {
+	return &Folder{underlying, limiter}
+}
+
+func (folder *Folder) GetPath() string {
+	return folder.underlying.GetPath()
+}
+
+func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []storage.Folder, err error) {
+	folder.limiter.waitOperation()
+	objects, underlyingSubFolders, err := folder.underlying.ListFolder()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, subFolder := range underlyingSubFolders {
+		subFolders = append(subFolders, NewFolder(subFolder, folder.limiter))
+	}
+	return objects, subFolders, nil
+}
+
+func (folder *Folder) DeleteObjects(objectRelativePaths []string) error {
+	folder.limiter.waitOperation()
+	return folder.underlying.DeleteObjects(objectRelativePaths)
+}
+
+func (folder *Folder) Exists(objectRelativePath string) (bool, error) {
+	folder.limiter.waitOperation()
+	return folder.underlying.Exists(objectRelativePath)
+}
+
+func (folder *Folder) GetSubFolder(subFolderRelativePath string) storage.Folder {
+	return NewFolder(folder.underlying.GetSubFolder(subFolderRelativePath), folder.limiter)
+}
+
+func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, error) {
+	folder.limiter.waitOperation()
+	reader, err := folder.underlying.ReadObject(objectRelativePath)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledReader{reader, reader, folder.limiter.waitDownload}, nil
+}
+
+func (folder *Folder) PutObject(name string, content io.Reader) error {
+	folder.limiter.waitOperation()
+	return folder.underlying.PutObject(name, &throttledReader{content, nil, folder.limiter.waitUpload})
+}
+
+func (folder *Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	folder.limiter.waitOperation()
+	return storage.PutObjectWithOptions(folder.underlying, name, &throttledReader{content, nil, folder.limiter.waitUpload}, options)
+}
+
+func (folder *Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	folder.limiter.waitOperation()
+	return storage.StatObject(folder.underlying, objectRelativePath)
+}
+
+func (folder *Folder) PutObjectWithCondition(name string, content io.Reader, condition storage.PutCondition) (string, error) {
+	folder.limiter.waitOperation()
+	return storage.PutObjectWithCondition(folder.underlying, name, &throttledReader{content, nil, folder.limiter.waitUpload}, condition)
+}
+
+// SignedURL is not throttled, because URLs are signed locally
+func (folder *Folder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	return storage.SignedURL(folder.underlying, objectRelativePath, method, expiry)
+}
+
+// NewLock returns the native lock of the underlying folder, operations of the lock are not throttled
+func (folder *Folder) NewLock(name, owner string, ttl time.Duration) (storage.Lock, error) {
+	return storage.NewNativeLock(folder.underlying, name, owner, ttl)
+}
+
+func (folder *Folder) PutObjectWithStorageClass(name string, content io.Reader, storageClass string) error {
+	folder.limiter.waitOperation()
+	return storage.PutObjectWithStorageClass(folder.underlying, name, &throttledReader{content, nil, folder.limiter.waitUpload}, storageClass)
+}
+
+func (folder *Folder) SetStorageClass(objectRelativePath, storageClass string) error {
+	folder.limiter.waitOperation()
+	return storage.SetStorageClass(folder.underlying, objectRelativePath, storageClass)
+}
+
+func (folder *Folder) PutObjectWithProgress(name string, content io.Reader, tracker *storage.ProgressTracker) error {
+	folder.limiter.waitOperation()
+	return storage.PutObjectWithTracker(folder.underlying, name, &throttledReader{content, nil, folder.limiter.waitUpload}, tracker)
+}
+
+func (folder *Folder) ListObjectVersions(objectRelativePath string) ([]storage.ObjectVersion, error) {
+	folder.limiter.waitOperation()
+	return storage.ListObjectVersions(folder.underlying, objectRelativePath)
+}
+
+func (folder *Folder) ReadObjectVersion(objectRelativePath, versionID string) (io.ReadCloser, error) {
+	folder.limiter.waitOperation()
+	reader, err := storage.ReadObjectVersion(folder.underlying, objectRelativePath, versionID)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledReader{reader, reader, folder.limiter.waitDownload}, nil
+}
+
+func (folder *Folder) DeleteObjectVersions(versions []storage.ObjectVersion) error {
+	folder.limiter.waitOperation()
+	return storage.DeleteObjectVersions(folder.underlying, versions)
+}
+
+// ObjectLockEnabled is not throttled, because it is the configuration of the folder
+func (folder *Folder) ObjectLockEnabled() bool {
+	return storage.ObjectLockEnabled(folder.underlying)
+}
+
+func (folder *Folder) GetObjectLock(objectRelativePath string) (storage.ObjectLock, error) {
+	folder.limiter.waitOperation()
+	return storage.GetObjectLock(folder.underlying, objectRelativePath)
+}
+
+func (folder *Folder) RestoreObject(objectRelativePath string, days int64, tier string) error {
+	folder.limiter.waitOperation()
+	return storage.RestoreObject(folder.underlying, objectRelativePath, days, tier)
+}
+
+func (folder *Folder) GetRestoreStatus(objectRelativePath string) (storage.RestoreStatus, error) {
+	folder.limiter.waitOperation()
+	return storage.GetRestoreStatus(folder.underlying, objectRelativePath)
+}
+
+// throttledReader waits for tokens after every read, so the next read is delayed until the rate allows it
+type throttledReader struct {
+	reader io.Reader
+	closer io.Closer
+	wait   func(bytes int)
+}
+
+func (reader *throttledReader) Read(p []byte) (n int, err error) {
+	if len(p) > readChunkSize {
+		p = p[:readChunkSize]
+	}
+	n, err = reader.reader.Read(p)
+	if n > 0 {
+		reader.wait(n)
+	}
+	return
+}
+
+func (reader *throttledReader) Close() error {
+	if reader.closer == nil {
+		return nil
+	}
+	return reader.closer.Close()
+}
@@ -0,0 +1,130 @@
+package throttle
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/fs"
+	"github.com/tinsane/storages/memory"
+	"github.com/tinsane/storages/storage"
+)
+
+func TestThrottledFolder(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "throttle")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	underlying, err := fs.ConfigureFolder(tmpDir, nil)
+	assert.NoError(t, err)
+
+	storage.RunFolderTest(NewFolder(underlying, NewLimiter(Limits{})), t)
+}
+
+func TestThrottledFolderLimitsBandwidth(t *testing.T) {
+	limiter := NewLimiter(Limits{UploadBytesPerSecond: 200000, DownloadBytesPerSecond: 200000})
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewStorage()), limiter)
+	content := bytes.Repeat([]byte{1}, 300000)
+
+	// The first second of the rate is a burst, the rest is throttled
+	start := time.Now()
+	assert.NoError(t, folder.PutObject("object", bytes.NewReader(content)))
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+
+	start = time.Now()
+	reader, err := folder.ReadObject("object")
+	assert.NoError(t, err)
+	readContent, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, content, readContent)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+}
+
+func TestThrottledFolderSharesLimitsWithSubFolders(t *testing.T) {
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewStorage()), NewLimiter(Limits{OperationsPerSecond: 50}))
+	subFolder := folder.GetSubFolder("sub/")
+
+	start := time.Now()
+	for i := 0; i < 40; i++ {
+		_, err := folder.Exists("object")
+		assert.NoError(t, err)
+		_, err = subFolder.Exists("object")
+		assert.NoError(t, err)
+	}
+	assert.True(t, time.Since(start) >= 500*time.Millisecond)
+}
+
+func TestScheduledLimiterCurrentLimits(t *testing.T) {
+	night := Limits{UploadBytesPerSecond: 1000}
+	day := Limits{UploadBytesPerSecond: 10}
+	limiter := NewScheduledLimiter([]ScheduleEntry{
+		{Start: 18 * time.Hour, Limits: night},
+		{Start: 9 * time.Hour, Limits: day},
+	})
+
+	for hour, expected := range map[int]Limits{3: night, 9: day, 12: day, 18: night, 23: night} {
+		limiter.now = func() time.Time {
+			return time.Date(2020, 1, 1, hour, 30, 0, 0, time.Local)
+		}
+		assert.Equal(t, expected, limiter.CurrentLimits(), "hour %d", hour)
+	}
+	assert.Equal(t, Limits{}, NewScheduledLimiter(nil).CurrentLimits())
+}
+
+func TestThrottledFolderForwardsOptionalInterfaces(t *testing.T) {
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewStorage()), NewLimiter(Limits{}))
+
+	err := storage.PutObjectWithOptions(folder, "object", bytes.NewReader([]byte("data")),
+		storage.PutOptions{ContentType: "text/plain"})
+	assert.NoError(t, err)
+	attributes, err := storage.StatObject(folder, "object")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", attributes.ContentType)
+
+	_, err = storage.PutObjectWithCondition(folder, "object", bytes.NewReader(nil), storage.PutCondition{IfNoneMatch: true})
+	assert.IsType(t, storage.PreconditionFailedError{}, err)
+
+	// The memory folder has no native locks, so the lock is the object written through the throttled folder
+	lock, err := storage.NewLock(folder, "lock", "owner", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Acquire())
+	exists, err := folder.Exists("lock")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	_, err = storage.SignedURL(folder, "object", "GET", time.Minute)
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+
+	err = storage.PutObjectWithProgress(folder, "object", bytes.NewReader([]byte("data")), 4, storage.ProgressOptions{})
+	assert.NoError(t, err)
+	assert.False(t, storage.ObjectLockEnabled(folder))
+	_, err = storage.GetObjectLock(folder, "object")
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+	err = storage.SetStorageClass(folder, "object", "COLD")
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+	err = storage.RestoreObject(folder, "object", 1, "")
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+}
+
+func TestThrottledFolderForwardsVersions(t *testing.T) {
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewVersionedStorage()), NewLimiter(Limits{}))
+	assert.NoError(t, folder.PutObject("object", bytes.NewReader([]byte("first"))))
+	assert.NoError(t, folder.PutObject("object", bytes.NewReader([]byte("second"))))
+
+	versions, err := storage.ListObjectVersions(folder, "object")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	reader, err := storage.ReadObjectVersion(folder, "object", versions[1].VersionID)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+
+	assert.NoError(t, storage.DeleteObjectVersions(folder, versions[:1]))
+	versions, err = storage.ListObjectVersions(folder, "object")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+}
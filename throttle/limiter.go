@@ -0,0 +1,114 @@
+package throttle
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits are applied to all folders sharing the limiter, zero means unlimited
+type Limits struct {
+	UploadBytesPerSecond   int64
+	DownloadBytesPerSecond int64
+	OperationsPerSecond    float64
+}
+
+// ScheduleEntry applies limits from Start until the start of the next entry
+type ScheduleEntry struct {
+	// Start is the time of day in local time zone, e.g. 9 * time.Hour
+	Start  time.Duration
+	Limits Limits
+}
+
+// Limiter is a set of token buckets for uploaded bytes, downloaded bytes and operations
+type Limiter struct {
+	// schedule is sorted by start, the last entry is applied before the first one since midnight
+	schedule   []ScheduleEntry
+	upload     tokenBucket
+	download   tokenBucket
+	operations tokenBucket
+	now        func() time.Time
+}
+
+func NewLimiter(limits Limits) *Limiter {
+	return NewScheduledLimiter([]ScheduleEntry{{Start: 0, Limits: limits}})
+}
+
+// NewScheduledLimiter changes limits by time of day, e.g. stricter limits may be set for business hours
+func NewScheduledLimiter(schedule []ScheduleEntry) *Limiter {
+	sorted := append([]ScheduleEntry(nil), schedule...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+	return &Limiter{schedule: sorted, now: time.Now}
+}
+
+// CurrentLimits returns limits scheduled for now
+func (limiter *Limiter) CurrentLimits() Limits {
+	if len(limiter.schedule) == 0 {
+		return Limits{}
+	}
+	now := limiter.now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	sinceMidnight := now.Sub(midnight)
+	current := limiter.schedule[len(limiter.schedule)-1]
+	for _, entry := range limiter.schedule {
+		if entry.Start > sinceMidnight {
+			break
+		}
+		current = entry
+	}
+	return current.Limits
+}
+
+func (limiter *Limiter) waitUpload(bytes int) {
+	limiter.upload.take(float64(bytes), float64(limiter.CurrentLimits().UploadBytesPerSecond))
+}
+
+func (limiter *Limiter) waitDownload(bytes int) {
+	limiter.download.take(float64(bytes), float64(limiter.CurrentLimits().DownloadBytesPerSecond))
+}
+
+func (limiter *Limiter) waitOperation() {
+	limiter.operations.take(1, limiter.CurrentLimits().OperationsPerSecond)
+}
+
+// tokenBucket allows bursts of one second of the rate. Takers go into debt and wait until it is paid off,
+// so transfers bigger than the bucket are not blocked forever and concurrent takers are served in order
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// take waits for tokens, rate is passed on every call because it depends on the schedule. Zero rate is unlimited
+func (bucket *tokenBucket) take(tokens, rate float64) {
+	bucket.mutex.Lock()
+	now := time.Now()
+	if rate <= 0 {
+		bucket.rate, bucket.tokens, bucket.last = 0, 0, now
+		bucket.mutex.Unlock()
+		return
+	}
+	if bucket.rate != rate {
+		// The bucket is full after the limit changes, debt is kept
+		bucket.rate, bucket.tokens, bucket.last = rate, minFloat(bucket.tokens, 0)+rate, now
+	}
+	bucket.tokens = minFloat(rate, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	bucket.tokens -= tokens
+	var wait time.Duration
+	if bucket.tokens < 0 {
+		wait = time.Duration(-bucket.tokens / rate * float64(time.Second))
+	}
+	bucket.mutex.Unlock()
+	time.Sleep(wait)
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,284 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tinsane/storages/metrics"
+	"github.com/tinsane/storages/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attributes of storage spans
+const (
+	BackendAttribute    = attribute.Key("storage.backend")
+	PathAttribute       = attribute.Key("storage.path")
+	ObjectAttribute     = attribute.Key("storage.object")
+	BytesAttribute      = attribute.Key("storage.bytes")
+	CountAttribute      = attribute.Key("storage.count")
+	SubFoldersAttribute = attribute.Key("storage.subfolders")
+	ExistsAttribute     = attribute.Key("storage.exists")
+	VersionAttribute    = attribute.Key("storage.version")
+	ClassAttribute      = attribute.Key("storage.class")
+	// ResultAttribute is ok or the error class of metrics.ErrorClass
+	ResultAttribute = attribute.Key("storage.result")
+)
+
+const (
+	spanNamePrefix   = "storage."
+	successfulResult = "ok"
+)
+
+// Folder creates a span for every operation of the underlying folder. Folder methods have no context,
+// so spans are children of the span in the context passed by WithContext, or root spans by default
+type Folder struct {
+	underlying storage.Folder
+	backend    string
+	tracer     trace.Tracer
+	ctx        context.Context
+}
+
+// NewFolder uses backend name passed to storage.NewError, e.g. S3, GCS, Azure, Swift or FS
+func NewFolder(underlying storage.Folder, backend string, tracer trace.Tracer) *Folder {
+	return &Folder{underlying, backend, tracer, context.Background()}
+}
+
+// WithContext returns the folder, which creates spans as children of the span in the context
+func (folder *Folder) WithContext(ctx context.Context) *Folder {
+	return &Folder{folder.underlying, folder.backend, folder.tracer, ctx}
+}
+
+func (folder *Folder) startSpan(operation string, attributes ...attribute.KeyValue) trace.Span {
+	attributes = append(attributes, BackendAttribute.String(folder.backend), PathAttribute.String(folder.GetPath()))
+	_, span := folder.tracer.Start(folder.ctx, spanNamePrefix+operation, trace.WithAttributes(attributes...))
+	return span
+}
+
+// endSpan records the result, errors are classified the same way as in metrics
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetAttributes(ResultAttribute.String(metrics.ErrorClass(err)))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(ResultAttribute.String(successfulResult))
+	}
+	span.End()
+}
+
+func (folder *Folder) wrap(subFolder storage.Folder) *Folder {
+	return &Folder{subFolder, folder.backend, folder.tracer, folder.ctx}
+}
+
+func (folder *Folder) GetPath() string {
+	return folder.underlying.GetPath()
+}
+
+func (folder *Folder) ListFolder() (objects []storage.Object, subFolders []storage.Folder, err error) {
+	span := folder.startSpan(metrics.ListFolderOperation)
+	objects, underlyingSubFolders, err := folder.underlying.ListFolder()
+	span.SetAttributes(CountAttribute.Int(len(objects)), SubFoldersAttribute.Int(len(underlyingSubFolders)))
+	endSpan(span, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, subFolder := range underlyingSubFolders {
+		subFolders = append(subFolders, folder.wrap(subFolder))
+	}
+	return objects, subFolders, nil
+}
+
+func (folder *Folder) DeleteObjects(objectRelativePaths []string) error {
+	span := folder.startSpan(metrics.DeleteObjectsOperation, CountAttribute.Int(len(objectRelativePaths)))
+	err := folder.underlying.DeleteObjects(objectRelativePaths)
+	endSpan(span, err)
+	return err
+}
+
+func (folder *Folder) Exists(objectRelativePath string) (bool, error) {
+	span := folder.startSpan(metrics.ExistsOperation, ObjectAttribute.String(objectRelativePath))
+	exists, err := folder.underlying.Exists(objectRelativePath)
+	span.SetAttributes(ExistsAttribute.Bool(exists))
+	endSpan(span, err)
+	return exists, err
+}
+
+func (folder *Folder) GetSubFolder(subFolderRelativePath string) storage.Folder {
+	return folder.wrap(folder.underlying.GetSubFolder(subFolderRelativePath))
+}
+
+// ReadObject span covers reading of the content and ends when the reader is closed
+func (folder *Folder) ReadObject(objectRelativePath string) (io.ReadCloser, error) {
+	span := folder.startSpan(metrics.ReadObjectOperation, ObjectAttribute.String(objectRelativePath))
+	reader, err := folder.underlying.ReadObject(objectRelativePath)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	return &spanReader{reader: reader, span: span}, nil
+}
+
+func (folder *Folder) PutObject(name string, content io.Reader) error {
+	return folder.put(name, content, func(reader io.Reader) error {
+		return folder.underlying.PutObject(name, reader)
+	})
+}
+
+func (folder *Folder) PutObjectWithOptions(name string, content io.Reader, options storage.PutOptions) error {
+	return folder.put(name, content, func(reader io.Reader) error {
+		return storage.PutObjectWithOptions(folder.underlying, name, reader, options)
+	})
+}
+
+// PutObjectWithCondition has PutObject span, writes which lost the race have precondition_failed result
+func (folder *Folder) PutObjectWithCondition(name string, content io.Reader,
+	condition storage.PutCondition) (version string, err error) {
+	err = folder.put(name, content, func(reader io.Reader) (err error) {
+		version, err = storage.PutObjectWithCondition(folder.underlying, name, reader, condition)
+		return err
+	})
+	return version, err
+}
+
+// PutObjectWithStorageClass has PutObject span
+func (folder *Folder) PutObjectWithStorageClass(name string, content io.Reader, storageClass string) error {
+	return folder.put(name, content, func(reader io.Reader) error {
+		return storage.PutObjectWithStorageClass(folder.underlying, name, reader, storageClass)
+	}, ClassAttribute.String(storageClass))
+}
+
+// PutObjectWithProgress has PutObject span
+func (folder *Folder) PutObjectWithProgress(name string, content io.Reader, tracker *storage.ProgressTracker) error {
+	return folder.put(name, content, func(reader io.Reader) error {
+		return storage.PutObjectWithTracker(folder.underlying, name, reader, tracker)
+	})
+}
+
+func (folder *Folder) put(name string, content io.Reader, write func(reader io.Reader) error,
+	attributes ...attribute.KeyValue) error {
+	span := folder.startSpan(metrics.PutObjectOperation, append(attributes, ObjectAttribute.String(name))...)
+	reader := &spanReader{reader: content}
+	err := write(reader)
+	span.SetAttributes(BytesAttribute.Int64(reader.bytes))
+	endSpan(span, err)
+	return err
+}
+
+func (folder *Folder) StatObject(objectRelativePath string) (storage.ObjectAttributes, error) {
+	span := folder.startSpan(metrics.StatObjectOperation, ObjectAttribute.String(objectRelativePath))
+	attributes, err := storage.StatObject(folder.underlying, objectRelativePath)
+	endSpan(span, err)
+	return attributes, err
+}
+
+func (folder *Folder) SetStorageClass(objectRelativePath, storageClass string) error {
+	span := folder.startSpan(metrics.SetStorageClassOperation,
+		ObjectAttribute.String(objectRelativePath), ClassAttribute.String(storageClass))
+	err := storage.SetStorageClass(folder.underlying, objectRelativePath, storageClass)
+	endSpan(span, err)
+	return err
+}
+
+func (folder *Folder) ListObjectVersions(objectRelativePath string) ([]storage.ObjectVersion, error) {
+	span := folder.startSpan(metrics.ListObjectVersionsOperation, ObjectAttribute.String(objectRelativePath))
+	versions, err := storage.ListObjectVersions(folder.underlying, objectRelativePath)
+	span.SetAttributes(CountAttribute.Int(len(versions)))
+	endSpan(span, err)
+	return versions, err
+}
+
+// ReadObjectVersion has ReadObject span, which ends when the reader is closed
+func (folder *Folder) ReadObjectVersion(objectRelativePath, versionID string) (io.ReadCloser, error) {
+	span := folder.startSpan(metrics.ReadObjectOperation,
+		ObjectAttribute.String(objectRelativePath), VersionAttribute.String(versionID))
+	reader, err := storage.ReadObjectVersion(folder.underlying, objectRelativePath, versionID)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	return &spanReader{reader: reader, span: span}, nil
+}
+
+func (folder *Folder) DeleteObjectVersions(versions []storage.ObjectVersion) error {
+	span := folder.startSpan(metrics.DeleteObjectVersionsOperation, CountAttribute.Int(len(versions)))
+	err := storage.DeleteObjectVersions(folder.underlying, versions)
+	endSpan(span, err)
+	return err
+}
+
+// ObjectLockEnabled has no span, because it is the configuration of the folder
+func (folder *Folder) ObjectLockEnabled() bool {
+	return storage.ObjectLockEnabled(folder.underlying)
+}
+
+func (folder *Folder) GetObjectLock(objectRelativePath string) (storage.ObjectLock, error) {
+	span := folder.startSpan(metrics.GetObjectLockOperation, ObjectAttribute.String(objectRelativePath))
+	lock, err := storage.GetObjectLock(folder.underlying, objectRelativePath)
+	endSpan(span, err)
+	return lock, err
+}
+
+func (folder *Folder) RestoreObject(objectRelativePath string, days int64, tier string) error {
+	span := folder.startSpan(metrics.RestoreObjectOperation, ObjectAttribute.String(objectRelativePath))
+	err := storage.RestoreObject(folder.underlying, objectRelativePath, days, tier)
+	endSpan(span, err)
+	return err
+}
+
+func (folder *Folder) GetRestoreStatus(objectRelativePath string) (storage.RestoreStatus, error) {
+	span := folder.startSpan(metrics.GetRestoreStatusOperation, ObjectAttribute.String(objectRelativePath))
+	status, err := storage.GetRestoreStatus(folder.underlying, objectRelativePath)
+	endSpan(span, err)
+	return status, err
+}
+
+// SignedURL has no span, because URLs are signed locally
+func (folder *Folder) SignedURL(objectRelativePath, method string, expiry time.Duration) (string, error) {
+	return storage.SignedURL(folder.underlying, objectRelativePath, method, expiry)
+}
+
+// NewLock returns the native lock of the underlying folder, operations of the lock have no spans
+func (folder *Folder) NewLock(name, owner string, ttl time.Duration) (storage.Lock, error) {
+	return storage.NewNativeLock(folder.underlying, name, owner, ttl)
+}
+
+// spanReader counts bytes, the span is ended on close if it is set
+type spanReader struct {
+	reader  io.Reader
+	span    trace.Span
+	bytes   int64
+	readErr error
+	once    sync.Once
+}
+
+func (reader *spanReader) Read(p []byte) (n int, err error) {
+	n, err = reader.reader.Read(p)
+	reader.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		reader.readErr = err
+	}
+	return
+}
+
+func (reader *spanReader) Close() error {
+	var err error
+	if closer, ok := reader.reader.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if reader.span == nil {
+		return err
+	}
+	reader.once.Do(func() {
+		reader.span.SetAttributes(BytesAttribute.Int64(reader.bytes))
+		if reader.readErr != nil {
+			endSpan(reader.span, reader.readErr)
+		} else {
+			endSpan(reader.span, err)
+		}
+	})
+	return err
+}
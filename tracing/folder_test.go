@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tinsane/storages/memory"
+	"github.com/tinsane/storages/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, keyValue := range span.Attributes() {
+		if keyValue.Key == key {
+			return keyValue.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracedFolderCreatesSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewStorage()), "Memory", tracer)
+	content := bytes.Repeat([]byte{1}, 1000)
+
+	assert.NoError(t, folder.GetSubFolder("sub/").PutObject("object", bytes.NewReader(content)))
+	reader, err := folder.ReadObject("sub/object")
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	// The span of reading is not ended until the reader is closed
+	assert.Equal(t, 1, len(recorder.Ended()))
+	assert.NoError(t, reader.Close())
+	_, err = folder.ReadObject("missing")
+	assert.Error(t, err)
+
+	spans := recorder.Ended()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, "storage.PutObject", spans[0].Name())
+	assert.Equal(t, "in_memory/sub/", spanAttribute(spans[0], PathAttribute).AsString())
+	assert.Equal(t, int64(len(content)), spanAttribute(spans[0], BytesAttribute).AsInt64())
+	assert.Equal(t, "storage.ReadObject", spans[1].Name())
+	assert.Equal(t, int64(len(content)), spanAttribute(spans[1], BytesAttribute).AsInt64())
+	assert.Equal(t, "ok", spanAttribute(spans[1], ResultAttribute).AsString())
+	assert.Equal(t, codes.Error, spans[2].Status().Code)
+	assert.Equal(t, "not_found", spanAttribute(spans[2], ResultAttribute).AsString())
+}
+
+func TestTracedFolderCreatesSpansOfOptionalOperations(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewStorage()), "Memory", tracer)
+
+	assert.NoError(t, storage.PutObjectWithOptions(folder, "object", bytes.NewReader([]byte("data")),
+		storage.PutOptions{ContentType: "text/plain"}))
+	_, err := storage.PutObjectWithCondition(folder, "object", bytes.NewReader(nil), storage.PutCondition{IfNoneMatch: true})
+	assert.IsType(t, storage.PreconditionFailedError{}, err)
+	_, err = storage.StatObject(folder, "object")
+	assert.NoError(t, err)
+
+	spans := recorder.Ended()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, "storage.PutObject", spans[0].Name())
+	assert.Equal(t, int64(4), spanAttribute(spans[0], BytesAttribute).AsInt64())
+	assert.Equal(t, "precondition_failed", spanAttribute(spans[1], ResultAttribute).AsString())
+	assert.Equal(t, "storage.StatObject", spans[2].Name())
+}
+
+func TestTracedFolderCreatesSpansOfVersions(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	folder := NewFolder(memory.NewFolder("in_memory/", memory.NewVersionedStorage()), "Memory", tracer)
+
+	assert.NoError(t, storage.PutObjectWithProgress(folder, "object", bytes.NewReader([]byte("first")), 5,
+		storage.ProgressOptions{}))
+	assert.NoError(t, folder.PutObject("object", bytes.NewReader([]byte("second"))))
+	versions, err := storage.ListObjectVersions(folder, "object")
+	assert.NoError(t, err)
+	reader, err := storage.ReadObjectVersion(folder, "object", versions[1].VersionID)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.NoError(t, storage.DeleteObjectVersions(folder, versions[:1]))
+	err = storage.SetStorageClass(folder, "object", "COLD")
+	assert.IsType(t, storage.UnsupportedOperationError{}, err)
+
+	spans := recorder.Ended()
+	assert.Equal(t, 6, len(spans))
+	assert.Equal(t, "storage.PutObject", spans[0].Name())
+	assert.Equal(t, int64(5), spanAttribute(spans[0], BytesAttribute).AsInt64())
+	assert.Equal(t, "storage.ListObjectVersions", spans[2].Name())
+	assert.Equal(t, int64(2), spanAttribute(spans[2], CountAttribute).AsInt64())
+	assert.Equal(t, "storage.ReadObject", spans[3].Name())
+	assert.Equal(t, versions[1].VersionID, spanAttribute(spans[3], VersionAttribute).AsString())
+	assert.Equal(t, int64(5), spanAttribute(spans[3], BytesAttribute).AsInt64())
+	assert.Equal(t, "storage.DeleteObjectVersions", spans[4].Name())
+	assert.Equal(t, "storage.SetStorageClass", spans[5].Name())
+	assert.Equal(t, codes.Error, spans[5].Status().Code)
+}